@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultNeighborAnnouncementInterval = 1 * time.Second
+
+// neighborAnnouncementConfig controls gratuitous ARP and unsolicited
+// neighbor advertisements sent after an address was moved to this machine.
+// Stale neighbor caches would otherwise keep sending traffic elsewhere.
+type neighborAnnouncementConfig struct {
+	// Interface to send announcements on; defaults to the local interface
+	// of the address
+	Interface string `yaml:"interface"`
+
+	// Number of announcements per move; zero disables them
+	Count    int           `yaml:"count"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+func newNeighborAnnouncementConfig() neighborAnnouncementConfig {
+	return neighborAnnouncementConfig{
+		Interval: defaultNeighborAnnouncementInterval,
+	}
+}
+
+type neighborAnnouncementTarget struct {
+	Interface string
+	IP        net.IP
+}
+
+// neighborAnnouncer sends announcements for moved addresses. A nil
+// announcer does nothing.
+type neighborAnnouncer struct {
+	cfg neighborAnnouncementConfig
+
+	// Targets keyed by managed address
+	targets map[string][]neighborAnnouncementTarget
+}
+
+// newNeighborAnnouncer determines where to announce the given addresses.
+// Addresses configured on a local interface are announced with their local
+// IP, other addresses only without prefix.
+func newNeighborAnnouncer(cfg notifyConfig, addresses []netAddress) (*neighborAnnouncer, error) {
+	if cfg.NeighborAnnouncement.Count < 1 {
+		return nil, nil
+	}
+
+	local, err := cfg.localAddresses(addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &neighborAnnouncer{
+		cfg:     cfg.NeighborAnnouncement,
+		targets: map[string][]neighborAnnouncementTarget{},
+	}
+
+	for _, i := range local {
+		target := neighborAnnouncementTarget{Interface: a.cfg.Interface, IP: i.IP}
+		if target.Interface == "" {
+			target.Interface = i.Interface
+		}
+
+		key := i.Managed.String()
+		a.targets[key] = append(a.targets[key], target)
+	}
+
+	for _, address := range addresses {
+		key := address.String()
+		logger := logrus.WithField("address", key)
+
+		if _, ok := a.targets[key]; ok {
+			continue
+		}
+
+		if ones, bits := address.Mask.Size(); ones != bits {
+			logger.Debug("Not announcing network address")
+			continue
+		}
+
+		if a.cfg.Interface == "" {
+			logger.Warning("No interface to send neighbor announcements on")
+			continue
+		}
+
+		a.targets[key] = []neighborAnnouncementTarget{{Interface: a.cfg.Interface, IP: address.IP}}
+	}
+
+	return a, nil
+}
+
+// Announce sends the configured number of announcements for the addresses
+// and returns when done or when the context is cancelled
+func (a *neighborAnnouncer) Announce(ctx context.Context, addresses []netAddress) {
+	if a == nil {
+		return
+	}
+
+	for round := 0; round < a.cfg.Count; round++ {
+		if round > 0 {
+			timer := time.NewTimer(a.cfg.Interval)
+
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+
+		for _, address := range addresses {
+			for _, target := range a.targets[address.String()] {
+				logger := logrus.WithFields(logrus.Fields{
+					"address":   target.IP,
+					"interface": target.Interface,
+				})
+
+				if err := sendNeighborAnnouncement(target.Interface, target.IP); err != nil {
+					logger.Warningf("Sending neighbor announcement failed: %s", err)
+				} else if round == 0 {
+					logger.Infof("Announcing address %d time(s)", a.cfg.Count)
+				}
+			}
+		}
+	}
+}
+
+// gratuitousARPFrame returns an Ethernet frame with an ARP request for the
+// address sent from the address itself
+func gratuitousARPFrame(mac net.HardwareAddr, ip net.IP) []byte {
+	frame := make([]byte, 14+28)
+
+	// Ethernet header
+	copy(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(frame[6:12], mac)
+	binary.BigEndian.PutUint16(frame[12:14], 0x0806)
+
+	arp := frame[14:]
+	binary.BigEndian.PutUint16(arp[0:2], 1)      // Ethernet
+	binary.BigEndian.PutUint16(arp[2:4], 0x0800) // IPv4
+	arp[4] = 6
+	arp[5] = 4
+	binary.BigEndian.PutUint16(arp[6:8], 1) // Request
+	copy(arp[8:14], mac)
+	copy(arp[14:18], ip.To4())
+	copy(arp[24:28], ip.To4())
+
+	return frame
+}
+
+// unsolicitedNeighborAdvertisement returns an ICMPv6 neighbor advertisement
+// for the address with the override flag and the link-layer address set.
+// The checksum is left to the kernel.
+func unsolicitedNeighborAdvertisement(mac net.HardwareAddr, ip net.IP) []byte {
+	msg := make([]byte, 24+8)
+
+	msg[0] = 136  // Neighbor advertisement
+	msg[4] = 0x20 // Override
+	copy(msg[8:24], ip.To16())
+
+	// Target link-layer address option
+	msg[24] = 2
+	msg[25] = 1
+	copy(msg[26:32], mac)
+
+	return msg
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// htons converts to network byte order as expected by packet sockets
+func htons(value uint16) uint16 {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, value)
+	return binary.NativeEndian.Uint16(buf)
+}
+
+// sendNeighborAnnouncement sends a gratuitous ARP request for IPv4
+// addresses or an unsolicited neighbor advertisement for IPv6 addresses
+func sendNeighborAnnouncement(name string, ip net.IP) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("Interface %q: %w", name, err)
+	}
+
+	if len(iface.HardwareAddr) != 6 {
+		return fmt.Errorf("Interface %q has no Ethernet address", name)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return sendGratuitousARP(iface, ip4)
+	}
+
+	return sendUnsolicitedNeighborAdvertisement(iface, ip)
+}
+
+func sendGratuitousARP(iface *net.Interface, ip net.IP) error {
+	// Protocol zero as no packets are received
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Opening packet socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	addr := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  iface.Index,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	if err := unix.Sendto(fd, gratuitousARPFrame(iface.HardwareAddr, ip), 0, addr); err != nil {
+		return fmt.Errorf("Sending gratuitous ARP: %w", err)
+	}
+
+	return nil
+}
+
+func sendUnsolicitedNeighborAdvertisement(iface *net.Interface, ip net.IP) error {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_ICMPV6)
+	if err != nil {
+		return fmt.Errorf("Opening ICMPv6 socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	// Neighbor discovery messages with another hop limit are ignored
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return fmt.Errorf("Setting hop limit: %w", err)
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF, iface.Index); err != nil {
+		return fmt.Errorf("Selecting interface: %w", err)
+	}
+
+	dst := &unix.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(dst.Addr[:], net.IPv6linklocalallnodes)
+
+	if err := unix.Sendto(fd, unsolicitedNeighborAdvertisement(iface.HardwareAddr, ip), 0, dst); err != nil {
+		return fmt.Errorf("Sending neighbor advertisement: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func sendNeighborAnnouncement(name string, ip net.IP) error {
+	return errors.New("Neighbor announcements are only supported on Linux")
+}
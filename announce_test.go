@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGratuitousARPFrame(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+
+	frame := gratuitousARPFrame(mac, net.ParseIP("192.0.2.10"))
+
+	assert.Equal(t, []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x08, 0x06,
+		0x00, 0x01, 0x08, 0x00, 6, 4, 0x00, 0x01,
+		0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 192, 0, 2, 10,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 192, 0, 2, 10,
+	}, frame)
+}
+
+func TestUnsolicitedNeighborAdvertisement(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+
+	msg := unsolicitedNeighborAdvertisement(mac, net.ParseIP("2001:db8::1"))
+
+	assert.Equal(t, []byte{
+		136, 0, 0, 0, 0x20, 0, 0, 0,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		2, 1, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01,
+	}, msg)
+}
+
+func TestNeighborAnnouncerTargets(t *testing.T) {
+	cfg := newNotifyConfig()
+	cfg.ManagedAddresses = []managedAddress{{
+		Address: mustParseNetAddress("192.0.2.0/24"),
+		Local:   localAddressConfig{Interface: "eth1", Address: "192.0.2.201/24"},
+	}}
+	cfg.NeighborAnnouncement.Interface = "eth0"
+
+	addresses := []netAddress{
+		mustParseNetAddress("192.0.2.0/24"),
+		mustParseNetAddress("198.51.100.10"),
+		mustParseNetAddress("2001:db8:1:200::/56"),
+	}
+
+	a, err := newNeighborAnnouncer(cfg, addresses)
+	require.NoError(t, err)
+	assert.Nil(t, a, "disabled by default")
+
+	// Announcing with a nil announcer does nothing
+	a.Announce(context.Background(), addresses)
+
+	cfg.NeighborAnnouncement.Count = 3
+
+	a, err = newNeighborAnnouncer(cfg, addresses)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string][]neighborAnnouncementTarget{
+		"192.0.2.0/24":     {{Interface: "eth0", IP: net.ParseIP("192.0.2.201").To4()}},
+		"198.51.100.10/32": {{Interface: "eth0", IP: net.ParseIP("198.51.100.10").To4()}},
+	}, a.targets)
+
+	// Without a global interface the local one is used
+	cfg.NeighborAnnouncement.Interface = ""
+
+	a, err = newNeighborAnnouncer(cfg, addresses)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string][]neighborAnnouncementTarget{
+		"192.0.2.0/24": {{Interface: "eth1", IP: net.ParseIP("192.0.2.201").To4()}},
+	}, a.targets)
+}
+
+func TestNeighborAnnouncerCancelled(t *testing.T) {
+	cfg := newNotifyConfig()
+	cfg.NeighborAnnouncement = neighborAnnouncementConfig{
+		Interface: "missing0",
+		Count:     100,
+		Interval:  1 * time.Hour,
+	}
+
+	a, err := newNeighborAnnouncer(cfg, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Returns after the first round
+	a.Announce(ctx, []netAddress{mustParseNetAddress("192.0.2.10")})
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// How long a refresh may take beyond its deadline
+const conformanceCancelSlack = 1 * time.Second
+
+// conformanceAPI wraps a fake provider API. All requests can be made to
+// fail or to stall until cancelled.
+type conformanceAPI struct {
+	next http.Handler
+
+	// Closed at the end of the test so stalled requests don't block
+	// shutting down the server
+	done chan struct{}
+
+	mu     sync.Mutex
+	status int
+	stall  bool
+}
+
+func (a *conformanceAPI) setStatus(status int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.status = status
+}
+
+func (a *conformanceAPI) setStall(stall bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.stall = stall
+}
+
+func (a *conformanceAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	status, stall := a.status, a.stall
+	a.mu.Unlock()
+
+	switch {
+	case stall:
+		// The server only notices the client going away once the body
+		// has been read
+		io.Copy(io.Discard, r.Body)
+
+		select {
+		case <-r.Context().Done():
+		case <-a.done:
+		}
+
+	case status != 0:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"detail": "Injected %d", "message": "Injected %d"}`, status, status)
+
+	default:
+		a.next.ServeHTTP(w, r)
+	}
+}
+
+// newConformanceServer starts a server for the fake API and returns its URL
+func newConformanceServer(t *testing.T, next http.Handler) (*conformanceAPI, string) {
+	api := &conformanceAPI{
+		next: next,
+		done: make(chan struct{}),
+	}
+
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(api.done) })
+
+	return api, server.URL
+}
+
+// conformanceProvider sets up a provider for the conformance tests
+type conformanceProvider struct {
+	name string
+
+	// newProvider returns a provider for the addresses, which are routed to
+	// another machine initially. A non-zero status is returned by the API
+	// from the start, before the provider is set up. The API is nil for
+	// providers without one.
+	newProvider func(t *testing.T, addresses []netAddress, status int) (elasticIPProvider, *conformanceAPI)
+}
+
+// conformanceProviders lists all providers; new ones must be added here
+var conformanceProviders = []conformanceProvider{
+	{
+		name: "fake",
+		newProvider: func(t *testing.T, addresses []netAddress, _ int) (elasticIPProvider, *conformanceAPI) {
+			cfg := newFakeNotifyConfig()
+			cfg.Owners = fakeOtherOwners(addresses)
+
+			provider, err := cfg.NewProvider(context.Background())
+			require.NoError(t, err)
+
+			return provider, nil
+		},
+	},
+	{
+		name: "fake-state-file",
+		newProvider: func(t *testing.T, addresses []netAddress, _ int) (elasticIPProvider, *conformanceAPI) {
+			cfg := newFakeNotifyConfig()
+			cfg.StateFile = filepath.Join(t.TempDir(), "state.json")
+			cfg.Owners = fakeOtherOwners(addresses)
+
+			provider, err := cfg.NewProvider(context.Background())
+			require.NoError(t, err)
+
+			return provider, nil
+		},
+	},
+	{
+		name: "cloudscale",
+		newProvider: func(t *testing.T, addresses []netAddress, status int) (elasticIPProvider, *conformanceAPI) {
+			return newCloudscaleConformanceProvider(t, addresses, status, false)
+		},
+	},
+	{
+		name: "cloudscale-discovered",
+		newProvider: func(t *testing.T, addresses []netAddress, status int) (elasticIPProvider, *conformanceAPI) {
+			return newCloudscaleConformanceProvider(t, addresses, status, true)
+		},
+	},
+	{
+		name: "exoscale",
+		newProvider: func(t *testing.T, addresses []netAddress, status int) (elasticIPProvider, *conformanceAPI) {
+			return newExoscaleConformanceProvider(t, addresses, status, false)
+		},
+	},
+	{
+		name: "exoscale-discovered",
+		newProvider: func(t *testing.T, addresses []netAddress, status int) (elasticIPProvider, *conformanceAPI) {
+			return newExoscaleConformanceProvider(t, addresses, status, true)
+		},
+	},
+}
+
+// conformanceIdentity returns the identity configuration for providers
+// discovering the ID of the machine from the config drive
+func conformanceIdentity(t *testing.T, name, content string) identityConfig {
+	dir := t.TempDir()
+	writeIdentityTestFile(t, filepath.Join(dir, filepath.FromSlash(name)), content)
+
+	return identityConfig{
+		Sources:           []string{identitySourceConfigDrive},
+		ConfigDrive:       dir,
+		CacheFileTemplate: filepath.Join(dir, "identity.%s.json"),
+		CacheTTL:          time.Hour,
+	}
+}
+
+// conformanceContext returns a context cancelled at the end of the test,
+// stopping confirmations of identities in the background
+func conformanceContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func newCloudscaleConformanceProvider(t *testing.T, addresses []netAddress, status int, discover bool) (elasticIPProvider, *conformanceAPI) {
+	fake := newFakeCloudscaleAPI()
+	for _, address := range addresses {
+		fake.addFloatingIP(address.String(), "", fakeCloudscaleOtherUUID)
+	}
+
+	api, endpoint := newConformanceServer(t, fake)
+	api.setStatus(status)
+	endpointURL := mustParseTextURL(endpoint + "/")
+
+	cfg := cloudscaleNotifyConfig{
+		Endpoint: &endpointURL,
+		Token:    "token",
+	}
+
+	identity := identityConfig{}
+	if discover {
+		identity = conformanceIdentity(t, "openstack/latest/meta_data.json",
+			fmt.Sprintf(`{"meta": {"cloudscale_uuid": %q}}`, fakeCloudscaleServerUUID))
+	} else {
+		cfg.ServerUUID = uuid.Must(uuid.FromString(fakeCloudscaleServerUUID))
+	}
+
+	provider, err := cfg.NewProvider(conformanceContext(t), identity, rateLimitConfig{}, httpConfig{})
+	require.NoError(t, err)
+
+	return provider, api
+}
+
+func newExoscaleConformanceProvider(t *testing.T, addresses []netAddress, status int, discover bool) (elasticIPProvider, *conformanceAPI) {
+	fake := newFakeExoscaleAPI(2)
+	for i, address := range addresses {
+		fake.addElasticIP(fakeExoscaleUUID(1000+i), address.IP.String())
+		fake.attach(fakeExoscaleUUID(2), fakeExoscaleUUID(1000+i))
+	}
+
+	api, endpoint := newConformanceServer(t, fake)
+	api.setStatus(status)
+	endpointURL := mustParseTextURL(endpoint)
+
+	cfg := exoscaleNotifyConfig{
+		Endpoint: &endpointURL,
+		Zone:     "ch-gva-2",
+		Key:      "EXOtest",
+		Secret:   "secret",
+	}
+
+	identity := identityConfig{}
+	if discover {
+		identity = conformanceIdentity(t, exoscaleConfigDriveFile,
+			fmt.Sprintf("instance-id: %s\n", fakeExoscaleUUID(1)))
+	} else {
+		cfg.InstanceID = fakeExoscaleUUID(1).String()
+	}
+
+	provider, err := cfg.NewProvider(conformanceContext(t), identity, rateLimitConfig{}, httpConfig{})
+	require.NoError(t, err)
+
+	return provider, api
+}
+
+func conformanceAddresses(n int) []netAddress {
+	result := []netAddress{}
+	for i := 1; i <= n; i++ {
+		result = append(result, mustParseNetAddress(fmt.Sprintf("192.0.2.%d", i)))
+	}
+	return result
+}
+
+func newConformanceRefresher(t *testing.T, provider elasticIPProvider, address netAddress) elasticIPRefresher {
+	r, err := provider.NewElasticIPRefresher(context.Background(), logrus.WithField("test", t.Name()), address)
+	require.NoError(t, err)
+	return r
+}
+
+// TestProviderConformance verifies the behaviour all providers must share
+func TestProviderConformance(t *testing.T) {
+	for _, p := range conformanceProviders {
+		t.Run(p.name, func(t *testing.T) {
+			runProviderConformance(t, p)
+		})
+	}
+}
+
+func runProviderConformance(t *testing.T, p conformanceProvider) {
+	t.Run("idempotent-refresh", func(t *testing.T) {
+		address := conformanceAddresses(1)[0]
+		provider, _ := p.newProvider(t, []netAddress{address}, 0)
+		r := newConformanceRefresher(t, provider, address)
+		ctx := context.Background()
+
+		for i := 0; i < 3; i++ {
+			moved, err := r.Refresh(ctx)
+			require.NoError(t, err)
+			if i == 0 {
+				assert.True(t, moved, "Address routed elsewhere must be reported as moved")
+			} else {
+				assert.False(t, moved, "Address routed here must not be reported as moved")
+			}
+
+			owners, err := r.Owners(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{provider.Identity()}, owners)
+		}
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		address := conformanceAddresses(1)[0]
+		provider, api := p.newProvider(t, []netAddress{address}, 0)
+		if api == nil {
+			t.Skip("Provider has no API")
+		}
+		r := newConformanceRefresher(t, provider, address)
+
+		api.setStall(true)
+
+		timeout := 100 * time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		start := time.Now()
+		_, err := r.Refresh(ctx)
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), timeout+conformanceCancelSlack)
+
+		api.setStall(false)
+
+		_, err = r.Refresh(context.Background())
+		assert.NoError(t, err)
+	})
+
+	t.Run("error-classification", func(t *testing.T) {
+		address := conformanceAddresses(1)[0]
+		provider, api := p.newProvider(t, []netAddress{address}, 0)
+		if api == nil {
+			t.Skip("Provider has no API")
+		}
+		r := newConformanceRefresher(t, provider, address)
+
+		for _, tc := range []struct {
+			status    int
+			permanent bool
+		}{
+			{status: http.StatusBadRequest, permanent: true},
+			{status: http.StatusUnauthorized, permanent: true},
+			{status: http.StatusForbidden, permanent: true},
+			{status: http.StatusNotFound, permanent: true},
+			{status: http.StatusInternalServerError},
+			{status: http.StatusBadGateway},
+			{status: http.StatusServiceUnavailable},
+		} {
+			api.setStatus(tc.status)
+
+			_, err := r.Refresh(context.Background())
+			require.Errorf(t, err, "HTTP %d", tc.status)
+
+			var permanent *backoff.PermanentError
+			assert.Equalf(t, tc.permanent, errors.As(err, &permanent), "HTTP %d: %s", tc.status, err)
+		}
+
+		api.setStatus(0)
+
+		_, err := r.Refresh(context.Background())
+		assert.NoError(t, err)
+	})
+
+	t.Run("test-bad-credentials", func(t *testing.T) {
+		addresses := conformanceAddresses(2)
+		provider, api := p.newProvider(t, addresses, 0)
+
+		report := &selfTestReport{}
+		provider.Test(context.Background(), addresses, newSelfTestConfig(), report)
+		assert.Equal(t, checkOK, report.Status())
+
+		if api == nil {
+			t.Skip("Provider has no API")
+		}
+
+		expectCredentialsCritical := func(provider elasticIPProvider) {
+			report := &selfTestReport{}
+			provider.Test(context.Background(), addresses, newSelfTestConfig(), report)
+			assert.Equal(t, checkCritical, report.Status())
+
+			found := false
+			for _, c := range report.Checks() {
+				if c.Name == "credentials" {
+					found = true
+					assert.Equal(t, checkCritical, c.Status)
+				}
+			}
+			assert.True(t, found, "Credentials check missing")
+		}
+
+		api.setStatus(http.StatusUnauthorized)
+		expectCredentialsCritical(provider)
+
+		// Bad credentials must not prevent setting up the provider, even
+		// if its identity has yet to be confirmed
+		provider, _ = p.newProvider(t, addresses, http.StatusUnauthorized)
+		expectCredentialsCritical(provider)
+	})
+
+	t.Run("concurrent-refreshers", func(t *testing.T) {
+		addresses := conformanceAddresses(4)
+		provider, _ := p.newProvider(t, addresses, 0)
+		ctx := context.Background()
+
+		refreshers := []elasticIPRefresher{}
+		for _, address := range addresses {
+			refreshers = append(refreshers, newConformanceRefresher(t, provider, address))
+		}
+
+		var mu sync.Mutex
+		var errs []error
+
+		wg := sync.WaitGroup{}
+		for _, r := range refreshers {
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func(r elasticIPRefresher) {
+					defer wg.Done()
+					if _, err := r.Refresh(ctx); err != nil {
+						mu.Lock()
+						errs = append(errs, err)
+						mu.Unlock()
+					}
+				}(r)
+			}
+		}
+		wg.Wait()
+
+		assert.Empty(t, errs)
+
+		for _, r := range refreshers {
+			owners, err := r.Owners(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{provider.Identity()}, owners)
+		}
+
+		if batchProvider, ok := provider.(elasticIPBatchProvider); ok {
+			b, err := batchProvider.NewElasticIPBatchRefresher(ctx, logrus.WithField("test", t.Name()), addresses)
+			require.NoError(t, err)
+
+			for _, result := range b.RefreshAll(ctx, b.Addresses()) {
+				assert.NoError(t, result.Err)
+			}
+		}
+	})
+}
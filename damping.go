@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDampingStateFileTemplate = "/var/lib/floaty/damping.%s.json"
+
+	// Defaults as recommended for BGP route flap damping in RFC 2439
+	defaultDampingPenalty       = 1000
+	defaultDampingSuppressLimit = 2000
+	defaultDampingReuseLimit    = 750
+)
+
+// dampingConfig controls how quickly floaty reacts to repeated transitions
+// into MASTER status. All mechanisms are disabled by default.
+type dampingConfig struct {
+	StateFileTemplate string `yaml:"state-file-template"`
+
+	// Delay before the first refresh after entering MASTER status
+	HoldDown time.Duration `yaml:"hold-down"`
+
+	// Maximum number of takeovers within the given window
+	MaxTakeovers   int           `yaml:"max-takeovers"`
+	TakeoverWindow time.Duration `yaml:"takeover-window"`
+
+	// Penalty-based damping; a zero half-life disables it
+	HalfLife      time.Duration `yaml:"half-life"`
+	Penalty       float64       `yaml:"penalty"`
+	SuppressLimit float64       `yaml:"suppress-limit"`
+	ReuseLimit    float64       `yaml:"reuse-limit"`
+}
+
+func newDampingConfig() dampingConfig {
+	return dampingConfig{
+		StateFileTemplate: defaultDampingStateFileTemplate,
+		Penalty:           defaultDampingPenalty,
+		SuppressLimit:     defaultDampingSuppressLimit,
+		ReuseLimit:        defaultDampingReuseLimit,
+	}
+}
+
+func (cfg dampingConfig) enabled() bool {
+	return cfg.HoldDown > 0 || cfg.rateLimited() || cfg.HalfLife > 0
+}
+
+func (cfg dampingConfig) rateLimited() bool {
+	return cfg.MaxTakeovers > 0 && cfg.TakeoverWindow > 0
+}
+
+func (cfg dampingConfig) makeStateFilePath(name string) string {
+	return fmt.Sprintf(cfg.StateFileTemplate, url.PathEscape(name))
+}
+
+// dampingState is persisted between invocations as each transition is
+// usually handled by a separate process
+type dampingState struct {
+	Takeovers  []time.Time `json:"takeovers,omitempty"`
+	Penalty    float64     `json:"penalty"`
+	Updated    time.Time   `json:"updated"`
+	Suppressed bool        `json:"suppressed"`
+}
+
+// decayPenalty reduces the penalty exponentially according to the time
+// passed since the last update
+func (cfg dampingConfig) decayPenalty(state *dampingState, now time.Time) {
+	if cfg.HalfLife <= 0 || state.Updated.IsZero() {
+		state.Updated = now
+		return
+	}
+
+	if elapsed := now.Sub(state.Updated); elapsed > 0 {
+		state.Penalty *= math.Pow(0.5, float64(elapsed)/float64(cfg.HalfLife))
+	}
+
+	state.Updated = now
+}
+
+// recordTakeover adds a takeover at the given time to the state and returns
+// how long to wait before the floating IPs may be moved
+func (cfg dampingConfig) recordTakeover(state *dampingState, now time.Time) time.Duration {
+	wait := cfg.HoldDown
+
+	if cfg.rateLimited() {
+		takeovers := []time.Time{}
+		for _, ts := range state.Takeovers {
+			if now.Sub(ts) < cfg.TakeoverWindow {
+				takeovers = append(takeovers, ts)
+			}
+		}
+		takeovers = append(takeovers, now)
+		state.Takeovers = takeovers
+
+		if excess := len(takeovers) - cfg.MaxTakeovers; excess > 0 {
+			// Wait until enough earlier takeovers have left the window
+			if d := takeovers[excess-1].Add(cfg.TakeoverWindow).Sub(now); d > wait {
+				wait = d
+			}
+		}
+	} else {
+		state.Takeovers = nil
+	}
+
+	if cfg.HalfLife > 0 {
+		cfg.decayPenalty(state, now)
+
+		if state.Penalty < cfg.ReuseLimit {
+			// Calmed down since the last takeover
+			state.Suppressed = false
+		}
+
+		state.Penalty += cfg.Penalty
+
+		if state.Penalty > cfg.SuppressLimit {
+			state.Suppressed = true
+		}
+
+		if state.Suppressed && cfg.ReuseLimit > 0 {
+			// Time until the penalty has decayed below the reuse limit
+			halfLives := math.Log2(state.Penalty / cfg.ReuseLimit)
+			if d := time.Duration(halfLives * float64(cfg.HalfLife)); d > wait {
+				wait = d
+			}
+		}
+	} else {
+		state.Penalty = 0
+		state.Suppressed = false
+		state.Updated = now
+	}
+
+	return wait
+}
+
+func readDampingState(path string) (dampingState, error) {
+	state := dampingState{}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return dampingState{}, fmt.Errorf("Parsing damping state %q: %w", path, err)
+	}
+
+	return state, nil
+}
+
+func writeDampingState(path string, state dampingState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data, 0644)
+}
+
+// waitForDamping records a takeover of the given VRRP instance and blocks
+// until the configured damping allows the floating IPs to be moved. Returns
+// false if the context was cancelled while waiting.
+func waitForDamping(ctx context.Context, cfg dampingConfig, instance string) bool {
+	if !cfg.enabled() {
+		return true
+	}
+
+	path := cfg.makeStateFilePath(instance)
+
+	state, err := readDampingState(path)
+	if err != nil {
+		// A broken state file must not prevent failover
+		logrus.Warningf("Reading damping state failed, starting over: %s", err)
+		state = dampingState{}
+	}
+
+	wait := cfg.recordTakeover(&state, time.Now())
+
+	if err := writeDampingState(path, state); err != nil {
+		logrus.Warningf("Writing damping state %q failed: %s", path, err)
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"takeovers":  len(state.Takeovers),
+		"penalty":    math.Round(state.Penalty),
+		"suppressed": state.Suppressed,
+	})
+
+	if wait <= 0 {
+		logger.Debug("No takeover damping required")
+		return true
+	}
+
+	logger.Infof("Damping takeover, waiting %s before refreshing addresses", wait.Round(time.Second))
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		logger.Info("Takeover aborted while damping")
+		return false
+	case <-timer.C:
+	}
+
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDampingDisabled(t *testing.T) {
+	cfg := newDampingConfig()
+	assert.False(t, cfg.enabled())
+
+	state := dampingState{}
+	assert.Equal(t, time.Duration(0), cfg.recordTakeover(&state, time.Now()))
+}
+
+func TestDampingHoldDown(t *testing.T) {
+	cfg := newDampingConfig()
+	cfg.HoldDown = 3 * time.Second
+	assert.True(t, cfg.enabled())
+
+	state := dampingState{}
+	assert.Equal(t, 3*time.Second, cfg.recordTakeover(&state, time.Now()))
+}
+
+func TestDampingMaxTakeovers(t *testing.T) {
+	cfg := newDampingConfig()
+	cfg.MaxTakeovers = 2
+	cfg.TakeoverWindow = 10 * time.Minute
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	state := dampingState{}
+
+	assert.Equal(t, time.Duration(0), cfg.recordTakeover(&state, start))
+	assert.Equal(t, time.Duration(0), cfg.recordTakeover(&state, start.Add(time.Minute)))
+
+	// Third takeover within window must wait for the first to expire
+	assert.Equal(t, 8*time.Minute, cfg.recordTakeover(&state, start.Add(2*time.Minute)))
+	assert.Len(t, state.Takeovers, 3)
+
+	// Earlier takeovers are forgotten after the window
+	assert.Equal(t, time.Duration(0), cfg.recordTakeover(&state, start.Add(30*time.Minute)))
+	assert.Len(t, state.Takeovers, 1)
+}
+
+func TestDampingPenalty(t *testing.T) {
+	cfg := newDampingConfig()
+	cfg.HalfLife = 10 * time.Minute
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	state := dampingState{}
+
+	assert.Equal(t, time.Duration(0), cfg.recordTakeover(&state, start))
+	assert.Equal(t, time.Duration(0), cfg.recordTakeover(&state, start))
+	assert.False(t, state.Suppressed)
+
+	// Penalty of 3000 exceeds the suppress limit
+	wait := cfg.recordTakeover(&state, start)
+	assert.True(t, state.Suppressed)
+	assert.InDelta(t, 3000, state.Penalty, 0.001)
+	assert.InDelta(t, float64(20*time.Minute), float64(wait), float64(time.Second))
+
+	// Still suppressed as the penalty has only decayed to 1500 before adding
+	// another 1000
+	wait = cfg.recordTakeover(&state, start.Add(10*time.Minute))
+	assert.True(t, state.Suppressed)
+	assert.InDelta(t, 2500, state.Penalty, 0.001)
+	assert.Greater(t, wait, 17*time.Minute)
+
+	// Penalty has decayed below the reuse limit; a single takeover doesn't
+	// lead to suppression
+	assert.Equal(t, time.Duration(0), cfg.recordTakeover(&state, start.Add(40*time.Minute)))
+	assert.False(t, state.Suppressed)
+
+	// Long after, the penalty is below the reuse limit
+	assert.Equal(t, time.Duration(0), cfg.recordTakeover(&state, start.Add(24*time.Hour)))
+	assert.False(t, state.Suppressed)
+}
+
+func TestDampingStateFile(t *testing.T) {
+	cfg := newDampingConfig()
+	cfg.StateFileTemplate = filepath.Join(t.TempDir(), "sub", "damping.%s.json")
+	cfg.MaxTakeovers = 1
+	cfg.TakeoverWindow = time.Hour
+
+	assert.True(t, waitForDamping(context.Background(), cfg, "foo/bar"))
+
+	state, err := readDampingState(cfg.makeStateFilePath("foo/bar"))
+	require.NoError(t, err)
+	assert.Len(t, state.Takeovers, 1)
+
+	// Second takeover is delayed until the context is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.False(t, waitForDamping(ctx, cfg, "foo/bar"))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	commandDiff = "diff"
+
+	diffDesiredOther = "other"
+
+	diffStatusOK       = "ok"
+	diffStatusMismatch = "mismatch"
+	diffStatusError    = "error"
+)
+
+// diffEntry compares the desired and the actual destination of an address
+type diffEntry struct {
+	Instance string   `json:"instance,omitempty"`
+	Address  string   `json:"address"`
+	Local    bool     `json:"local"`
+	Desired  string   `json:"desired"`
+	Actual   []string `json:"actual"`
+	Status   string   `json:"status"`
+	Error    string   `json:"error,omitempty"`
+
+	address netAddress
+}
+
+func findDiffEntries(cfg notifyConfig, instance string) ([]diffEntry, error) {
+	var addresses map[string][]netAddress
+
+	if instance == "" {
+		var err error
+		if addresses, err = cfg.getAllAddresses(); err != nil {
+			return nil, err
+		}
+	} else {
+		instanceAddresses, err := cfg.getAddresses(instance)
+		if err != nil {
+			return nil, err
+		}
+		addresses = map[string][]netAddress{instance: instanceAddresses}
+	}
+
+	entries := []diffEntry{}
+	for name, i := range addresses {
+		for _, address := range i {
+			entries = append(entries, diffEntry{
+				Instance: name,
+				Address:  address.String(),
+				address:  address,
+			})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Instance != entries[j].Instance {
+			return entries[i].Instance < entries[j].Instance
+		}
+		return entries[i].Address < entries[j].Address
+	})
+
+	return entries, nil
+}
+
+// addressIsLocal reports whether the address is configured on a local
+// interface, which Keepalived does for instances in MASTER status
+func addressIsLocal(address netAddress, localAddrs []net.Addr) bool {
+	for _, i := range localAddrs {
+		if ipnet, ok := i.(*net.IPNet); ok && address.Contains(ipnet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// compare fills in the desired and actual destination and the resulting
+// status
+func (e *diffEntry) compare(ctx context.Context, provider elasticIPProvider, localAddrs []net.Addr) {
+	self := provider.Identity()
+
+	e.Local = addressIsLocal(e.address, localAddrs)
+	e.Desired = diffDesiredOther
+	if e.Local {
+		e.Desired = self
+	}
+
+	logger := logrus.WithField("address", e.address)
+
+	owners, err := func() ([]string, error) {
+		refresher, err := provider.NewElasticIPRefresher(ctx, logger, e.address)
+		if err != nil {
+			return nil, err
+		}
+		return refresher.Owners(ctx)
+	}()
+	if err != nil {
+		e.Status = diffStatusError
+		e.Error = err.Error()
+		return
+	}
+
+	e.Actual = append([]string{}, owners...)
+	sort.Strings(e.Actual)
+
+	ownedBySelf := false
+	for _, owner := range owners {
+		if owner == self {
+			ownedBySelf = true
+		}
+	}
+
+	e.Status = diffStatusMismatch
+	if e.Local && ownedBySelf && len(owners) == 1 {
+		e.Status = diffStatusOK
+	} else if !e.Local && !ownedBySelf && len(owners) > 0 {
+		e.Status = diffStatusOK
+	}
+}
+
+func writeDiffTable(out io.Writer, entries []diffEntry) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "INSTANCE\tADDRESS\tLOCAL\tDESIRED\tACTUAL\tSTATUS")
+
+	for _, e := range entries {
+		instance := e.Instance
+		if instance == "" {
+			instance = "-"
+		}
+
+		actual := "none"
+		if len(e.Actual) > 0 {
+			actual = strings.Join(e.Actual, ",")
+		}
+
+		status := e.Status
+		if e.Error != "" {
+			status = fmt.Sprintf("%s: %s", e.Status, e.Error)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%s\n",
+			instance, e.Address, e.Local, e.Desired, actual, status)
+	}
+
+	return w.Flush()
+}
+
+// runDiff prints the desired and actual destination of all managed addresses,
+// optionally limited to a single VRRP instance
+func runDiff(ctx context.Context, cfg notifyConfig, instance string, asJSON bool, out io.Writer) error {
+	entries, err := findDiffEntries(cfg, instance)
+	if err != nil {
+		return err
+	}
+
+	localAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("Listing local addresses: %w", err)
+	}
+
+	provider, err := cfg.NewProvider(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
+	defer cancel()
+
+	failed := 0
+	for i := range entries {
+		entries[i].compare(ctx, provider, localAddrs)
+		if entries[i].Status != diffStatusOK {
+			failed++
+		}
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(entries)
+	} else {
+		err = writeDiffTable(out, entries)
+	}
+	if err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d address(es) not routed as desired", failed, len(entries))
+	}
+
+	return nil
+}
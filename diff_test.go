@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressIsLocal(t *testing.T) {
+	_, local, err := net.ParseCIDR("192.0.2.10/24")
+	require.NoError(t, err)
+	local.IP = net.ParseIP("192.0.2.10")
+
+	localAddrs := []net.Addr{local}
+
+	assert.True(t, addressIsLocal(mustParseNetAddress("192.0.2.10"), localAddrs))
+	assert.False(t, addressIsLocal(mustParseNetAddress("192.0.2.11"), localAddrs))
+	assert.True(t, addressIsLocal(mustParseNetAddress("192.0.2.0/28"), localAddrs))
+}
+
+func TestFindDiffEntries(t *testing.T) {
+	cfg := setupManualTest(t)
+
+	entries, err := findDiffEntries(cfg, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "bar", entries[0].Instance)
+	assert.Equal(t, "192.0.2.11/32", entries[0].Address)
+	assert.Equal(t, "foo", entries[1].Instance)
+
+	entries, err = findDiffEntries(cfg, "foo")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "192.0.2.10/32", entries[0].Address)
+
+	_, err = findDiffEntries(cfg, "missing")
+	assert.Error(t, err)
+}
+
+func TestDiffCompare(t *testing.T) {
+	provider := &fakeElasticIPProvider{}
+
+	owned := mustParseNetAddress("192.0.2.10")
+	refresher, err := provider.NewElasticIPRefresher(context.Background(), logrus.WithField("address", owned), owned)
+	require.NoError(t, err)
+	mustRefresh(t, context.Background(), refresher)
+
+	localAddrs := []net.Addr{&net.IPNet{IP: owned.IP, Mask: owned.Mask}}
+
+	local := diffEntry{address: owned}
+	local.compare(context.Background(), provider, localAddrs)
+	assert.Equal(t, diffStatusOK, local.Status)
+	assert.Equal(t, fakeIdentity, local.Desired)
+	assert.Equal(t, []string{fakeIdentity}, local.Actual)
+
+	remote := diffEntry{address: owned}
+	remote.compare(context.Background(), provider, nil)
+	assert.Equal(t, diffStatusMismatch, remote.Status)
+	assert.Equal(t, diffDesiredOther, remote.Desired)
+
+	unassigned := diffEntry{address: mustParseNetAddress("192.0.2.11")}
+	unassigned.compare(context.Background(), provider, nil)
+	assert.Equal(t, diffStatusMismatch, unassigned.Status)
+	assert.Empty(t, unassigned.Actual)
+}
+
+func TestRunDiff(t *testing.T) {
+	cfg := setupManualTest(t)
+
+	out := &bytes.Buffer{}
+	err := runDiff(context.Background(), cfg, "foo", false, out)
+	assert.EqualError(t, err, "1 of 1 address(es) not routed as desired")
+	assert.Equal(t, `INSTANCE  ADDRESS        LOCAL  DESIRED  ACTUAL  STATUS
+foo       192.0.2.10/32  false  other    none    mismatch
+`, out.String())
+
+	out.Reset()
+	err = runDiff(context.Background(), cfg, "foo", true, out)
+	assert.Error(t, err)
+	assert.JSONEq(t, `[{"instance": "foo", "address": "192.0.2.10/32", "local": false,
+		"desired": "other", "actual": [], "status": "mismatch"}]`, out.String())
+}
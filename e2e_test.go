@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -85,6 +86,94 @@ func TestE2E_FIFO(t *testing.T) {
 	expectUpdate(t, out, "192.168.1.1/32", 3)
 }
 
+func TestE2E_CloudscaleMaster(t *testing.T) {
+	api, _, conf := setupCloudscale(t, "192.0.2.10/32")
+
+	cmd := exec.Command("./floaty", conf, "INSTANCE", t.Name(), "MASTER", "100")
+	_, stop, err := startCmd(cmd)
+	require.NoError(t, err)
+	defer stop()
+
+	expectServer(t, api, "192.0.2.10", fakeCloudscaleServerUUID)
+
+	// Another machine takes over, e.g. in a split brain
+	api.assign("192.0.2.10", fakeCloudscaleOtherUUID)
+	expectServer(t, api, "192.0.2.10", fakeCloudscaleServerUUID)
+}
+
+func TestE2E_CloudscaleMasterThenBackup(t *testing.T) {
+	api, _, conf := setupCloudscale(t, "192.0.2.11/32")
+
+	masterCmd := exec.Command("./floaty", conf, "INSTANCE", t.Name(), "MASTER", "100")
+	_, done, err := runCmd(masterCmd)
+	require.NoError(t, err)
+	expectServer(t, api, "192.0.2.11", fakeCloudscaleServerUUID)
+
+	backupCmd := exec.Command("./floaty", conf, "INSTANCE", t.Name(), "BACKUP", "100")
+	out, err := backupCmd.CombinedOutput()
+	assert.NoErrorf(t, err, "failed to run backup command:\n%s", string(out))
+	assert.NoErrorf(t, done(), "failed to stop master command")
+
+	// The master process is gone and no longer refreshes
+	api.assign("192.0.2.11", fakeCloudscaleOtherUUID)
+	expectStaysWithServer(t, api, "192.0.2.11", fakeCloudscaleOtherUUID)
+}
+
+func TestE2E_CloudscaleFIFO(t *testing.T) {
+	api, faults, conf := setupCloudscale(t, "192.0.2.12/32")
+	pname, pipe, removePipe, err := setupFifo(t.Name())
+	require.NoErrorf(t, err, "failed to setup pipe")
+	defer removePipe()
+
+	cmd := exec.Command("./floaty", "--fifo", conf, pname)
+	_, stop, err := startCmd(cmd)
+	require.NoError(t, err)
+	defer stop()
+
+	_, err = pipe.Write([]byte(fmt.Sprintf("INSTANCE %q MASTER 100\n", t.Name())))
+	require.NoError(t, err)
+	expectServer(t, api, "192.0.2.12", fakeCloudscaleServerUUID)
+
+	// Refreshes fail during an API outage and succeed once it's over
+	faults.setStatus(http.StatusServiceUnavailable)
+	api.assign("192.0.2.12", fakeCloudscaleOtherUUID)
+	expectStaysWithServer(t, api, "192.0.2.12", fakeCloudscaleOtherUUID)
+
+	faults.setStatus(0)
+	expectServer(t, api, "192.0.2.12", fakeCloudscaleServerUUID)
+
+	_, err = pipe.Write([]byte(fmt.Sprintf("INSTANCE %q BACKUP 100\n", t.Name())))
+	require.NoError(t, err)
+
+	// Let a refresh in progress finish
+	time.Sleep(time.Second)
+
+	api.assign("192.0.2.12", fakeCloudscaleOtherUUID)
+	expectStaysWithServer(t, api, "192.0.2.12", fakeCloudscaleOtherUUID)
+}
+
+func TestE2E_CloudscaleBackupBadToken(t *testing.T) {
+	api, _, conf := setupCloudscale(t, "192.0.2.14/32")
+	api.setToken("other")
+
+	// Leaving MASTER state doesn't depend on the provider API
+	out, err := exec.Command("./floaty", conf, "INSTANCE", t.Name(), "BACKUP", "100").CombinedOutput()
+	assert.NoErrorf(t, err, "failed to run backup command:\n%s", string(out))
+	assert.Empty(t, api.callCounts())
+}
+
+func TestE2E_CloudscaleSelfTestBadToken(t *testing.T) {
+	api, _, conf := setupCloudscale(t, "192.0.2.13/32")
+	api.setToken("other")
+
+	out, err := exec.Command("./floaty", "--test", conf).Output()
+
+	var exitErr *exec.ExitError
+	require.ErrorAsf(t, err, &exitErr, "self-test succeeded:\n%s", string(out))
+	assert.Equal(t, int(checkCritical), exitErr.ExitCode())
+	assert.Contains(t, string(out), "Listing floating IPs failed")
+}
+
 func startCmd(cmd *exec.Cmd) (*syncBuffer, func() error, error) {
 	out := &syncBuffer{}
 	cmd.Stdout = out
@@ -141,6 +230,16 @@ func expectUpdate(t *testing.T, buf *syncBuffer, addr string, n int) {
 }
 
 func setupConfig(name, addr string) (string, func() error, error) {
+	return writeConfig(name, addr, notifyConfig{
+		RefreshInterval: time.Second,
+		Provider:        "fake",
+	})
+}
+
+// writeConfig writes the configuration and a Keepalived configuration with
+// the address to a temporary directory, which also holds the lock and
+// identity cache files
+func writeConfig(name, addr string, conf notifyConfig) (string, func() error, error) {
 	dir, err := os.MkdirTemp("", name)
 	if err != nil {
 		return "", nil, err
@@ -169,12 +268,10 @@ vrrp_instance %s {
 		return "", cleanup, err
 	}
 
-	conf := notifyConfig{
-		LockFileTemplate:     filepath.Join(dir, "floaty.%s.lock"),
-		KeepalivedConfigFile: kd,
-		RefreshInterval:      time.Second,
-		Provider:             "fake",
-	}
+	conf.LockFileTemplate = filepath.Join(dir, "floaty.%s.lock")
+	conf.KeepalivedConfigFile = kd
+	conf.Identity.CacheFileTemplate = filepath.Join(dir, "identity.%s.json")
+
 	confF := filepath.Join(dir, "conf.yml")
 	data, err := yaml.Marshal(conf)
 	if err != nil {
@@ -186,6 +283,55 @@ vrrp_instance %s {
 	return confF, cleanup, nil
 }
 
+// setupCloudscale starts the fake Cloudscale API with the floating IP routed
+// to another server and writes a configuration using it. The server running
+// floaty is found via the metadata service of the fake API.
+func setupCloudscale(t *testing.T, addr string) (*fakeCloudscaleAPI, *conformanceAPI, string) {
+	api := newFakeCloudscaleAPI()
+	api.setToken("e2e-token")
+	api.addFloatingIP(addr, "", fakeCloudscaleOtherUUID)
+
+	faults, endpoint := newConformanceServer(t, api)
+	endpointURL := mustParseTextURL(endpoint + "/")
+	metadataURL := mustParseTextURL(endpoint + fakeCloudscaleMetadataPath)
+
+	conf := newNotifyConfig()
+	conf.RefreshInterval = time.Second
+	conf.BackOff.MaxInterval = time.Second
+	conf.Identity.Sources = []string{identitySourceMetadata}
+	conf.Provider = "cloudscale"
+	conf.Cloudscale = cloudscaleNotifyConfig{
+		Endpoint:    &endpointURL,
+		Token:       "e2e-token",
+		MetadataURL: &metadataURL,
+	}
+
+	path, cleanup, err := writeConfig(t.Name(), addr, conf)
+	require.NoErrorf(t, err, "failed to setup test env")
+	t.Cleanup(func() { cleanup() })
+
+	return api, faults, path
+}
+
+// expectServer waits for the floating IP to be routed to the server
+func expectServer(t *testing.T, api *fakeCloudscaleAPI, ip, server string) {
+	t.Helper()
+
+	require.Eventuallyf(t, func() bool {
+		return api.serverOf(ip) == server
+	}, 8*time.Second, 100*time.Millisecond, "Floating IP %s not routed to %s", ip, server)
+}
+
+// expectStaysWithServer verifies that the floating IP isn't moved away from
+// the server for a few refresh intervals
+func expectStaysWithServer(t *testing.T, api *fakeCloudscaleAPI, ip, server string) {
+	t.Helper()
+
+	require.Neverf(t, func() bool {
+		return api.serverOf(ip) != server
+	}, 3*time.Second, 100*time.Millisecond, "Floating IP %s moved away from %s", ip, server)
+}
+
 func setupFifo(name string) (string, io.Writer, func() error, error) {
 	dir, err := os.MkdirTemp("", name)
 	if err != nil {
@@ -12,6 +12,7 @@ import (
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
 
 	"github.com/cloudscale-ch/cloudscale-go-sdk/v6"
 	"github.com/gofrs/uuid"
@@ -21,40 +22,85 @@ type cloudscaleNotifyConfig struct {
 	Endpoint *textURL `yaml:"endpoint"`
 	Token    string   `yaml:"token"`
 
+	// Metadata service used to identify the server; defaults to the
+	// OpenStack metadata service
+	MetadataURL *textURL `yaml:"metadata-url"`
+
 	ServerUUID           uuid.UUID            `yaml:"server-uuid"`
 	HostnameToServerUUID map[string]uuid.UUID `yaml:"hostname-to-server-uuid"`
 }
 
-func (cfg cloudscaleNotifyConfig) findServerUUID(hostname string) (uuid.UUID, error) {
+// findServerUUID returns the UUID of the server running floaty and where it
+// was found
+func (cfg cloudscaleNotifyConfig) findServerUUID(ctx context.Context, identity identityConfig, httpCfg httpConfig, hostname string) (uuid.UUID, identityOrigin, error) {
 	if cfg.ServerUUID != uuid.Nil {
 		// Directly specified in config
-		return cfg.ServerUUID, nil
+		return cfg.ServerUUID, identityConfigured, nil
 	}
 
 	if serverUUID, ok := cfg.HostnameToServerUUID[hostname]; ok && serverUUID != uuid.Nil {
 		// Found using hostname
-		return serverUUID, nil
+		return serverUUID, identityConfigured, nil
+	}
+
+	if cached, ok := identity.validatedIdentity("cloudscale", hostname, time.Now()); ok {
+		if serverUUID, err := parseCloudscaleServerUUID(cached.ID); err == nil {
+			logrus.Debug("Using cached server UUID")
+			return serverUUID, identityCached, nil
+		}
+	}
+
+	found, err := identity.discover(ctx, "cloudscale", cloudscaleIdentitySources(identity, httpCfg, cfg.metadataURL()), func(i instanceIdentity) error {
+		_, err := parseCloudscaleServerUUID(i.ID)
+		return err
+	})
+	if err != nil {
+		return uuid.Nil, identityDiscovered, fmt.Errorf("Server UUID not found with hostname %q: %s", hostname, err)
 	}
 
-	md, err := findCloudscaleServerMetadata()
+	serverUUID, err := parseCloudscaleServerUUID(found.ID)
+
+	return serverUUID, identityDiscovered, err
+}
+
+func (cfg cloudscaleNotifyConfig) metadataURL() string {
+	if cfg.MetadataURL == nil {
+		return cloudscaleMetadataURL
+	}
+
+	return cfg.MetadataURL.String()
+}
+
+func parseCloudscaleServerUUID(value string) (uuid.UUID, error) {
+	serverUUID, err := uuid.FromString(value)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("Failed to retrieve Cloudscale server metadata: %s", err)
+		return uuid.Nil, err
+	}
+
+	if err := validateCloudscaleServerUUID(serverUUID); err != nil {
+		return uuid.Nil, err
 	}
 
-	if md.Meta.CloudscaleUUID != nil {
-		return *md.Meta.CloudscaleUUID, nil
+	return serverUUID, nil
+}
+
+func validateCloudscaleServerUUID(serverUUID uuid.UUID) error {
+	switch serverUUID.Variant() {
+	case uuid.VariantRFC4122, uuid.VariantMicrosoft:
+		return nil
 	}
 
-	return uuid.Nil, fmt.Errorf("Server UUID not found with hostname %q", hostname)
+	return fmt.Errorf("Invalid UUID %q", serverUUID)
 }
 
-func (cfg cloudscaleNotifyConfig) NewProvider() (elasticIPProvider, error) {
+func (cfg cloudscaleNotifyConfig) NewProvider(ctx context.Context, identity identityConfig, rateLimit rateLimitConfig, httpCfg httpConfig) (elasticIPProvider, error) {
 	if len(cfg.Token) < 1 {
 		return nil, fmt.Errorf("Authentication token required")
 	}
 
-	httpClient := &http.Client{
-		Timeout: 1 * time.Minute,
+	httpClient, err := httpCfg.newClient(rateLimit)
+	if err != nil {
+		return nil, err
 	}
 
 	client := cloudscale.NewClient(httpClient)
@@ -75,97 +121,423 @@ func (cfg cloudscaleNotifyConfig) NewProvider() (elasticIPProvider, error) {
 
 	logrus.Debugf("Hostname %q", hostname)
 
-	serverUUID, err := cfg.findServerUUID(hostname)
+	serverUUID, origin, err := cfg.findServerUUID(ctx, identity, httpCfg, hostname)
 	if err != nil {
 		return nil, err
 	}
 
-	switch serverUUID.Variant() {
-	case uuid.VariantRFC4122, uuid.VariantMicrosoft:
-		break
-	default:
-		return nil, fmt.Errorf("Invalid UUID %q", serverUUID)
+	if err := validateCloudscaleServerUUID(serverUUID); err != nil {
+		return nil, err
 	}
 
 	logrus.WithField("server-uuid", serverUUID).Debug("Server UUID")
 
-	return &cloudscaleFloatingIPProvider{
+	p := &cloudscaleFloatingIPProvider{
 		serverUUID: serverUUID.String(),
 		httpClient: httpClient,
 		client:     client,
-	}, nil
+	}
+
+	// Confirming the server also fetches the details needed before the
+	// first refresh
+	switch origin {
+	case identityCached:
+		// Confirm the server without delaying the first refresh
+		identity.revalidateIdentity(ctx, "cloudscale", hostname, instanceIdentity{ID: p.serverUUID}, p.confirmServer)
+
+	case identityDiscovered:
+		if err := identity.confirmIdentity(ctx, "cloudscale", hostname, instanceIdentity{ID: p.serverUUID}, p.confirmServer); err != nil {
+			return nil, fmt.Errorf("Confirming discovered server UUID: %w", err)
+		}
+	}
+
+	return p, nil
 }
 
+// cloudscaleCacheTTL limits how long the list of floating IPs is shared
+// between refreshers
+const cloudscaleCacheTTL = 1 * time.Minute
+
 type cloudscaleFloatingIPProvider struct {
 	serverUUID string
 	httpClient *http.Client
 	client     *cloudscale.Client
+
+	mu                sync.Mutex
+	floatingIPs       []cloudscale.FloatingIP
+	floatingIPsExpiry time.Time
+	server            *cloudscale.Server
+	region            string
+}
+
+// findServer returns the server running floaty and its region. Both are
+// retrieved only once.
+func (p *cloudscaleFloatingIPProvider) findServer(ctx context.Context) (*cloudscale.Server, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.server != nil {
+		return p.server, p.region, nil
+	}
+
+	server, err := p.client.Servers.Get(ctx, p.serverUUID)
+	if err != nil {
+		return nil, "", cloudscaleLookupError(err, "Retrieving server %s", p.serverUUID)
+	}
+
+	regions, err := p.client.Regions.List(ctx)
+	if err != nil {
+		return nil, "", cloudscaleLookupError(err, "Listing regions")
+	}
+
+	region := findCloudscaleRegion(regions, server.Zone.Slug)
+	if region == "" {
+		return nil, "", backoff.Permanent(fmt.Errorf("Region of zone %q not found", server.Zone.Slug))
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"zone":   server.Zone.Slug,
+		"region": region,
+	}).Debug("Server location")
+
+	p.server = server
+	p.region = region
+
+	return p.server, p.region, nil
+}
+
+// confirmServer retrieves the server running floaty. An
+// identityRejectedError is returned if the API doesn't know the server.
+func (p *cloudscaleFloatingIPProvider) confirmServer(ctx context.Context) error {
+	_, _, err := p.findServer(ctx)
+
+	var apiError *cloudscale.ErrorResponse
+	if errors.As(err, &apiError) {
+		switch apiError.StatusCode {
+		case http.StatusBadRequest, http.StatusNotFound:
+			return &identityRejectedError{Err: err}
+		}
+	}
+
+	return err
+}
+
+func findCloudscaleRegion(regions []cloudscale.Region, zone string) string {
+	for _, region := range regions {
+		for _, z := range region.Zones {
+			if z.Slug == zone {
+				return region.Slug
+			}
+		}
+	}
+
+	return ""
+}
+
+// validateCloudscaleFloatingIP verifies that the floating IP can be routed to
+// the server in the given region
+func validateCloudscaleFloatingIP(floatingIP *cloudscale.FloatingIP, server *cloudscale.Server, region string) error {
+	var errs error
+
+	switch floatingIP.Type {
+	case "regional":
+		floatingIPRegion := "unknown"
+		if floatingIP.Region != nil {
+			floatingIPRegion = floatingIP.Region.Slug
+		}
+		if floatingIPRegion != region {
+			errs = multierr.Append(errs, fmt.Errorf("Floating IP %s is in region %s, but server %s is in region %s",
+				floatingIP.Network, floatingIPRegion, server.UUID, region))
+		}
+	case "global":
+		break
+	default:
+		errs = multierr.Append(errs, fmt.Errorf("Floating IP %s has unsupported type %q",
+			floatingIP.Network, floatingIP.Type))
+	}
+
+	if floatingIP.LoadBalancer != nil {
+		errs = multierr.Append(errs, fmt.Errorf("Floating IP %s is assigned to load balancer %s",
+			floatingIP.Network, floatingIP.LoadBalancer.UUID))
+	}
+
+	hasIPVersion := false
+	for _, iface := range server.Interfaces {
+		if iface.Type != "public" {
+			continue
+		}
+		for _, address := range iface.Addresses {
+			hasIPVersion = hasIPVersion || address.Version == floatingIP.IPVersion
+		}
+	}
+	if !hasIPVersion {
+		errs = multierr.Append(errs, fmt.Errorf("Floating IP %s requires a public IPv%d address, but server %s has none",
+			floatingIP.Network, floatingIP.IPVersion, server.UUID))
+	}
+
+	return errs
+}
+
+// listFloatingIPs returns all floating IPs and networks. The list is cached.
+func (p *cloudscaleFloatingIPProvider) listFloatingIPs(ctx context.Context) ([]cloudscale.FloatingIP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Now().Before(p.floatingIPsExpiry) {
+		return p.floatingIPs, nil
+	}
+
+	floatingIPs, err := p.client.FloatingIPs.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.floatingIPs = floatingIPs
+	p.floatingIPsExpiry = time.Now().Add(cloudscaleCacheTTL)
+
+	return p.floatingIPs, nil
+}
+
+func (p *cloudscaleFloatingIPProvider) Identity() string {
+	return p.serverUUID
 }
 
-func (p *cloudscaleFloatingIPProvider) Test(ctx context.Context) error {
-	var errServer, errFloatingIP error
+func (p *cloudscaleFloatingIPProvider) Test(ctx context.Context, addresses []netAddress, cfg selfTestConfig, report *selfTestReport) {
 	var server *cloudscale.Server
 	var floatingIPs []cloudscale.FloatingIP
 
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+	err := report.Time(func() (err error) {
+		floatingIPs, err = p.client.FloatingIPs.List(ctx)
+		return err
+	})
+	if err == nil {
+		logrus.WithField("floating-ips", floatingIPs).Debug("Got floating IPs")
+		report.Add("credentials", checkOK, "Listed %d floating IPs", len(floatingIPs))
+	} else {
+		report.Add("credentials", checkCritical, "Listing floating IPs failed: %s", describeCloudscaleError(err))
+	}
 
-	go func() {
-		defer wg.Done()
-		server, errServer = p.client.Servers.Get(ctx, p.serverUUID)
-	}()
+	err = report.Time(func() (err error) {
+		server, err = p.client.Servers.Get(ctx, p.serverUUID)
+		return err
+	})
+	if err == nil {
+		report.Add("instance", checkOK, "Server %q (%s) in zone %s", server.Name, server.UUID, server.Zone.Slug)
+	} else {
+		report.Add("instance", checkCritical, "Retrieving server %s failed: %s", p.serverUUID, describeCloudscaleError(err))
+	}
+
+	if floatingIPs == nil {
+		return
+	}
 
-	go func() {
-		defer wg.Done()
-		floatingIPs, errFloatingIP = p.client.FloatingIPs.List(ctx)
-	}()
+	var existing *cloudscale.FloatingIP
 
-	wg.Wait()
+	for _, address := range addresses {
+		name := fmt.Sprintf("address %s", address)
 
-	fields := logrus.Fields{}
-	success := true
+		if floatingIP, err := resolveCloudscaleFloatingIP(floatingIPs, address); err != nil {
+			report.Add(name, checkCritical, "%s", err)
+		} else if err := p.validateForTest(ctx, floatingIP, report); err != nil {
+			existing = floatingIP
+			report.Add(name, checkCritical, "%s", err)
+		} else {
+			existing = floatingIP
+			report.Add(name, checkOK, "Floating IP routed to %s",
+				formatOwners(cloudscaleFloatingIPOwners(floatingIP), p.serverUUID))
+		}
+	}
 
-	if errServer == nil {
-		fields["server"] = server
-	} else {
-		success = false
-		logrus.Errorf("Retrieving server %q: %s", p.serverUUID, errServer)
+	if !cfg.CheckWritePermission {
+		return
 	}
 
-	if errFloatingIP == nil {
-		fields["floating-ips"] = floatingIPs
+	if existing == nil {
+		report.Add("update-permission", checkUnknown, "No floating IP available to verify write access")
+		return
+	}
+
+	// An update without changes verifies that the token has write access
+	err = report.Time(func() error {
+		return p.client.FloatingIPs.Update(ctx, existing.IP(), &cloudscale.FloatingIPUpdateRequest{})
+	})
+	if err == nil {
+		report.Add("update-permission", checkOK, "Floating IP %s can be updated", existing.Network)
 	} else {
-		success = false
-		logrus.Errorf("Listing floating IPs failed: %s", errFloatingIP)
+		report.Add("update-permission", checkCritical, "Updating floating IP %s failed: %s", existing.Network, describeCloudscaleError(err))
 	}
+}
 
-	logger := logrus.WithFields(fields)
+// validateForTest validates the floating IP if the server location is known
+func (p *cloudscaleFloatingIPProvider) validateForTest(ctx context.Context, floatingIP *cloudscale.FloatingIP, report *selfTestReport) error {
+	var server *cloudscale.Server
+	var region string
 
-	if success {
-		logger.Info("Test successful")
+	err := report.Time(func() (err error) {
+		server, region, err = p.findServer(ctx)
+		return err
+	})
+	if err != nil {
+		// Already reported by the instance check
 		return nil
 	}
 
-	logger.Error("Test failed")
+	return validateCloudscaleFloatingIP(floatingIP, server, region)
+}
+
+// findCloudscaleFloatingIP returns the floating IP or network with the
+// same address and prefix length as given
+func findCloudscaleFloatingIP(floatingIPs []cloudscale.FloatingIP, address netAddress) *cloudscale.FloatingIP {
+	for i, floatingIP := range floatingIPs {
+		network, err := parseNetAddress(floatingIP.Network)
+		if err != nil {
+			logrus.WithField("network", floatingIP.Network).Warn("Failed to parse floating IP")
+			continue
+		}
+
+		if network.String() == address.String() {
+			return &floatingIPs[i]
+		}
+	}
+
+	return nil
+}
+
+// resolveCloudscaleFloatingIP returns the floating IP or network for the
+// address. Addresses with a prefix length, e.g. from Keepalived
+// configurations, refer to floating networks of the same size. An error is
+// returned if the floating IP doesn't exist or if the prefix length differs.
+func resolveCloudscaleFloatingIP(floatingIPs []cloudscale.FloatingIP, address netAddress) (*cloudscale.FloatingIP, error) {
+	if floatingIP := findCloudscaleFloatingIP(floatingIPs, address); floatingIP != nil {
+		return floatingIP, nil
+	}
+
+	for _, floatingIP := range floatingIPs {
+		network, err := parseNetAddress(floatingIP.Network)
+		if err != nil {
+			continue
+		}
+
+		if network.Contains(address.IP) || address.Contains(network.IP) {
+			prefixLength, _ := address.Mask.Size()
+			return nil, fmt.Errorf("Prefix length /%d of address %s doesn't match floating IP %s",
+				prefixLength, address, floatingIP.Network)
+		}
+	}
+
+	return nil, fmt.Errorf("Floating IP %s not found", address)
+}
+
+// describeCloudscaleError includes the HTTP status code of API errors
+func describeCloudscaleError(err error) string {
+	var apiError *cloudscale.ErrorResponse
+
+	if errors.As(err, &apiError) {
+		return fmt.Sprintf("HTTP %d %s: %s", apiError.StatusCode, http.StatusText(apiError.StatusCode), apiError)
+	}
+
+	return err.Error()
+}
+
+// cloudscaleLookupError describes a failed API call. Client errors other
+// than rate limiting are permanent, everything else may succeed when
+// retried.
+func cloudscaleLookupError(err error, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+
+	var apiError *cloudscale.ErrorResponse
+	if !errors.As(err, &apiError) {
+		return fmt.Errorf("%s: %w", message, err)
+	}
+
+	wrapped := fmt.Errorf("%s: HTTP %d %s: %w", message,
+		apiError.StatusCode, http.StatusText(apiError.StatusCode), apiError)
+
+	if apiError.StatusCode >= 400 && apiError.StatusCode < 500 &&
+		apiError.StatusCode != http.StatusTooManyRequests {
+		return backoff.Permanent(wrapped)
+	}
+
+	return wrapped
+}
+
+// resolveFloatingIP looks up the floating IP or network for the address and
+// validates it against the server. Validation failures are permanent.
+func (p *cloudscaleFloatingIPProvider) resolveFloatingIP(ctx context.Context, network netAddress) (*cloudscale.FloatingIP, error) {
+	floatingIPs, err := p.listFloatingIPs(ctx)
+	if err != nil {
+		return nil, cloudscaleLookupError(err, "Floating IP lookup")
+	}
+
+	floatingIP, err := resolveCloudscaleFloatingIP(floatingIPs, network)
+	if err != nil {
+		return nil, backoff.Permanent(err)
+	}
+
+	server, region, err := p.findServer(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	return errors.New("Self-test failed")
+	if err := validateCloudscaleFloatingIP(floatingIP, server, region); err != nil {
+		return nil, backoff.Permanent(err)
+	}
+
+	return floatingIP, nil
 }
 
+// NewElasticIPRefresher validates the floating IP. Only permanent errors are
+// returned, the floating IP is looked up again when refreshing if the API
+// isn't available, e.g. due to server errors or timeouts.
 func (p *cloudscaleFloatingIPProvider) NewElasticIPRefresher(ctx context.Context,
 	logger *logrus.Entry, network netAddress) (elasticIPRefresher, error) {
 
-	return &cloudscaleFloatingIPRefresher{
+	r := &cloudscaleFloatingIPRefresher{
 		provider: p,
 		network:  network,
 		logger:   logger,
-	}, nil
+	}
+
+	if _, err := r.resolve(ctx); err != nil {
+		if _, ok := err.(*backoff.PermanentError); ok {
+			return nil, err
+		}
+
+		logger.Warningf("Validating floating IP failed, retrying when refreshing: %s", err)
+	}
+
+	return r, nil
 }
 
 type cloudscaleFloatingIPRefresher struct {
 	provider *cloudscaleFloatingIPProvider
-	client   *cloudscale.Client
 	network  netAddress
 	logger   *logrus.Entry
+
+	mu sync.Mutex
+
+	// floatingIP identifies the floating IP or network in API calls. It's
+	// empty until the floating IP was validated.
+	floatingIP string
+}
+
+// resolve returns the floating IP, looking it up unless already validated
+func (r *cloudscaleFloatingIPRefresher) resolve(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.floatingIP != "" {
+		return r.floatingIP, nil
+	}
+
+	floatingIP, err := r.provider.resolveFloatingIP(ctx, r.network)
+	if err != nil {
+		return "", err
+	}
+
+	r.floatingIP = floatingIP.IP()
+
+	return r.floatingIP, nil
 }
 
 func (r *cloudscaleFloatingIPRefresher) String() string {
@@ -176,9 +548,43 @@ func (r *cloudscaleFloatingIPRefresher) Logger() *logrus.Entry {
 	return r.logger
 }
 
-func (r *cloudscaleFloatingIPRefresher) Refresh(ctx context.Context) error {
+// Refresh routes the floating IP to this server unless it already is. The
+// floating IP counts as moved if it was routed elsewhere or if its next-hop
+// couldn't be retrieved.
+func (r *cloudscaleFloatingIPRefresher) Refresh(ctx context.Context) (bool, error) {
+	ip, err := r.resolve(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	floatingIP, err := r.provider.client.FloatingIPs.Get(ctx, ip)
+	if err != nil {
+		// Setting the next-hop may still succeed
+		r.logger.Warningf("Retrieving address %s failed: %s", ip, describeCloudscaleError(err))
+	} else if r.routedHere(floatingIP) {
+		return false, nil
+	}
+
+	if err := r.assign(ctx, ip); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// routedHere reports whether the floating IP is routed to this server
+func (r *cloudscaleFloatingIPRefresher) routedHere(floatingIP *cloudscale.FloatingIP) bool {
+	owners := cloudscaleFloatingIPOwners(floatingIP)
+	if len(owners) == 1 && owners[0] == r.provider.serverUUID {
+		r.logger.Debugf("Address %s is routed to server %s", floatingIP.IP(), owners[0])
+		return true
+	}
+	return false
+}
+
+// assign sets the next-hop of the floating IP to this server
+func (r *cloudscaleFloatingIPRefresher) assign(ctx context.Context, ip string) error {
 	serverUUID := r.provider.serverUUID
-	ip := r.network.IP.String()
 	client := r.provider.client
 
 	r.logger.Infof("Set next-hop of address %s to server %s", ip, serverUUID)
@@ -203,6 +609,151 @@ func (r *cloudscaleFloatingIPRefresher) Refresh(ctx context.Context) error {
 	}
 
 	r.logger.Debug("Refresh successful")
+
+	return nil
+}
+
+func (r *cloudscaleFloatingIPRefresher) Owners(ctx context.Context) ([]string, error) {
+	ip, err := r.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	floatingIP, err := r.provider.client.FloatingIPs.Get(ctx, ip)
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving floating IP %s: %w", ip, err)
+	}
+
+	return cloudscaleFloatingIPOwners(floatingIP), nil
+}
+
+func cloudscaleFloatingIPOwners(floatingIP *cloudscale.FloatingIP) []string {
+	owners := []string{}
+
+	if floatingIP.Server != nil {
+		owners = append(owners, floatingIP.Server.UUID)
+	}
+
+	if floatingIP.LoadBalancer != nil {
+		owners = append(owners, "load-balancer/"+floatingIP.LoadBalancer.UUID)
+	}
+
+	return owners
+}
+
+func (r *cloudscaleFloatingIPRefresher) Release(ctx context.Context) error {
+	serverUUID := r.provider.serverUUID
+	client := r.provider.client
+
+	owners, err := r.Owners(ctx)
+	if err != nil {
+		return err
+	}
+
+	ip, err := r.resolve(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(owners) != 1 || owners[0] != serverUUID {
+		r.logger.Infof("Address %s is not routed to server %s", ip, serverUUID)
+		return nil
+	}
+
+	r.logger.Infof("Unassigning address %s from server %s", ip, serverUUID)
+
+	// NOTE: FloatingIPUpdateRequest omits empty server values, so the
+	// request to unassign the address is built manually.
+	req, err := client.NewRequest(ctx, http.MethodPatch,
+		fmt.Sprintf("v1/floating-ips/%s", ip),
+		map[string]interface{}{"server": nil})
+	if err != nil {
+		return err
+	}
+
+	if err := client.Do(ctx, req, nil); err != nil {
+		return fmt.Errorf("Unassigning address %s from server %s: %w", ip, serverUUID, err)
+	}
+
 	return nil
+}
+
+func (p *cloudscaleFloatingIPProvider) NewElasticIPBatchRefresher(ctx context.Context,
+	logger *logrus.Entry, addresses []netAddress) (elasticIPBatchRefresher, error) {
+
+	b := &cloudscaleFloatingIPBatchRefresher{
+		provider:   p,
+		logger:     logger,
+		addresses:  addresses,
+		refreshers: map[string]*cloudscaleFloatingIPRefresher{},
+	}
+
+	var errs error
+	for _, address := range addresses {
+		r, err := p.NewElasticIPRefresher(ctx, logger.WithField("address", address), address)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		b.refreshers[address.String()] = r.(*cloudscaleFloatingIPRefresher)
+	}
+	if errs != nil {
+		return nil, errs
+	}
+
+	return b, nil
+}
+
+// cloudscaleFloatingIPBatchRefresher lists all floating IPs once per refresh
+// and only updates those not routed to this server
+type cloudscaleFloatingIPBatchRefresher struct {
+	provider  *cloudscaleFloatingIPProvider
+	logger    *logrus.Entry
+	addresses []netAddress
+
+	// Refreshers keyed by address
+	refreshers map[string]*cloudscaleFloatingIPRefresher
+}
+
+func (b *cloudscaleFloatingIPBatchRefresher) Logger() *logrus.Entry {
+	return b.logger
+}
+
+func (b *cloudscaleFloatingIPBatchRefresher) Addresses() []netAddress {
+	return b.addresses
+}
+
+func (b *cloudscaleFloatingIPBatchRefresher) RefreshAll(ctx context.Context, addresses []netAddress) []refreshResult {
+	floatingIPs, err := b.provider.client.FloatingIPs.List(ctx)
+	if err != nil {
+		// Update all floating IPs, refreshes may still succeed
+		b.logger.Warningf("Listing floating IPs failed: %s", describeCloudscaleError(err))
+		floatingIPs = nil
+	}
+
+	return refreshConcurrently(len(addresses), func(i int) (bool, error) {
+		r := b.refreshers[addresses[i].String()]
+
+		floatingIP := findCloudscaleFloatingIP(floatingIPs, r.network)
+		if floatingIP == nil {
+			// Retrieves the next-hop of the floating IP itself
+			return r.Refresh(ctx)
+		}
+
+		if r.routedHere(floatingIP) {
+			return false, nil
+		}
+
+		// The floating IP is validated before it's first assigned
+		ip, err := r.resolve(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		if err := r.assign(ctx, ip); err != nil {
+			return false, err
+		}
 
+		return true, nil
+	})
 }
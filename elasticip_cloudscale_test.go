@@ -0,0 +1,748 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/cloudscale-ch/cloudscale-go-sdk/v6"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	fakeCloudscaleServerUUID = "96defb88-002c-4985-b795-5c929bab23da"
+	fakeCloudscaleOtherUUID  = "7d37a073-e84c-4fc6-b631-cc2e29d9d4ea"
+)
+
+// Path of the OpenStack metadata served by the fake API
+const fakeCloudscaleMetadataPath = "/openstack/latest/meta_data.json"
+
+// fakeCloudscaleAPI implements the parts of the Cloudscale API used by
+// floaty and counts the calls per endpoint. It also serves the metadata of
+// the server running floaty.
+type fakeCloudscaleAPI struct {
+	// Token required by the API; any token is accepted if empty
+	token string
+
+	// Number of following API requests failing with a server error
+	unavailable int
+
+	mu          sync.Mutex
+	calls       map[string]int
+	floatingIPs []cloudscale.FloatingIP
+	servers     []cloudscale.Server
+	regions     []cloudscale.Region
+}
+
+func newFakeCloudscaleAPI() *fakeCloudscaleAPI {
+	publicInterface := cloudscale.Interface{
+		Type: "public",
+		Addresses: []cloudscale.Address{
+			{Version: 4, Address: "198.51.100.10"},
+			{Version: 6, Address: "2001:db8:ffff::10"},
+		},
+	}
+
+	return &fakeCloudscaleAPI{
+		calls: map[string]int{},
+		servers: []cloudscale.Server{
+			{
+				UUID:          fakeCloudscaleServerUUID,
+				Name:          "lb1",
+				ZonalResource: cloudscale.ZonalResource{Zone: cloudscale.Zone{Slug: "rma1"}},
+				Interfaces:    []cloudscale.Interface{publicInterface},
+			},
+			{
+				UUID:          fakeCloudscaleOtherUUID,
+				Name:          "lb2",
+				ZonalResource: cloudscale.ZonalResource{Zone: cloudscale.Zone{Slug: "rma1"}},
+				Interfaces:    []cloudscale.Interface{publicInterface},
+			},
+		},
+		regions: []cloudscale.Region{
+			{Slug: "rma", Zones: []cloudscale.Zone{{Slug: "rma1"}}},
+			{Slug: "lpg", Zones: []cloudscale.Zone{{Slug: "lpg1"}}},
+		},
+	}
+}
+
+func (a *fakeCloudscaleAPI) addFloatingIP(network string, region string, server string) {
+	floatingIP := cloudscale.FloatingIP{
+		Network:   network,
+		IPVersion: 4,
+		Type:      "global",
+	}
+
+	if strings.Contains(network, ":") {
+		floatingIP.IPVersion = 6
+	}
+
+	if region != "" {
+		floatingIP.Type = "regional"
+		floatingIP.Region = &cloudscale.Region{Slug: region}
+	}
+
+	if server != "" {
+		floatingIP.Server = &cloudscale.ServerStub{UUID: server}
+	}
+
+	a.floatingIPs = append(a.floatingIPs, floatingIP)
+}
+
+func (a *fakeCloudscaleAPI) findFloatingIP(ip string) *cloudscale.FloatingIP {
+	for i := range a.floatingIPs {
+		if a.floatingIPs[i].IP() == ip {
+			return &a.floatingIPs[i]
+		}
+	}
+	return nil
+}
+
+func (a *fakeCloudscaleAPI) resetCalls() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.calls = map[string]int{}
+}
+
+func (a *fakeCloudscaleAPI) callCounts() map[string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := map[string]int{}
+	for k, v := range a.calls {
+		result[k] = v
+	}
+	return result
+}
+
+func (a *fakeCloudscaleAPI) setToken(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.token = token
+}
+
+// setUnavailable lets the next API requests fail with a server error
+func (a *fakeCloudscaleAPI) setUnavailable(requests int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.unavailable = requests
+}
+
+// serverOf returns the UUID of the server the floating IP is assigned to
+func (a *fakeCloudscaleAPI) serverOf(ip string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	floatingIP := a.findFloatingIP(ip)
+	if floatingIP == nil || floatingIP.Server == nil {
+		return ""
+	}
+
+	return floatingIP.Server.UUID
+}
+
+// assign routes the floating IP to the server, e.g. to simulate another
+// machine taking it over
+func (a *fakeCloudscaleAPI) assign(ip string, server string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.findFloatingIP(ip).Server = &cloudscale.ServerStub{UUID: server}
+}
+
+func (a *fakeCloudscaleAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if r.Method == http.MethodGet && r.URL.Path == fakeCloudscaleMetadataPath {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"name": %q, "meta": {"cloudscale_uuid": %q}}`, a.servers[0].Name, a.servers[0].UUID)
+		return
+	}
+
+	if a.token != "" && r.Header.Get("Authorization") != "Bearer "+a.token {
+		http.Error(w, `{"detail": "Invalid token."}`, http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/"), "/", 2)
+	resource := parts[0]
+
+	id := ""
+	key := r.Method + " /v1/" + resource
+	if len(parts) > 1 {
+		id = parts[1]
+		key += "/{id}"
+	}
+	a.calls[key]++
+
+	if a.unavailable > 0 {
+		a.unavailable--
+		http.Error(w, `{"detail": "Service unavailable."}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	var result interface{}
+
+	switch key {
+	case "GET /v1/floating-ips":
+		result = a.floatingIPs
+
+	case "GET /v1/floating-ips/{id}", "PATCH /v1/floating-ips/{id}":
+		floatingIP := a.findFloatingIP(id)
+		if floatingIP == nil {
+			http.Error(w, `{"detail": "Not found."}`, http.StatusNotFound)
+			return
+		}
+
+		if r.Method == http.MethodPatch {
+			var req map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, `{"detail": "Invalid request."}`, http.StatusBadRequest)
+				return
+			}
+			if server, ok := req["server"]; ok {
+				floatingIP.Server = nil
+				if server != nil {
+					floatingIP.Server = &cloudscale.ServerStub{UUID: server.(string)}
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		result = floatingIP
+
+	case "GET /v1/servers/{id}":
+		for _, server := range a.servers {
+			if server.UUID == id {
+				result = server
+			}
+		}
+
+	case "GET /v1/regions":
+		result = a.regions
+	}
+
+	if result == nil {
+		http.Error(w, `{"detail": "Not found."}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func setupCloudscaleTest(t *testing.T, api *fakeCloudscaleAPI) *cloudscaleFloatingIPProvider {
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	endpoint := mustParseTextURL(server.URL + "/")
+
+	cfg := cloudscaleNotifyConfig{
+		Endpoint:   &endpoint,
+		Token:      "token",
+		ServerUUID: uuid.Must(uuid.FromString(fakeCloudscaleServerUUID)),
+	}
+
+	provider, err := cfg.NewProvider(context.Background(), identityConfig{}, rateLimitConfig{}, httpConfig{})
+	require.NoError(t, err)
+
+	return provider.(*cloudscaleFloatingIPProvider)
+}
+
+func TestCloudscaleConfirmDiscoveredIdentity(t *testing.T) {
+	api := newFakeCloudscaleAPI()
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	endpoint := mustParseTextURL(server.URL + "/")
+	metadataURL := mustParseTextURL(server.URL + fakeCloudscaleMetadataPath)
+	dir := t.TempDir()
+
+	cfg := cloudscaleNotifyConfig{
+		Endpoint:    &endpoint,
+		MetadataURL: &metadataURL,
+		Token:       "token",
+	}
+	identity := identityConfig{
+		Sources:           []string{identitySourceConfigDrive, identitySourceMetadata},
+		ConfigDrive:       dir,
+		CacheFileTemplate: filepath.Join(dir, "identity.%s.json"),
+		CacheTTL:          time.Hour,
+	}
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	// A server unknown to the API is rejected and not cached
+	writeIdentityTestFile(t, filepath.Join(dir, "openstack", "latest", "meta_data.json"),
+		`{"name": "lb1", "meta": {"cloudscale_uuid": "00000000-0000-4000-8000-000000000001"}}`)
+
+	_, err = cfg.NewProvider(context.Background(), identity, rateLimitConfig{}, httpConfig{})
+	assert.ErrorContains(t, err, "404 Not Found")
+	assert.NoFileExists(t, identity.makeCacheFilePath("cloudscale"))
+
+	// The discovered server is confirmed before it's used
+	identity.Sources = []string{identitySourceMetadata}
+
+	provider, err := cfg.NewProvider(context.Background(), identity, rateLimitConfig{}, httpConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, fakeCloudscaleServerUUID, provider.Identity())
+	assert.Equal(t, 2, api.callCounts()["GET /v1/servers/{id}"])
+
+	found, ok := identity.validatedIdentity("cloudscale", hostname, time.Now())
+	assert.True(t, ok)
+	assert.Equal(t, fakeCloudscaleServerUUID, found.ID)
+
+	// Unavailable APIs or invalid credentials don't prevent using the
+	// server, it's confirmed in the background instead
+	require.NoError(t, os.Remove(identity.makeCacheFilePath("cloudscale")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	api.setToken("other")
+
+	provider, err = cfg.NewProvider(ctx, identity, rateLimitConfig{}, httpConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, fakeCloudscaleServerUUID, provider.Identity())
+	assert.NoFileExists(t, identity.makeCacheFilePath("cloudscale"))
+
+	api.setToken("")
+
+	assert.Eventually(t, func() bool {
+		_, ok := identity.validatedIdentity("cloudscale", hostname, time.Now())
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestResolveCloudscaleFloatingIP(t *testing.T) {
+	floatingIPs := []cloudscale.FloatingIP{
+		{Network: "192.0.2.10/32", IPVersion: 4},
+		{Network: "192.0.2.64/29", IPVersion: 4},
+		{Network: "2001:db8:1::1/128", IPVersion: 6},
+		{Network: "2001:db8:1:200::/56", IPVersion: 6},
+	}
+
+	for _, tc := range []struct {
+		address  string
+		expected string
+		err      string
+	}{
+		{address: "192.0.2.10", expected: "192.0.2.10"},
+		{address: "192.0.2.10/32", expected: "192.0.2.10"},
+		{address: "192.0.2.64/29", expected: "192.0.2.64"},
+		// Keepalived address within the floating network
+		{address: "192.0.2.65/29", expected: "192.0.2.64"},
+		{address: "2001:db8:1::1", expected: "2001:db8:1::1"},
+		{address: "2001:db8:1:200::/56", expected: "2001:db8:1:200::"},
+		{address: "2001:db8:1:2ff::1/56", expected: "2001:db8:1:200::"},
+		{
+			address: "192.0.2.65",
+			err:     "Prefix length /32 of address 192.0.2.65/32 doesn't match floating IP 192.0.2.64/29",
+		},
+		{
+			address: "192.0.2.10/24",
+			err:     "Prefix length /24 of address 192.0.2.0/24 doesn't match floating IP 192.0.2.10/32",
+		},
+		{
+			address: "2001:db8:1:200::/64",
+			err:     "Prefix length /64 of address 2001:db8:1:200::/64 doesn't match floating IP 2001:db8:1:200::/56",
+		},
+		{address: "198.51.100.1", err: "Floating IP 198.51.100.1/32 not found"},
+		{address: "2001:db8:2::/56", err: "Floating IP 2001:db8:2::/56 not found"},
+	} {
+		t.Run(tc.address, func(t *testing.T) {
+			floatingIP, err := resolveCloudscaleFloatingIP(floatingIPs, mustParseNetAddress(tc.address))
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				assert.Nil(t, floatingIP)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.expected, floatingIP.IP())
+			}
+		})
+	}
+}
+
+func TestCloudscaleNewRefresher(t *testing.T) {
+	api := newFakeCloudscaleAPI()
+	api.addFloatingIP("192.0.2.1/32", "", fakeCloudscaleOtherUUID)
+	api.addFloatingIP("192.0.2.2/32", "rma", "")
+	api.addFloatingIP("192.0.2.3/32", "lpg", "")
+	api.addFloatingIP("192.0.2.4/32", "", "")
+	api.floatingIPs[3].LoadBalancer = &cloudscale.LoadBalancerStub{UUID: "lb-uuid"}
+	api.addFloatingIP("2001:db8:1:200::/56", "rma", "")
+
+	provider := setupCloudscaleTest(t, api)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		address string
+		err     string
+	}{
+		{address: "192.0.2.1"},
+		{address: "192.0.2.2"},
+		{
+			address: "192.0.2.3",
+			err:     "Floating IP 192.0.2.3/32 is in region lpg, but server " + fakeCloudscaleServerUUID + " is in region rma",
+		},
+		{
+			address: "192.0.2.4",
+			err:     "Floating IP 192.0.2.4/32 is assigned to load balancer lb-uuid",
+		},
+		{address: "192.0.2.5", err: "Floating IP 192.0.2.5/32 not found"},
+		{address: "2001:db8:1:200::1/56"},
+	} {
+		t.Run(tc.address, func(t *testing.T) {
+			_, err := provider.NewElasticIPRefresher(ctx, logrus.WithField("test", t.Name()), mustParseNetAddress(tc.address))
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err)
+				assert.IsType(t, &backoff.PermanentError{}, err)
+			}
+		})
+	}
+
+	// The server location and the floating IPs are looked up only once
+	assert.Equal(t, map[string]int{
+		"GET /v1/floating-ips": 1,
+		"GET /v1/servers/{id}": 1,
+		"GET /v1/regions":      1,
+	}, api.callCounts())
+}
+
+func TestCloudscaleValidateIPVersion(t *testing.T) {
+	server := &cloudscale.Server{
+		UUID: fakeCloudscaleServerUUID,
+		Interfaces: []cloudscale.Interface{
+			{Type: "public", Addresses: []cloudscale.Address{{Version: 4}}},
+			{Type: "private", Addresses: []cloudscale.Address{{Version: 6}}},
+		},
+	}
+
+	assert.NoError(t, validateCloudscaleFloatingIP(&cloudscale.FloatingIP{
+		Network:   "192.0.2.1/32",
+		IPVersion: 4,
+		Type:      "global",
+	}, server, "rma"))
+
+	assert.EqualError(t, validateCloudscaleFloatingIP(&cloudscale.FloatingIP{
+		Network:   "2001:db8::1/128",
+		IPVersion: 6,
+		Type:      "global",
+	}, server, "rma"), "Floating IP 2001:db8::1/128 requires a public IPv6 address, but server "+fakeCloudscaleServerUUID+" has none")
+}
+
+func TestCloudscalePinFailsEarly(t *testing.T) {
+	api := newFakeCloudscaleAPI()
+	api.addFloatingIP("192.0.2.1/32", "", "")
+	api.addFloatingIP("192.0.2.3/32", "lpg", "")
+
+	provider := setupCloudscaleTest(t, api)
+
+	cfg := newNotifyConfig()
+	cfg.TrackFile.FileTemplate = filepath.Join(t.TempDir(), "track.%s")
+	addresses := []netAddress{
+		mustParseNetAddress("192.0.2.1"),
+		mustParseNetAddress("192.0.2.3"),
+		mustParseNetAddress("192.0.2.5"),
+	}
+
+	err := pinElasticIPs(context.Background(), provider, "test", addresses, cfg)
+	assert.EqualError(t, err, "Floating IP 192.0.2.3/32 is in region lpg, but server "+
+		fakeCloudscaleServerUUID+" is in region rma; Floating IP 192.0.2.5/32 not found")
+
+	// Keepalived is told that refreshes can't work
+	track, err := os.ReadFile(cfg.TrackFile.makeTrackFilePath("test"))
+	require.NoError(t, err)
+	assert.Equal(t, "1\n", string(track))
+
+	// Nothing was changed
+	assert.Zero(t, api.callCounts()["PATCH /v1/floating-ips/{id}"])
+	assert.Nil(t, api.findFloatingIP("192.0.2.1").Server)
+}
+
+func TestCloudscaleNewRefresherUnavailable(t *testing.T) {
+	api := newFakeCloudscaleAPI()
+	api.addFloatingIP("192.0.2.1/32", "", fakeCloudscaleOtherUUID)
+	api.addFloatingIP("192.0.2.3/32", "lpg", "")
+
+	provider := setupCloudscaleTest(t, api)
+	ctx := context.Background()
+
+	// Server errors don't prevent creating the refresher
+	api.setUnavailable(1)
+	r, err := provider.NewElasticIPRefresher(ctx, logrus.WithField("test", t.Name()), mustParseNetAddress("192.0.2.1"))
+	require.NoError(t, err)
+
+	// The floating IP is validated when refreshing, errors are retried
+	api.setUnavailable(1)
+	_, err = r.Refresh(ctx)
+	assert.ErrorContains(t, err, "503 Service Unavailable")
+	assert.NotErrorAs(t, err, new(*backoff.PermanentError))
+	assert.Equal(t, fakeCloudscaleOtherUUID, api.serverOf("192.0.2.1"))
+
+	mustRefresh(t, ctx, r)
+	assert.Equal(t, fakeCloudscaleServerUUID, api.serverOf("192.0.2.1"))
+
+	// Validation failures found when refreshing are permanent
+	api.setUnavailable(1)
+	provider = setupCloudscaleTest(t, api)
+	r, err = provider.NewElasticIPRefresher(ctx, logrus.WithField("test", t.Name()), mustParseNetAddress("192.0.2.3"))
+	require.NoError(t, err)
+
+	_, err = r.Refresh(ctx)
+	assert.EqualError(t, err, "Floating IP 192.0.2.3/32 is in region lpg, but server "+
+		fakeCloudscaleServerUUID+" is in region rma")
+	assert.IsType(t, &backoff.PermanentError{}, err)
+}
+
+func TestCloudscalePinRetriesUnavailable(t *testing.T) {
+	api := newFakeCloudscaleAPI()
+	api.addFloatingIP("192.0.2.1/32", "", fakeCloudscaleOtherUUID)
+	api.addFloatingIP("192.0.2.2/32", "", fakeCloudscaleOtherUUID)
+	api.setUnavailable(2)
+
+	provider := setupCloudscaleTest(t, api)
+
+	cfg := newNotifyConfig()
+	cfg.TrackFile.FileTemplate = filepath.Join(t.TempDir(), "track.%s")
+	cfg.RefreshInterval = time.Hour
+	cfg.BackOff.InitialInterval = 10 * time.Millisecond
+	cfg.BackOff.MaxInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- pinElasticIPs(ctx, provider, "test", []netAddress{
+			mustParseNetAddress("192.0.2.1"),
+			mustParseNetAddress("192.0.2.2"),
+		}, cfg)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return api.serverOf("192.0.2.1") == fakeCloudscaleServerUUID &&
+			api.serverOf("192.0.2.2") == fakeCloudscaleServerUUID
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestCloudscaleRefreshMoved(t *testing.T) {
+	api := newFakeCloudscaleAPI()
+	api.addFloatingIP("192.0.2.1/32", "", fakeCloudscaleOtherUUID)
+
+	provider := setupCloudscaleTest(t, api)
+	ctx := context.Background()
+
+	r, err := provider.NewElasticIPRefresher(ctx, logrus.WithField("test", t.Name()), mustParseNetAddress("192.0.2.1"))
+	require.NoError(t, err)
+	api.resetCalls()
+
+	assert.True(t, mustRefresh(t, ctx, r))
+	assert.Equal(t, fakeCloudscaleServerUUID, api.serverOf("192.0.2.1"))
+	api.resetCalls()
+
+	// A floating IP routed to this server isn't updated
+	assert.False(t, mustRefresh(t, ctx, r))
+	assert.Equal(t, map[string]int{
+		"GET /v1/floating-ips/{id}": 1,
+	}, api.callCounts())
+
+	api.assign("192.0.2.1", fakeCloudscaleOtherUUID)
+	assert.True(t, mustRefresh(t, ctx, r))
+	assert.Equal(t, fakeCloudscaleServerUUID, api.serverOf("192.0.2.1"))
+	api.resetCalls()
+
+	// The next-hop is set even if it can't be retrieved
+	api.setUnavailable(1)
+	assert.True(t, mustRefresh(t, ctx, r))
+	assert.Equal(t, map[string]int{
+		"GET /v1/floating-ips/{id}":   1,
+		"PATCH /v1/floating-ips/{id}": 1,
+	}, api.callCounts())
+}
+
+func TestCloudscaleBatchRepinRecorded(t *testing.T) {
+	api := newFakeCloudscaleAPI()
+	api.addFloatingIP("127.0.0.1/32", "", fakeCloudscaleOtherUUID)
+
+	provider := setupCloudscaleTest(t, api)
+
+	// Probes fail as nothing listens on the port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	target := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	cfg := newNotifyConfig()
+	cfg.TrackFile.FileTemplate = filepath.Join(t.TempDir(), "track.%s")
+	cfg.TrackFile.Failures = 1
+	cfg.RefreshInterval = time.Hour
+	cfg.Verification = verificationConfig{
+		Probe:      verificationProbeTCP,
+		Target:     target,
+		Delay:      200 * time.Millisecond,
+		Interval:   10 * time.Millisecond,
+		Timeout:    time.Second,
+		Attempts:   4,
+		RepinAfter: 1,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- pinElasticIPs(ctx, provider, "test", []netAddress{mustParseNetAddress("127.0.0.1")}, cfg)
+	}()
+
+	require.Eventually(t, func() bool {
+		return api.serverOf("127.0.0.1") == fakeCloudscaleServerUUID
+	}, 5*time.Second, time.Millisecond)
+
+	api.setToken("other")
+
+	// Failing re-pins are reported to Keepalived like failing refreshes
+	assert.Eventually(t, func() bool {
+		track, err := os.ReadFile(cfg.TrackFile.makeTrackFilePath("test"))
+		return err == nil && string(track) == "1\n"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestCloudscaleSelfTestWritePermission(t *testing.T) {
+	api := newFakeCloudscaleAPI()
+	api.addFloatingIP("192.0.2.1/32", "", fakeCloudscaleOtherUUID)
+
+	provider := setupCloudscaleTest(t, api)
+	addresses := []netAddress{mustParseNetAddress("192.0.2.1")}
+
+	// Write access is only checked if enabled as it modifies the account
+	report := &selfTestReport{}
+	provider.Test(context.Background(), addresses, newSelfTestConfig(), report)
+	assert.Equal(t, checkOK, report.Status())
+	for _, c := range report.Checks() {
+		assert.NotEqual(t, "update-permission", c.Name)
+	}
+	assert.Zero(t, api.callCounts()["PATCH /v1/floating-ips/{id}"])
+
+	cfg := newSelfTestConfig()
+	cfg.CheckWritePermission = true
+
+	report = &selfTestReport{}
+	provider.Test(context.Background(), addresses, cfg, report)
+	assert.Contains(t, report.Checks(), selfTestCheck{
+		Name:    "update-permission",
+		Status:  checkOK,
+		Message: "Floating IP 192.0.2.1/32 can be updated",
+	})
+	assert.Equal(t, 1, api.callCounts()["PATCH /v1/floating-ips/{id}"])
+	assert.Equal(t, fakeCloudscaleOtherUUID, api.serverOf("192.0.2.1"))
+}
+
+func TestCloudscaleBatchRefresh(t *testing.T) {
+	api := newFakeCloudscaleAPI()
+	api.addFloatingIP("192.0.2.1/32", "", fakeCloudscaleServerUUID)
+	api.addFloatingIP("192.0.2.2/32", "", fakeCloudscaleOtherUUID)
+	api.addFloatingIP("2001:db8:1:200::/56", "rma", "")
+
+	provider := setupCloudscaleTest(t, api)
+	ctx := context.Background()
+
+	addresses := []netAddress{
+		mustParseNetAddress("192.0.2.1"),
+		mustParseNetAddress("192.0.2.2"),
+		mustParseNetAddress("2001:db8:1:200::/56"),
+	}
+
+	b, err := provider.NewElasticIPBatchRefresher(ctx, logrus.WithField("test", t.Name()), addresses)
+	require.NoError(t, err)
+	api.resetCalls()
+
+	// Only floating IPs not routed to this server are updated
+	assert.Equal(t, []refreshResult{{}, {Moved: true}, {Moved: true}}, b.RefreshAll(ctx, b.Addresses()))
+	assert.Equal(t, map[string]int{
+		"GET /v1/floating-ips":        1,
+		"PATCH /v1/floating-ips/{id}": 2,
+	}, api.callCounts())
+	api.resetCalls()
+
+	for _, floatingIP := range api.floatingIPs {
+		assert.Equal(t, fakeCloudscaleServerUUID, floatingIP.Server.UUID)
+	}
+
+	assert.Equal(t, []refreshResult{{}, {}, {}}, b.RefreshAll(ctx, b.Addresses()))
+	assert.Equal(t, map[string]int{
+		"GET /v1/floating-ips": 1,
+	}, api.callCounts())
+}
+
+func TestCloudscaleOwnersAndRelease(t *testing.T) {
+	api := newFakeCloudscaleAPI()
+	api.addFloatingIP("2001:db8:1:200::/56", "", fakeCloudscaleOtherUUID)
+
+	provider := setupCloudscaleTest(t, api)
+	ctx := context.Background()
+
+	r, err := provider.NewElasticIPRefresher(ctx, logrus.WithField("test", t.Name()), mustParseNetAddress("2001:db8:1:200::/56"))
+	require.NoError(t, err)
+
+	owners, err := r.Owners(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{fakeCloudscaleOtherUUID}, owners)
+
+	mustRefresh(t, ctx, r)
+	owners, err = r.Owners(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{fakeCloudscaleServerUUID}, owners)
+
+	require.NoError(t, r.Release(ctx))
+	owners, err = r.Owners(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, owners)
+}
+
+func TestCloudscaleAuthentication(t *testing.T) {
+	api := newFakeCloudscaleAPI()
+	api.setToken("other")
+	api.addFloatingIP("192.0.2.1/32", "", fakeCloudscaleOtherUUID)
+
+	provider := setupCloudscaleTest(t, api)
+	ctx := context.Background()
+	address := mustParseNetAddress("192.0.2.1")
+
+	_, err := provider.NewElasticIPRefresher(ctx, logrus.WithField("test", t.Name()), address)
+	assert.ErrorContains(t, err, "401 Unauthorized")
+	assert.IsType(t, &backoff.PermanentError{}, err)
+
+	api.setToken("token")
+
+	r, err := provider.NewElasticIPRefresher(ctx, logrus.WithField("test", t.Name()), address)
+	require.NoError(t, err)
+	mustRefresh(t, ctx, r)
+	assert.Equal(t, fakeCloudscaleServerUUID, api.serverOf("192.0.2.1"))
+}
@@ -2,58 +2,49 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/cenkalti/backoff/v4"
 	egoscale "github.com/exoscale/egoscale/v3"
 	"github.com/exoscale/egoscale/v3/credentials"
-	"github.com/exoscale/egoscale/v3/metadata"
 	"github.com/sirupsen/logrus"
 	"go.uber.org/multierr"
 )
 
-func findExoscaleZone(ctx context.Context) (string, error) {
-	var zone string
-
-	fn := func() error {
-		var err error
-		zone, err = metadata.Get(ctx, "availability-zone")
-		return err
-	}
+type exoscaleNotifyConfig struct {
+	Endpoint   *textURL `yaml:"endpoint"`
+	Zone       string   `yaml:"zone"`
+	Key        string   `yaml:"key"`
+	Secret     string   `yaml:"secret"`
+	InstanceID string   `yaml:"instance-id"`
 
-	if err := metadataRetry(fn); err != nil {
-		return "", err
-	}
+	exoscaleAddressConfig `yaml:",inline"`
 
-	return zone, nil
+	// Overrides from managed-addresses entries keyed by address
+	addresses map[string]exoscaleAddressConfig
 }
 
-func findExoscaleInstanceID(ctx context.Context) (egoscale.UUID, error) {
-	var instanceID string
-
-	fn := func() error {
-		var err error
-		instanceID, err = metadata.Get(ctx, "instance-id")
-		return err
-	}
+// withAddresses returns the configuration with the provider options of the
+// managed-addresses entries
+func (c exoscaleNotifyConfig) withAddresses(managed []managedAddress) exoscaleNotifyConfig {
+	c.addresses = map[string]exoscaleAddressConfig{}
 
-	if err := metadataRetry(fn); err != nil {
-		return "", err
+	for _, i := range managed {
+		if i.Exoscale != nil {
+			c.addresses[i.Address.String()] = *i.Exoscale
+		}
 	}
 
-	return egoscale.ParseUUID(instanceID)
-}
-
-type exoscaleNotifyConfig struct {
-	Endpoint   *textURL `yaml:"endpoint"`
-	Zone       string   `yaml:"zone"`
-	Key        string   `yaml:"key"`
-	Secret     string   `yaml:"secret"`
-	InstanceID string   `yaml:"instance-id"`
+	return c
 }
 
-func (c exoscaleNotifyConfig) NewProvider(ctx context.Context) (elasticIPProvider, error) {
+func (c exoscaleNotifyConfig) NewProvider(ctx context.Context, identity identityConfig, rateLimit rateLimitConfig, httpCfg httpConfig) (elasticIPProvider, error) {
 	var err error
 
 	if len(c.Key) < 1 {
@@ -64,31 +55,78 @@ func (c exoscaleNotifyConfig) NewProvider(ctx context.Context) (elasticIPProvide
 		return nil, fmt.Errorf("Authentication secret required")
 	}
 
-	zone := c.Zone
-	if zone == "" {
-		if zone, err = findExoscaleZone(ctx); err != nil {
-			return nil, fmt.Errorf("Exoscale zone lookup: %s", err)
+	managedEIP, err := c.managedEIP()
+	if err != nil {
+		return nil, err
+	}
+
+	addressManagedEIP := map[string]exoscaleManagedEIP{}
+	for address, override := range c.addresses {
+		if addressManagedEIP[address], err = c.override(override).managedEIP(); err != nil {
+			return nil, fmt.Errorf("Address %s: %w", address, err)
 		}
 	}
-	logrus.WithField("zone", zone).Debug("Exoscale zone")
 
-	var instanceID egoscale.UUID
-	if c.InstanceID == "" {
-		if instanceID, err = findExoscaleInstanceID(ctx); err != nil {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving hostname: %s", err)
+	}
+
+	found, cached := identity.validatedIdentity("exoscale", hostname, time.Now())
+	if cached && !c.matchesIdentity(found) {
+		cached = false
+	}
+
+	if !cached {
+		found = instanceIdentity{ID: c.InstanceID, Zone: c.Zone}
+	}
+
+	if found.Zone == "" || found.ID == "" {
+		needZone := found.Zone == ""
+
+		discovered, err := identity.discover(ctx, "exoscale", exoscaleIdentitySources(identity, httpCfg, needZone), func(i instanceIdentity) error {
+			if needZone && i.Zone == "" {
+				return errors.New("Zone unknown")
+			}
+			_, err := egoscale.ParseUUID(i.ID)
+			return err
+		})
+		if err != nil {
 			return nil, fmt.Errorf("Instance ID lookup: %s", err)
 		}
-	} else {
-		if instanceID, err = egoscale.ParseUUID(c.InstanceID); err != nil {
-			return nil, fmt.Errorf("Failed to parse instance UUID: %s", err)
+
+		if found.Zone == "" {
+			found.Zone = discovered.Zone
+		}
+		if found.ID == "" {
+			found.ID = discovered.ID
 		}
 	}
 
-	logrus.WithField("instance-id", instanceID.String()).Debug("Instance ID")
+	zone := found.Zone
+	logrus.WithField("zone", zone).Debug("Exoscale zone")
+
+	instanceID, err := egoscale.ParseUUID(found.ID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse instance UUID: %s", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"instance-id": instanceID.String(),
+		"cached":      cached,
+	}).Debug("Instance ID")
 
 	creds := credentials.NewStaticCredentials(c.Key, c.Secret)
 
+	// Retries are left to the refresh loop so they are subject to the
+	// same rate limit
+	httpClient, err := httpCfg.newClient(rateLimit)
+	if err != nil {
+		return nil, err
+	}
+
 	timeoutOpt := egoscale.ClientOptWithWaitTimeout(1 * time.Minute)
-	client, err := egoscale.NewClient(creds, timeoutOpt)
+	client, err := egoscale.NewClient(creds, timeoutOpt, egoscale.ClientOptWithHTTPClient(httpClient))
 	if err != nil {
 		return nil, err
 	}
@@ -103,86 +141,372 @@ func (c exoscaleNotifyConfig) NewProvider(ctx context.Context) (elasticIPProvide
 	}
 	client = client.WithEndpoint(zoneEndpoint)
 
-	vm, err := client.GetInstance(ctx, instanceID)
-	if err != nil {
+	p := &exoscaleElasticIPProvider{
+		client:            client,
+		zone:              zone,
+		instance:          &egoscale.Instance{ID: instanceID},
+		managedEIP:        managedEIP,
+		addressManagedEIP: addressManagedEIP,
+	}
+
+	// Only the ID of the instance is used when refreshing
+	confirm := func(ctx context.Context) error {
+		_, err := confirmExoscaleInstance(ctx, client, instanceID)
+		return err
+	}
+
+	if cached {
+		// Confirm the instance without delaying the first refresh
+		identity.revalidateIdentity(ctx, "exoscale", hostname, found, confirm)
+	} else if err := identity.confirmIdentity(ctx, "exoscale", hostname, found, confirm); err != nil {
 		return nil, err
 	}
 
-	return &exoscaleElasticIPProvider{
-		client:   client,
-		zone:     zone,
-		instance: vm,
-	}, nil
+	return p, nil
+}
+
+// confirmExoscaleInstance retrieves the instance running floaty. An
+// identityRejectedError is returned if the API doesn't know the instance.
+func confirmExoscaleInstance(ctx context.Context, client *egoscale.Client, id egoscale.UUID) (*egoscale.Instance, error) {
+	vm, err := client.GetInstance(ctx, id)
+	if errors.Is(err, egoscale.ErrNotFound) || errors.Is(err, egoscale.ErrBadRequest) {
+		return nil, &identityRejectedError{Err: err}
+	}
+
+	return vm, err
+}
+
+// matchesIdentity reports whether a cached identity is compatible with the
+// configured zone and instance ID
+func (c exoscaleNotifyConfig) matchesIdentity(i instanceIdentity) bool {
+	if i.Zone == "" || i.ID == "" {
+		return false
+	}
+
+	return (c.Zone == "" || c.Zone == i.Zone) &&
+		(c.InstanceID == "" || strings.EqualFold(c.InstanceID, i.ID))
 }
 
+// exoscaleCacheTTL limits how long the results of expensive API calls are
+// shared between refreshers
+const exoscaleCacheTTL = 1 * time.Minute
+
 type exoscaleElasticIPProvider struct {
 	client   *egoscale.Client
 	zone     string
 	instance *egoscale.Instance
+
+	// Overridden for individual addresses, keyed by address
+	managedEIP        exoscaleManagedEIP
+	addressManagedEIP map[string]exoscaleManagedEIP
+
+	mu               sync.Mutex
+	elasticIPs       []egoscale.ElasticIP
+	elasticIPsExpiry time.Time
+
+	// Separate from mu so that lookups of elastic IPs don't wait for a scan
+	attachmentsMu     sync.Mutex
+	attachments       map[egoscale.UUID][]egoscale.UUID
+	attachmentsExpiry time.Time
+}
+
+// managedEIPFor returns the managed EIP mode of the address
+func (p *exoscaleElasticIPProvider) managedEIPFor(address netAddress) exoscaleManagedEIP {
+	if m, ok := p.addressManagedEIP[address.String()]; ok {
+		return m
+	}
+	return p.managedEIP
 }
 
-func (p *exoscaleElasticIPProvider) Test(ctx context.Context) error {
-	// Check that we can list EIPs and instances
+// listElasticIPs returns all elastic IPs in the zone. The list is cached.
+func (p *exoscaleElasticIPProvider) listElasticIPs(ctx context.Context) ([]egoscale.ElasticIP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Now().Before(p.elasticIPsExpiry) {
+		return p.elasticIPs, nil
+	}
+
 	eips, err := p.client.ListElasticIPS(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	elasticIPs := []string{}
-	for _, eip := range eips.ElasticIPS {
-		elasticIPs = append(elasticIPs, eip.IP)
+	p.elasticIPs = eips.ElasticIPS
+	p.elasticIPsExpiry = time.Now().Add(exoscaleCacheTTL)
+
+	return p.elasticIPs, nil
+}
+
+// scanAttachments returns the IDs of the instances each elastic IP is
+// attached to by fetching the details of all instances in the zone. Complete
+// results are cached and concurrent callers wait for a running scan. On errors
+// with individual instances the attachments found so far are returned
+// alongside the errors.
+func (p *exoscaleElasticIPProvider) scanAttachments(ctx context.Context) (map[egoscale.UUID][]egoscale.UUID, error) {
+	p.attachmentsMu.Lock()
+	defer p.attachmentsMu.Unlock()
+
+	if time.Now().Before(p.attachmentsExpiry) {
+		return p.attachments, nil
 	}
-	logrus.WithField("eips", elasticIPs).Debug("Got elastic IPs")
 
 	vms, err := p.client.ListInstances(ctx)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Unable to list instances: %w", err)
 	}
 
-	instances := []string{}
+	logrus.WithField("instances", len(vms.Instances)).Debug("Scanning all instances for elastic IPs")
+
+	attachments := map[egoscale.UUID][]egoscale.UUID{}
+	var errs error
 	for _, vm := range vms.Instances {
-		instances = append(instances, vm.ID.String())
+		// NOTE(sg): the response from `ListInstances()` doesn't
+		// contain the attached EIPs. Because of that we need to fetch
+		// the instance details with `GetInstance()` in order to be
+		// able to find the instances holding the EIP.
+		vmdetails, err := p.client.GetInstance(ctx, vm.ID)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		for _, eip := range vmdetails.ElasticIPS {
+			attachments[eip.ID] = append(attachments[eip.ID], vm.ID)
+		}
 	}
-	logrus.WithField("count", len(instances)).WithField("instances", instances).Debug("Got instances")
 
-	return nil
+	if errs == nil {
+		p.attachments = attachments
+		p.attachmentsExpiry = time.Now().Add(exoscaleCacheTTL)
+	}
+
+	return attachments, errs
 }
 
-func (p *exoscaleElasticIPProvider) NewElasticIPRefresher(ctx context.Context,
-	logger *logrus.Entry, network netAddress) (elasticIPRefresher, error) {
+// invalidateAttachments discards cached attachments after changes
+func (p *exoscaleElasticIPProvider) invalidateAttachments() {
+	p.attachmentsMu.Lock()
+	defer p.attachmentsMu.Unlock()
 
-	eips, err := p.client.ListElasticIPS(ctx)
+	p.attachments = nil
+	p.attachmentsExpiry = time.Time{}
+}
+
+func (p *exoscaleElasticIPProvider) Identity() string {
+	return p.instance.ID.String()
+}
+
+func (p *exoscaleElasticIPProvider) Test(ctx context.Context, addresses []netAddress, cfg selfTestConfig, report *selfTestReport) {
+	var eips *egoscale.ListElasticIPSResponse
+	var vms *egoscale.ListInstancesResponse
+	var vm *egoscale.Instance
+
+	err := report.Time(func() (err error) {
+		eips, err = p.client.ListElasticIPS(ctx)
+		return err
+	})
+	if err == nil {
+		elasticIPs := []string{}
+		families := map[egoscale.ElasticIPAddressfamily]int{}
+		for _, eip := range eips.ElasticIPS {
+			elasticIPs = append(elasticIPs, eip.IP)
+			families[eip.Addressfamily]++
+		}
+		logrus.WithField("eips", elasticIPs).Debug("Got elastic IPs")
+		report.Add("credentials", checkOK, "Listed %d elastic IPs (%d IPv4, %d IPv6)", len(eips.ElasticIPS),
+			families[egoscale.ElasticIPAddressfamilyInet4], families[egoscale.ElasticIPAddressfamilyInet6])
+	} else {
+		report.Add("credentials", checkCritical, "Listing elastic IPs failed: %s", err)
+	}
+
+	err = report.Time(func() (err error) {
+		vm, err = p.client.GetInstance(ctx, p.instance.ID)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("Elastic IP lookup: %s", err)
+		report.Add("instance", checkCritical, "Retrieving instance %s failed: %s", p.instance.ID, err)
+	} else if vm.State != egoscale.InstanceStateRunning {
+		report.Add("instance", checkWarning, "Instance %q (%s) in zone %s is %s", vm.Name, vm.ID, p.zone, vm.State)
+	} else {
+		report.Add("instance", checkOK, "Instance %q (%s) in zone %s", vm.Name, vm.ID, p.zone)
 	}
-	for _, eip := range eips.ElasticIPS {
-		ip := net.ParseIP(eip.IP)
+
+	err = report.Time(func() (err error) {
+		vms, err = p.client.ListInstances(ctx)
+		return err
+	})
+	if err == nil {
+		instances := []string{}
+		for _, vm := range vms.Instances {
+			instances = append(instances, vm.ID.String())
+		}
+		logrus.WithField("count", len(instances)).WithField("instances", instances).Debug("Got instances")
+		report.Add("instance-list", checkOK, "Listed %d instances", len(instances))
+	} else {
+		report.Add("instance-list", checkCritical, "Listing instances failed: %s", err)
+	}
+
+	if eips == nil {
+		return
+	}
+
+	var existing *egoscale.ElasticIP
+
+	// Holders are determined from the attachments of all instances
+	var attachments map[egoscale.UUID][]egoscale.UUID
+	var scanErr error
+	if len(addresses) > 0 {
+		p.invalidateAttachments()
+		scanErr = report.Time(func() (err error) {
+			attachments, err = p.scanAttachments(ctx)
+			return err
+		})
+	}
+
+	for _, address := range addresses {
+		name := fmt.Sprintf("address %s", address)
+
+		if eip, err := findExoscaleElasticIP(eips.ElasticIPS, address); err != nil {
+			report.Add(name, checkCritical, "%s", err)
+		} else {
+			existing = eip
+
+			if scanErr != nil {
+				report.Add(name, checkCritical, "Elastic IP %s (%s, %s): determining holders failed: %s",
+					eip.IP, eip.Addressfamily, eip.ID, scanErr)
+				continue
+			}
+
+			status, description := p.managedEIPFor(address).testHealthcheck(eip, len(attachments[eip.ID]))
+			report.Add(name, status, "Elastic IP %s (%s, %s): %s", eip.IP, eip.Addressfamily, eip.ID, description)
+		}
+	}
+
+	if !cfg.CheckWritePermission {
+		return
+	}
+
+	if existing == nil {
+		report.Add("update-permission", checkUnknown, "No elastic IP available to verify write access")
+		return
+	}
+
+	// An update without changes verifies that the key has write access
+	err = report.Time(func() error {
+		op, err := p.client.UpdateElasticIP(ctx, existing.ID, egoscale.UpdateElasticIPRequest{
+			Description: existing.Description,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = p.client.Wait(ctx, op, egoscale.OperationStateSuccess)
+		return err
+	})
+	if err == nil {
+		report.Add("update-permission", checkOK, "Elastic IP %s can be updated", existing.IP)
+	} else {
+		report.Add("update-permission", checkCritical, "Updating elastic IP %s failed: %s", existing.IP, err)
+	}
+}
+
+// exoscaleElasticIPAddress returns the address of an elastic IP and, if
+// known, the network it's part of
+func exoscaleElasticIPAddress(eip egoscale.ElasticIP) (net.IP, *net.IPNet) {
+	var network *net.IPNet
+
+	if eip.Cidr != "" {
+		if _, parsed, err := net.ParseCIDR(eip.Cidr); err == nil {
+			network = parsed
+		}
+	}
+
+	raw, _, _ := strings.Cut(eip.IP, "/")
+
+	return net.ParseIP(raw), network
+}
+
+// findExoscaleElasticIP returns the elastic IP for the address. An elastic IP
+// with the same address is preferred. Otherwise the address may contain the
+// elastic IP, e.g. a Keepalived address with the prefix length of the
+// interface, or be within the network of the elastic IP. An error is returned
+// if there are multiple such elastic IPs.
+func findExoscaleElasticIP(eips []egoscale.ElasticIP, network netAddress) (*egoscale.ElasticIP, error) {
+	var candidates []*egoscale.ElasticIP
+
+	for i, eip := range eips {
+		ip, eipNetwork := exoscaleElasticIPAddress(eip)
 		if ip == nil {
 			logrus.WithField("eip", eip.IP).Warn("Failed to parse EIP")
 			continue
 		}
-		logrus.WithField("eip", ip).Debug("Checking EIP")
-		if network.Contains(ip) {
-			return &exoscaleElasticIPRefresher{
-				logger:   logger,
-				network:  network,
-				client:   p.client,
-				eip:      eip,
-				instance: p.instance,
-				zone:     p.zone,
-			}, nil
+		logrus.WithFields(logrus.Fields{
+			"eip":           ip,
+			"addressfamily": eip.Addressfamily,
+		}).Debug("Checking EIP")
+
+		if ip.Equal(network.IP) {
+			return &eips[i], nil
+		}
+
+		if network.Contains(ip) || (eipNetwork != nil && eipNetwork.Contains(network.IP)) {
+			candidates = append(candidates, &eips[i])
 		}
 	}
-	return nil, fmt.Errorf("Unable to find elastic IP for %s", network)
+
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("Unable to find elastic IP for %s", network)
+	case 1:
+		return candidates[0], nil
+	}
+
+	ambiguous := []string{}
+	for _, eip := range candidates {
+		ambiguous = append(ambiguous, eip.IP)
+	}
+
+	return nil, fmt.Errorf("Multiple elastic IPs match %s: %s", network, strings.Join(ambiguous, ", "))
+}
+
+func (p *exoscaleElasticIPProvider) NewElasticIPRefresher(ctx context.Context,
+	logger *logrus.Entry, network netAddress) (elasticIPRefresher, error) {
+
+	eips, err := p.listElasticIPs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Elastic IP lookup: %s", err)
+	}
+	eip, err := findExoscaleElasticIP(eips, network)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, _ := exoscaleElasticIPAddress(*eip)
+
+	return &exoscaleElasticIPRefresher{
+		logger:   logger,
+		network:  network,
+		provider: p,
+		client:   p.client,
+		eip:      *eip,
+		ip:       ip,
+		instance: p.instance,
+		zone:     p.zone,
+
+		managedEIP: p.managedEIPFor(network),
+	}, nil
 }
 
 type exoscaleElasticIPRefresher struct {
 	network  netAddress
 	logger   *logrus.Entry
+	provider *exoscaleElasticIPProvider
 	client   *egoscale.Client
 	eip      egoscale.ElasticIP
+	ip       net.IP
 	instance *egoscale.Instance
 	zone     string
+
+	managedEIP exoscaleManagedEIP
 }
 
 func (r *exoscaleElasticIPRefresher) String() string {
@@ -193,7 +517,87 @@ func (r *exoscaleElasticIPRefresher) Logger() *logrus.Entry {
 	return r.logger
 }
 
-func (r *exoscaleElasticIPRefresher) Refresh(ctx context.Context) error {
+func (r *exoscaleElasticIPRefresher) Refresh(ctx context.Context) (bool, error) {
+	attached := false
+
+	vm, err := r.client.GetInstance(ctx, r.instance.ID)
+	if err != nil {
+		// Attaching may still succeed
+		r.logger.Warningf("Retrieving attached elastic IPs failed: %s", err)
+	} else {
+		for _, eip := range vm.ElasticIPS {
+			attached = attached || eip.ID == r.eip.ID
+		}
+	}
+
+	return r.refresh(ctx, attached)
+}
+
+// refresh attaches the elastic IP to this instance, unless it's known to be
+// attached already, and detaches it from all other instances. Attaching
+// without knowing the previous state counts as a move.
+func (r *exoscaleElasticIPRefresher) refresh(ctx context.Context, attached bool) (bool, error) {
+	if r.managedEIP.mode == exoscaleManagedEIPHealthCheck {
+		if err := r.ensureHealthcheck(ctx); err != nil {
+			return false, permanentExoscaleError(err)
+		}
+	}
+
+	moved := !attached
+
+	if attached {
+		r.logger.Debugf("EIP %s is attached to instance %s", r.eip.IP, r.instance.ID.String())
+	} else if err := r.attach(ctx); err != nil {
+		return false, permanentExoscaleError(err)
+	}
+
+	if r.managedEIP.keepsOtherHolders(r.eip) {
+		r.logger.Debugf("Not detaching managed EIP %s from other instances", r.eip.IP)
+		return moved, nil
+	}
+
+	// Detach from other instances, even if not all holders could be
+	// determined. Attachments cached before attaching are outdated.
+	holders, detacherrs := r.holders(ctx, moved)
+	for _, holder := range holders {
+		if holder == r.instance.ID {
+			continue
+		}
+		logrus.Infof("Detaching EIP %s from %s", r.eip.IP, holder.String())
+		if err := r.detach(ctx, holder); err != nil {
+			detacherrs = multierr.Append(detacherrs, err)
+		} else {
+			moved = true
+		}
+	}
+	return moved, detacherrs
+}
+
+// exoscalePermanentErrors are client errors which retrying doesn't resolve.
+// Rate limiting is handled by the transport.
+var exoscalePermanentErrors = []error{
+	egoscale.ErrBadRequest,
+	egoscale.ErrUnauthorized,
+	egoscale.ErrPaymentRequired,
+	egoscale.ErrForbidden,
+	egoscale.ErrNotFound,
+	egoscale.ErrMethodNotAllowed,
+	egoscale.ErrGone,
+	egoscale.ErrUnprocessableEntity,
+}
+
+// permanentExoscaleError marks client errors as permanent
+func permanentExoscaleError(err error) error {
+	for _, i := range exoscalePermanentErrors {
+		if errors.Is(err, i) {
+			return backoff.Permanent(err)
+		}
+	}
+
+	return err
+}
+
+func (r *exoscaleElasticIPRefresher) attach(ctx context.Context) error {
 	target := egoscale.AttachInstanceToElasticIPRequest{
 		Instance: &egoscale.InstanceTarget{
 			ID: r.instance.ID,
@@ -201,55 +605,135 @@ func (r *exoscaleElasticIPRefresher) Refresh(ctx context.Context) error {
 	}
 	op, err := r.client.AttachInstanceToElasticIP(ctx, r.eip.ID, target)
 	if err != nil {
-		return fmt.Errorf("while attaching the IP to this instance: %s", err)
+		return fmt.Errorf("while attaching the IP to this instance: %w", err)
 	}
 	op, err = r.client.Wait(ctx, op, egoscale.OperationStateSuccess)
 	if err != nil {
-		return fmt.Errorf("while attaching the IP to this instance: %s", err)
+		return fmt.Errorf("while attaching the IP to this instance: %w", err)
 	}
 	logrus.Infof("Ensured that %s is attached to instance %s", r.eip.IP, r.instance.ID.String())
+	return nil
+}
+
+// holders returns the IDs of all instances the elastic IP is attached to,
+// based on the attachments of all instances. Unless fresh, the cached
+// attachments may be used. On errors with individual instances the holders
+// found so far are returned alongside the errors.
+func (r *exoscaleElasticIPRefresher) holders(ctx context.Context, fresh bool) ([]egoscale.UUID, error) {
+	if fresh {
+		r.provider.invalidateAttachments()
+	}
 
-	vms, err := r.client.ListInstances(ctx)
+	attachments, err := r.provider.scanAttachments(ctx)
+	return attachments[r.eip.ID], err
+}
+
+func (r *exoscaleElasticIPRefresher) detach(ctx context.Context, instanceID egoscale.UUID) error {
+	detachTarget := egoscale.DetachInstanceFromElasticIPRequest{
+		Instance: &egoscale.InstanceTarget{
+			ID: instanceID,
+		},
+	}
+	defer r.provider.invalidateAttachments()
+
+	op, err := r.client.DetachInstanceFromElasticIP(ctx, r.eip.ID, detachTarget)
 	if err != nil {
-		return fmt.Errorf("Unable to list instances: %s", err)
+		return err
 	}
+	_, err = r.client.Wait(ctx, op, egoscale.OperationStateSuccess)
+	return err
+}
 
-	// Detach from other instances
-	var detacherrs error
-	for _, vm := range vms.Instances {
-		if vm.ID == r.instance.ID {
-			continue
+func (r *exoscaleElasticIPRefresher) Owners(ctx context.Context) ([]string, error) {
+	holders, err := r.holders(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := []string{}
+	for _, holder := range holders {
+		owners = append(owners, holder.String())
+	}
+	return owners, nil
+}
+
+func (r *exoscaleElasticIPRefresher) Release(ctx context.Context) error {
+	holders, err := r.holders(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	for _, holder := range holders {
+		if holder == r.instance.ID {
+			logrus.Infof("Detaching EIP %s from %s", r.eip.IP, holder.String())
+			return r.detach(ctx, holder)
 		}
-		// NOTE(sg): the response from `ListInstances()` doesn't
-		// contain the attached EIPs. Because of that we need to fetch
-		// the instance details with `GetInstance()` in order to be
-		// able to detach EIPs from other instances.
-		vmdetails, err := r.client.GetInstance(ctx, vm.ID)
+	}
+
+	logrus.Infof("EIP %s is not attached to instance %s", r.eip.IP, r.instance.ID.String())
+	return nil
+}
+
+func (p *exoscaleElasticIPProvider) NewElasticIPBatchRefresher(ctx context.Context,
+	logger *logrus.Entry, addresses []netAddress) (elasticIPBatchRefresher, error) {
+
+	b := &exoscaleElasticIPBatchRefresher{
+		provider:   p,
+		logger:     logger,
+		addresses:  addresses,
+		refreshers: map[string]*exoscaleElasticIPRefresher{},
+	}
+
+	var errs error
+	for _, address := range addresses {
+		r, err := p.NewElasticIPRefresher(ctx, logger.WithField("address", address), address)
 		if err != nil {
-			detacherrs = multierr.Append(detacherrs, err)
+			errs = multierr.Append(errs, err)
 			continue
 		}
-		if vmdetails.ElasticIPS != nil && len(vmdetails.ElasticIPS) > 0 {
-			logrus.Debugf("Checking if we need to detach EIPs from %s", vm.ID.String())
-			for _, eip := range vmdetails.ElasticIPS {
-				if eip.ID == r.eip.ID {
-					logrus.Infof("Detaching EIP %s from %s", r.eip.IP, vm.ID.String())
-					detachTarget := egoscale.DetachInstanceFromElasticIPRequest{
-						Instance: &egoscale.InstanceTarget{
-							ID: vm.ID,
-						},
-					}
-					op, err := r.client.DetachInstanceFromElasticIP(ctx, r.eip.ID, detachTarget)
-					if err != nil {
-						detacherrs = multierr.Append(detacherrs, err)
-					}
-					op, err = r.client.Wait(ctx, op, egoscale.OperationStateSuccess)
-					if err != nil {
-						detacherrs = multierr.Append(detacherrs, err)
-					}
-				}
-			}
+		b.refreshers[address.String()] = r.(*exoscaleElasticIPRefresher)
+	}
+	if errs != nil {
+		return nil, errs
+	}
+
+	return b, nil
+}
+
+// exoscaleElasticIPBatchRefresher fetches the elastic IPs attached to this
+// instance once per refresh and only attaches missing ones
+type exoscaleElasticIPBatchRefresher struct {
+	provider  *exoscaleElasticIPProvider
+	logger    *logrus.Entry
+	addresses []netAddress
+
+	// Refreshers keyed by address
+	refreshers map[string]*exoscaleElasticIPRefresher
+}
+
+func (b *exoscaleElasticIPBatchRefresher) Logger() *logrus.Entry {
+	return b.logger
+}
+
+func (b *exoscaleElasticIPBatchRefresher) Addresses() []netAddress {
+	return b.addresses
+}
+
+func (b *exoscaleElasticIPBatchRefresher) RefreshAll(ctx context.Context, addresses []netAddress) []refreshResult {
+	attached := map[egoscale.UUID]bool{}
+
+	vm, err := b.provider.client.GetInstance(ctx, b.provider.instance.ID)
+	if err != nil {
+		// Attach all elastic IPs, refreshes may still succeed
+		b.logger.Warningf("Retrieving attached elastic IPs failed: %s", err)
+	} else {
+		for _, eip := range vm.ElasticIPS {
+			attached[eip.ID] = true
 		}
 	}
-	return detacherrs
+
+	return refreshConcurrently(len(addresses), func(i int) (bool, error) {
+		r := b.refreshers[addresses[i].String()]
+		return r.refresh(ctx, attached[r.eip.ID])
+	})
 }
@@ -0,0 +1,893 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	egoscale "github.com/exoscale/egoscale/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeExoscaleUUID(n int) egoscale.UUID {
+	return egoscale.UUID(fmt.Sprintf("00000000-0000-4000-8000-%012d", n))
+}
+
+// fakeExoscaleAPI implements the parts of the Exoscale API used by floaty
+// and counts the calls per endpoint
+type fakeExoscaleAPI struct {
+	mu         sync.Mutex
+	calls      map[string]int
+	elasticIPs []egoscale.ElasticIP
+	instances  []egoscale.UUID
+	// attachments maps instance IDs to elastic IP IDs
+	attachments map[egoscale.UUID][]egoscale.UUID
+}
+
+func newFakeExoscaleAPI(instanceCount int) *fakeExoscaleAPI {
+	api := &fakeExoscaleAPI{
+		calls:       map[string]int{},
+		attachments: map[egoscale.UUID][]egoscale.UUID{},
+	}
+	for i := 1; i <= instanceCount; i++ {
+		api.instances = append(api.instances, fakeExoscaleUUID(i))
+	}
+	return api
+}
+
+func (a *fakeExoscaleAPI) addElasticIP(id egoscale.UUID, ip string) {
+	family := egoscale.ElasticIPAddressfamilyInet4
+	if strings.Contains(ip, ":") {
+		family = egoscale.ElasticIPAddressfamilyInet6
+	}
+
+	a.elasticIPs = append(a.elasticIPs, egoscale.ElasticIP{
+		ID:            id,
+		IP:            ip,
+		Addressfamily: family,
+	})
+}
+
+func (a *fakeExoscaleAPI) findElasticIP(id egoscale.UUID) *egoscale.ElasticIP {
+	for i := range a.elasticIPs {
+		if a.elasticIPs[i].ID == id {
+			return &a.elasticIPs[i]
+		}
+	}
+	return nil
+}
+
+func (a *fakeExoscaleAPI) attach(instance, eip egoscale.UUID) {
+	for _, i := range a.attachments[instance] {
+		if i == eip {
+			return
+		}
+	}
+	a.attachments[instance] = append(a.attachments[instance], eip)
+}
+
+func (a *fakeExoscaleAPI) detach(instance, eip egoscale.UUID) {
+	remaining := []egoscale.UUID{}
+	for _, i := range a.attachments[instance] {
+		if i != eip {
+			remaining = append(remaining, i)
+		}
+	}
+	a.attachments[instance] = remaining
+}
+
+// holders returns the instances the elastic IP is attached to
+func (a *fakeExoscaleAPI) holders(eip egoscale.UUID) []egoscale.UUID {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := []egoscale.UUID{}
+	for _, instance := range a.instances {
+		for _, i := range a.attachments[instance] {
+			if i == eip {
+				result = append(result, instance)
+			}
+		}
+	}
+	return result
+}
+
+func (a *fakeExoscaleAPI) resetCalls() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.calls = map[string]int{}
+}
+
+func (a *fakeExoscaleAPI) callCounts() map[string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := map[string]int{}
+	for k, v := range a.calls {
+		result[k] = v
+	}
+	return result
+}
+
+func (a *fakeExoscaleAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	parts := strings.SplitN(path, "/", 2)
+	resource := parts[0]
+
+	id, action := "", ""
+	if len(parts) > 1 {
+		id, action, _ = strings.Cut(parts[1], ":")
+	}
+
+	key := r.Method + " /" + resource
+	if id != "" {
+		key += "/{id}"
+	}
+	if action != "" {
+		key += ":" + action
+	}
+	a.calls[key]++
+
+	var result interface{}
+
+	switch key {
+	case "GET /elastic-ip":
+		result = egoscale.ListElasticIPSResponse{ElasticIPS: a.elasticIPs}
+
+	case "GET /elastic-ip/{id}", "PUT /elastic-ip/{id}":
+		eip := a.findElasticIP(egoscale.UUID(id))
+		if eip == nil {
+			http.Error(w, `{"message": "not found"}`, http.StatusNotFound)
+			return
+		}
+
+		result = eip
+
+		if r.Method == http.MethodPut {
+			var req egoscale.UpdateElasticIPRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, `{"message": "invalid request"}`, http.StatusBadRequest)
+				return
+			}
+			eip.Description = req.Description
+			if req.Healthcheck != nil {
+				eip.Healthcheck = req.Healthcheck
+			}
+			result = egoscale.Operation{
+				ID:    fakeExoscaleUUID(999999),
+				State: egoscale.OperationStateSuccess,
+			}
+		}
+
+	case "PUT /elastic-ip/{id}:attach", "PUT /elastic-ip/{id}:detach":
+		var req egoscale.AttachInstanceToElasticIPRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Instance == nil {
+			http.Error(w, `{"message": "invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		if action == "attach" {
+			a.attach(req.Instance.ID, egoscale.UUID(id))
+		} else {
+			a.detach(req.Instance.ID, egoscale.UUID(id))
+		}
+		result = egoscale.Operation{
+			ID:    fakeExoscaleUUID(999999),
+			State: egoscale.OperationStateSuccess,
+		}
+
+	case "GET /instance":
+		list := egoscale.ListInstancesResponse{}
+		for _, instance := range a.instances {
+			list.Instances = append(list.Instances, egoscale.ListInstancesResponseInstances{ID: instance})
+		}
+		result = list
+
+	case "GET /instance/{id}":
+		instance := egoscale.Instance{
+			ID:    egoscale.UUID(id),
+			State: egoscale.InstanceStateRunning,
+		}
+		for _, eip := range a.attachments[instance.ID] {
+			instance.ElasticIPS = append(instance.ElasticIPS, egoscale.ElasticIP{ID: eip})
+		}
+		result = instance
+
+	default:
+		http.Error(w, `{"message": "not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func setupExoscaleTest(t *testing.T, api *fakeExoscaleAPI, opts ...func(*exoscaleNotifyConfig)) *exoscaleElasticIPProvider {
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	endpoint := mustParseTextURL(server.URL)
+
+	cfg := exoscaleNotifyConfig{
+		Endpoint:   &endpoint,
+		Zone:       "ch-gva-2",
+		Key:        "EXOtest",
+		Secret:     "secret",
+		InstanceID: fakeExoscaleUUID(1).String(),
+	}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	provider, err := cfg.NewProvider(context.Background(), identityConfig{}, rateLimitConfig{}, httpConfig{})
+	require.NoError(t, err)
+
+	return provider.(*exoscaleElasticIPProvider)
+}
+
+func TestExoscaleRefreshCallCount(t *testing.T) {
+	api := newFakeExoscaleAPI(300)
+	api.addElasticIP(fakeExoscaleUUID(1001), "192.0.2.1")
+	api.addElasticIP(fakeExoscaleUUID(1002), "192.0.2.2")
+	api.attach(fakeExoscaleUUID(2), fakeExoscaleUUID(1001))
+
+	provider := setupExoscaleTest(t, api)
+	ctx := context.Background()
+
+	var refreshers []elasticIPRefresher
+	for _, address := range []string{"192.0.2.1", "192.0.2.2"} {
+		r, err := provider.NewElasticIPRefresher(ctx, logrus.WithField("address", address), mustParseNetAddress(address))
+		require.NoError(t, err)
+		refreshers = append(refreshers, r)
+	}
+
+	// The elastic IP list is shared by all refreshers
+	assert.Equal(t, 1, api.callCounts()["GET /elastic-ip"])
+	api.resetCalls()
+
+	// Taking over the first address scans all instances after attaching
+	// and detaches the previous holder
+	assert.True(t, mustRefresh(t, ctx, refreshers[0]))
+	assert.Equal(t, []egoscale.UUID{fakeExoscaleUUID(1)}, api.holders(fakeExoscaleUUID(1001)))
+	assert.Equal(t, map[string]int{
+		"PUT /elastic-ip/{id}:attach": 1,
+		"GET /instance":               1,
+		"GET /instance/{id}":          301,
+		"PUT /elastic-ip/{id}:detach": 1,
+	}, api.callCounts())
+	api.resetCalls()
+
+	// Attaching doesn't use the scan from before
+	assert.True(t, mustRefresh(t, ctx, refreshers[1]))
+	assert.Equal(t, map[string]int{
+		"PUT /elastic-ip/{id}:attach": 1,
+		"GET /instance":               1,
+		"GET /instance/{id}":          301,
+	}, api.callCounts())
+	api.resetCalls()
+
+	// Further refreshes don't attach again and share the scan
+	for i := 0; i < 5; i++ {
+		for _, r := range refreshers {
+			assert.False(t, mustRefresh(t, ctx, r))
+		}
+	}
+	assert.Equal(t, map[string]int{
+		"GET /instance/{id}": 10,
+	}, api.callCounts())
+	assert.Equal(t, []egoscale.UUID{fakeExoscaleUUID(1)}, api.holders(fakeExoscaleUUID(1002)))
+	api.resetCalls()
+
+	// Owners are never taken from the shared scan
+	owners, err := refreshers[0].Owners(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{fakeExoscaleUUID(1).String()}, owners)
+	assert.Equal(t, map[string]int{
+		"GET /instance":      1,
+		"GET /instance/{id}": 300,
+	}, api.callCounts())
+}
+
+func TestExoscaleScanDoesNotBlockLookups(t *testing.T) {
+	api := newFakeExoscaleAPI(3)
+	api.addElasticIP(fakeExoscaleUUID(1001), "192.0.2.1")
+
+	var stall atomic.Bool
+	scanning := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if stall.Load() && strings.HasPrefix(r.URL.Path, "/instance/") {
+			once.Do(func() { close(scanning) })
+			<-release
+		}
+		api.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	endpoint := mustParseTextURL(server.URL)
+	cfg := exoscaleNotifyConfig{
+		Endpoint:   &endpoint,
+		Zone:       "ch-gva-2",
+		Key:        "EXOtest",
+		Secret:     "secret",
+		InstanceID: fakeExoscaleUUID(1).String(),
+	}
+
+	provider, err := cfg.NewProvider(context.Background(), identityConfig{}, rateLimitConfig{}, httpConfig{})
+	require.NoError(t, err)
+	p := provider.(*exoscaleElasticIPProvider)
+	ctx := context.Background()
+
+	stall.Store(true)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.scanAttachments(ctx)
+		done <- err
+	}()
+	<-scanning
+
+	eips, err := p.listElasticIPs(ctx)
+	require.NoError(t, err)
+	assert.Len(t, eips, 1)
+
+	close(release)
+	assert.NoError(t, <-done)
+}
+
+func TestExoscaleOwners(t *testing.T) {
+	api := newFakeExoscaleAPI(10)
+	api.addElasticIP(fakeExoscaleUUID(1001), "192.0.2.1")
+	api.attach(fakeExoscaleUUID(3), fakeExoscaleUUID(1001))
+
+	provider := setupExoscaleTest(t, api)
+	ctx := context.Background()
+
+	r, err := provider.NewElasticIPRefresher(ctx, logrus.WithField("address", "192.0.2.1"), mustParseNetAddress("192.0.2.1"))
+	require.NoError(t, err)
+
+	owners, err := r.Owners(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{fakeExoscaleUUID(3).String()}, owners)
+
+	mustRefresh(t, ctx, r)
+	owners, err = r.Owners(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{fakeExoscaleUUID(1).String()}, owners)
+
+	require.NoError(t, r.Release(ctx))
+	owners, err = r.Owners(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, owners)
+}
+
+func TestExoscaleBatchRefresh(t *testing.T) {
+	api := newFakeExoscaleAPI(100)
+	api.addElasticIP(fakeExoscaleUUID(1001), "192.0.2.1")
+	api.addElasticIP(fakeExoscaleUUID(1002), "192.0.2.2")
+	api.addElasticIP(fakeExoscaleUUID(1003), "192.0.2.3")
+	api.attach(fakeExoscaleUUID(1), fakeExoscaleUUID(1001))
+	api.attach(fakeExoscaleUUID(2), fakeExoscaleUUID(1002))
+
+	provider := setupExoscaleTest(t, api)
+	ctx := context.Background()
+
+	addresses := []netAddress{
+		mustParseNetAddress("192.0.2.1"),
+		mustParseNetAddress("192.0.2.2"),
+		mustParseNetAddress("192.0.2.3"),
+	}
+
+	b, err := provider.NewElasticIPBatchRefresher(ctx, logrus.WithField("test", t.Name()), addresses)
+	require.NoError(t, err)
+	assert.Equal(t, addresses, b.Addresses())
+	assert.Equal(t, 1, api.callCounts()["GET /elastic-ip"])
+	api.resetCalls()
+
+	// Only missing elastic IPs are attached
+	assert.Equal(t, []refreshResult{{}, {Moved: true}, {Moved: true}}, b.RefreshAll(ctx, b.Addresses()))
+	assert.Equal(t, 2, api.callCounts()["PUT /elastic-ip/{id}:attach"])
+	assert.Equal(t, 1, api.callCounts()["PUT /elastic-ip/{id}:detach"])
+
+	for _, id := range []int{1001, 1002, 1003} {
+		assert.Equal(t, []egoscale.UUID{fakeExoscaleUUID(1)}, api.holders(fakeExoscaleUUID(id)))
+	}
+
+	// Once nothing changes the scan is shared
+	assert.Equal(t, []refreshResult{{}, {}, {}}, b.RefreshAll(ctx, b.Addresses()))
+	api.resetCalls()
+
+	assert.Equal(t, []refreshResult{{}, {}, {}}, b.RefreshAll(ctx, b.Addresses()))
+	assert.Equal(t, map[string]int{
+		"GET /instance/{id}": 1,
+	}, api.callCounts())
+}
+
+func TestFindExoscaleElasticIP(t *testing.T) {
+	eips := []egoscale.ElasticIP{
+		{ID: fakeExoscaleUUID(1), IP: "192.0.2.10", Addressfamily: egoscale.ElasticIPAddressfamilyInet4},
+		{ID: fakeExoscaleUUID(2), IP: "192.0.2.20", Addressfamily: egoscale.ElasticIPAddressfamilyInet4},
+		{ID: fakeExoscaleUUID(3), IP: "198.51.100.5", Addressfamily: egoscale.ElasticIPAddressfamilyInet4},
+		{ID: fakeExoscaleUUID(4), IP: "2001:db8:1::10", Addressfamily: egoscale.ElasticIPAddressfamilyInet6},
+		{
+			ID:            fakeExoscaleUUID(5),
+			IP:            "2001:db8:2::",
+			Cidr:          "2001:db8:2::/64",
+			Addressfamily: egoscale.ElasticIPAddressfamilyInet6,
+		},
+	}
+
+	dir := t.TempDir()
+	kd := filepath.Join(dir, "keepalived.conf")
+	require.NoError(t, os.WriteFile(kd, []byte(`
+vrrp_instance mixed {
+  virtual_ipaddress {
+    192.0.2.10
+    198.51.100.5/24 dev eth0
+    2001:db8:1::10
+    2001:db8:1::10/128
+    2001:db8:2::1/64
+  }
+}
+vrrp_instance ambiguous {
+  virtual_ipaddress {
+    192.0.2.30/24
+  }
+}
+vrrp_instance missing {
+  virtual_ipaddress {
+    192.0.2.99
+    2001:db8:3::1
+  }
+}
+`), 0644))
+
+	for _, tc := range []struct {
+		instance string
+		expected []egoscale.UUID
+		err      []string
+	}{
+		{
+			instance: "mixed",
+			expected: []egoscale.UUID{
+				fakeExoscaleUUID(1),
+				fakeExoscaleUUID(3),
+				fakeExoscaleUUID(4),
+				fakeExoscaleUUID(4),
+				fakeExoscaleUUID(5),
+			},
+		},
+		{
+			instance: "ambiguous",
+			err:      []string{"Multiple elastic IPs match 192.0.2.0/24: 192.0.2.10, 192.0.2.20"},
+		},
+		{
+			instance: "missing",
+			err: []string{
+				"Unable to find elastic IP for 192.0.2.99/32",
+				"Unable to find elastic IP for 2001:db8:3::1/128",
+			},
+		},
+	} {
+		t.Run(tc.instance, func(t *testing.T) {
+			addresses, err := readAddressesFromKeepalivedConfig(kd, tc.instance)
+			require.NoError(t, err)
+
+			found := []egoscale.UUID{}
+			errs := []string{}
+			for _, address := range addresses {
+				eip, err := findExoscaleElasticIP(eips, address)
+				if err != nil {
+					errs = append(errs, err.Error())
+				} else {
+					found = append(found, eip.ID)
+				}
+			}
+
+			if tc.err == nil {
+				assert.Empty(t, errs)
+				assert.Equal(t, tc.expected, found)
+			} else {
+				assert.Equal(t, tc.err, errs)
+			}
+		})
+	}
+}
+
+func TestExoscaleRefreshIPv6(t *testing.T) {
+	api := newFakeExoscaleAPI(5)
+	api.addElasticIP(fakeExoscaleUUID(1001), "192.0.2.1")
+	api.addElasticIP(fakeExoscaleUUID(1002), "2001:db8:1::10")
+	api.attach(fakeExoscaleUUID(2), fakeExoscaleUUID(1001))
+	api.attach(fakeExoscaleUUID(2), fakeExoscaleUUID(1002))
+
+	provider := setupExoscaleTest(t, api)
+	ctx := context.Background()
+
+	addresses := []netAddress{
+		mustParseNetAddress("192.0.2.1"),
+		mustParseNetAddress("2001:db8:1::10"),
+	}
+
+	b, err := provider.NewElasticIPBatchRefresher(ctx, logrus.WithField("test", t.Name()), addresses)
+	require.NoError(t, err)
+
+	assert.Equal(t, []refreshResult{{Moved: true}, {Moved: true}}, b.RefreshAll(ctx, b.Addresses()))
+	assert.Equal(t, []egoscale.UUID{fakeExoscaleUUID(1)}, api.holders(fakeExoscaleUUID(1001)))
+	assert.Equal(t, []egoscale.UUID{fakeExoscaleUUID(1)}, api.holders(fakeExoscaleUUID(1002)))
+
+	r, err := provider.NewElasticIPRefresher(ctx, logrus.WithField("test", t.Name()), mustParseNetAddress("2001:db8:1::10"))
+	require.NoError(t, err)
+
+	require.NoError(t, r.Release(ctx))
+	assert.Empty(t, api.holders(fakeExoscaleUUID(1002)))
+	assert.Equal(t, []egoscale.UUID{fakeExoscaleUUID(1)}, api.holders(fakeExoscaleUUID(1001)))
+}
+
+func TestExoscaleSelfTest(t *testing.T) {
+	api := newFakeExoscaleAPI(2)
+	api.addElasticIP(fakeExoscaleUUID(1001), "192.0.2.1")
+	api.addElasticIP(fakeExoscaleUUID(1002), "2001:db8:1::10")
+
+	provider := setupExoscaleTest(t, api)
+
+	report := &selfTestReport{}
+	provider.Test(context.Background(), []netAddress{
+		mustParseNetAddress("192.0.2.1"),
+		mustParseNetAddress("2001:db8:1::10"),
+		mustParseNetAddress("2001:db8:1::11"),
+	}, newSelfTestConfig(), report)
+
+	messages := map[string]string{}
+	for _, c := range report.Checks() {
+		messages[c.Name] = fmt.Sprintf("%s: %s", c.Status, c.Message)
+	}
+
+	assert.Equal(t, "OK: Listed 2 elastic IPs (1 IPv4, 1 IPv6)", messages["credentials"])
+	assert.Equal(t, "OK: Elastic IP 192.0.2.1 (inet4, "+fakeExoscaleUUID(1001).String()+"): no health check, attached to 0 instance(s)",
+		messages["address 192.0.2.1/32"])
+	assert.Equal(t, "OK: Elastic IP 2001:db8:1::10 (inet6, "+fakeExoscaleUUID(1002).String()+"): no health check, attached to 0 instance(s)",
+		messages["address 2001:db8:1::10/128"])
+	assert.Equal(t, "CRITICAL: Unable to find elastic IP for 2001:db8:1::11/128", messages["address 2001:db8:1::11/128"])
+
+	// Write access is only checked if enabled as it modifies the account
+	assert.NotContains(t, messages, "update-permission")
+	assert.Zero(t, api.callCounts()["PUT /elastic-ip/{id}"])
+
+	cfg := newSelfTestConfig()
+	cfg.CheckWritePermission = true
+
+	report = &selfTestReport{}
+	provider.Test(context.Background(), []netAddress{mustParseNetAddress("192.0.2.1")}, cfg, report)
+	assert.Contains(t, report.Checks(), selfTestCheck{
+		Name:    "update-permission",
+		Status:  checkOK,
+		Message: "Elastic IP 192.0.2.1 can be updated",
+	})
+	assert.Equal(t, 1, api.callCounts()["PUT /elastic-ip/{id}"])
+}
+
+func TestExoscaleHealthcheckMatches(t *testing.T) {
+	skipVerify := true
+
+	desired := &egoscale.ElasticIPHealthcheck{
+		Mode:     egoscale.ElasticIPHealthcheckModeHTTP,
+		Port:     80,
+		URI:      "/healthz",
+		Interval: 5,
+	}
+
+	for _, tc := range []struct {
+		name     string
+		actual   *egoscale.ElasticIPHealthcheck
+		desired  *egoscale.ElasticIPHealthcheck
+		expected bool
+	}{
+		{name: "none", expected: true},
+		{name: "unmanaged", desired: desired, expected: false},
+		{name: "unwanted", actual: desired, expected: false},
+		{
+			name: "provider defaults",
+			actual: &egoscale.ElasticIPHealthcheck{
+				Mode: egoscale.ElasticIPHealthcheckModeHTTP, Port: 80, URI: "/healthz",
+				Interval: 5, Timeout: 2, StrikesOk: 2, StrikesFail: 3,
+			},
+			desired:  desired,
+			expected: true,
+		},
+		{
+			name: "interval",
+			actual: &egoscale.ElasticIPHealthcheck{
+				Mode: egoscale.ElasticIPHealthcheckModeHTTP, Port: 80, URI: "/healthz", Interval: 10,
+			},
+			desired:  desired,
+			expected: false,
+		},
+		{
+			name: "port",
+			actual: &egoscale.ElasticIPHealthcheck{
+				Mode: egoscale.ElasticIPHealthcheckModeHTTP, Port: 8080, URI: "/healthz", Interval: 5,
+			},
+			desired:  desired,
+			expected: false,
+		},
+		{
+			name:   "tls",
+			actual: &egoscale.ElasticIPHealthcheck{Mode: egoscale.ElasticIPHealthcheckModeHttps, Port: 443},
+			desired: &egoscale.ElasticIPHealthcheck{
+				Mode: egoscale.ElasticIPHealthcheckModeHttps, Port: 443, TlsSkipVerify: &skipVerify,
+			},
+			expected: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, exoscaleHealthcheckMatches(tc.actual, tc.desired))
+		})
+	}
+}
+
+func TestExoscaleManagedEIPModeConfig(t *testing.T) {
+	api := newFakeExoscaleAPI(1)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	endpoint := mustParseTextURL(server.URL)
+
+	for _, tc := range []struct {
+		mode        string
+		healthCheck *exoscaleHealthCheckConfig
+		err         string
+	}{
+		{mode: ""},
+		{mode: "exclusive"},
+		{mode: "shared"},
+		{mode: "other", err: `Unsupported managed EIP mode "other"`},
+		{mode: "health-check", err: `Managed EIP mode "health-check" requires a health check configuration`},
+		{
+			mode:        "health-check",
+			healthCheck: &exoscaleHealthCheckConfig{Mode: "udp", Port: 53},
+			err:         `Unsupported health check mode "udp"`,
+		},
+		{
+			mode:        "health-check",
+			healthCheck: &exoscaleHealthCheckConfig{Mode: "tcp"},
+			err:         `Invalid health check port 0`,
+		},
+		{mode: "health-check", healthCheck: &exoscaleHealthCheckConfig{Mode: "tcp", Port: 22}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			cfg := exoscaleNotifyConfig{
+				Endpoint:   &endpoint,
+				Zone:       "ch-gva-2",
+				Key:        "EXOtest",
+				Secret:     "secret",
+				InstanceID: fakeExoscaleUUID(1).String(),
+				exoscaleAddressConfig: exoscaleAddressConfig{
+					ManagedEIPMode: tc.mode,
+					HealthCheck:    tc.healthCheck,
+				},
+			}
+
+			_, err := cfg.NewProvider(context.Background(), identityConfig{}, rateLimitConfig{}, httpConfig{})
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestExoscaleSharedManagedEIP(t *testing.T) {
+	api := newFakeExoscaleAPI(3)
+	api.addElasticIP(fakeExoscaleUUID(1001), "192.0.2.1")
+	api.addElasticIP(fakeExoscaleUUID(1002), "192.0.2.2")
+	api.elasticIPs[0].Healthcheck = &egoscale.ElasticIPHealthcheck{
+		Mode: egoscale.ElasticIPHealthcheckModeTCP,
+		Port: 80,
+	}
+	for _, eip := range []int{1001, 1002} {
+		api.attach(fakeExoscaleUUID(2), fakeExoscaleUUID(eip))
+		api.attach(fakeExoscaleUUID(3), fakeExoscaleUUID(eip))
+	}
+
+	provider := setupExoscaleTest(t, api, func(cfg *exoscaleNotifyConfig) {
+		cfg.ManagedEIPMode = exoscaleManagedEIPShared
+	})
+	ctx := context.Background()
+
+	for _, address := range []string{"192.0.2.1", "192.0.2.2"} {
+		r, err := provider.NewElasticIPRefresher(ctx, logrus.WithField("address", address), mustParseNetAddress(address))
+		require.NoError(t, err)
+		mustRefresh(t, ctx, r)
+	}
+
+	// Only the unmanaged elastic IP is detached from other instances
+	assert.Equal(t, []egoscale.UUID{fakeExoscaleUUID(1), fakeExoscaleUUID(2), fakeExoscaleUUID(3)},
+		api.holders(fakeExoscaleUUID(1001)))
+	assert.Equal(t, []egoscale.UUID{fakeExoscaleUUID(1)}, api.holders(fakeExoscaleUUID(1002)))
+}
+
+func TestExoscaleHealthCheckMode(t *testing.T) {
+	api := newFakeExoscaleAPI(3)
+	api.addElasticIP(fakeExoscaleUUID(1001), "192.0.2.1")
+	api.attach(fakeExoscaleUUID(2), fakeExoscaleUUID(1001))
+
+	provider := setupExoscaleTest(t, api, func(cfg *exoscaleNotifyConfig) {
+		cfg.ManagedEIPMode = exoscaleManagedEIPHealthCheck
+		cfg.HealthCheck = &exoscaleHealthCheckConfig{
+			Mode:     "http",
+			Port:     8080,
+			URI:      "/master",
+			Interval: 5 * time.Second,
+		}
+	})
+	ctx := context.Background()
+
+	report := &selfTestReport{}
+	provider.Test(ctx, []netAddress{mustParseNetAddress("192.0.2.1")}, newSelfTestConfig(), report)
+	assert.Equal(t, checkWarning, report.Status())
+
+	r, err := provider.NewElasticIPRefresher(ctx, logrus.WithField("test", t.Name()), mustParseNetAddress("192.0.2.1"))
+	require.NoError(t, err)
+	api.resetCalls()
+
+	mustRefresh(t, ctx, r)
+	mustRefresh(t, ctx, r)
+
+	// The health check is configured once and no instance is detached
+	assert.Equal(t, map[string]int{
+		"GET /elastic-ip/{id}":        2,
+		"GET /instance/{id}":          2,
+		"PUT /elastic-ip/{id}":        1,
+		"PUT /elastic-ip/{id}:attach": 1,
+	}, api.callCounts())
+	assert.Equal(t, []egoscale.UUID{fakeExoscaleUUID(1), fakeExoscaleUUID(2)}, api.holders(fakeExoscaleUUID(1001)))
+	assert.Equal(t, &egoscale.ElasticIPHealthcheck{
+		Mode:     egoscale.ElasticIPHealthcheckModeHTTP,
+		Port:     8080,
+		URI:      "/master",
+		Interval: 5,
+	}, api.findElasticIP(fakeExoscaleUUID(1001)).Healthcheck)
+
+	report = &selfTestReport{}
+	provider.Test(ctx, []netAddress{mustParseNetAddress("192.0.2.1")}, newSelfTestConfig(), report)
+	for _, c := range report.Checks() {
+		if c.Name == "address 192.0.2.1/32" {
+			assert.Equal(t, checkOK, c.Status)
+			assert.Equal(t, "Elastic IP 192.0.2.1 (inet4, "+fakeExoscaleUUID(1001).String()+
+				"): http health check on port 8080 /master every 5s, attached to 2 instance(s)",
+				c.Message)
+		}
+	}
+}
+
+func TestExoscaleManagedEIPModePerAddress(t *testing.T) {
+	api := newFakeExoscaleAPI(3)
+	api.addElasticIP(fakeExoscaleUUID(1001), "192.0.2.1")
+	api.addElasticIP(fakeExoscaleUUID(1002), "192.0.2.2")
+	for _, eip := range []int{1001, 1002} {
+		api.attach(fakeExoscaleUUID(2), fakeExoscaleUUID(eip))
+	}
+
+	provider := setupExoscaleTest(t, api, func(cfg *exoscaleNotifyConfig) {
+		*cfg = cfg.withAddresses([]managedAddress{
+			{Address: mustParseNetAddress("192.0.2.1")},
+			{
+				Address: mustParseNetAddress("192.0.2.2"),
+				Exoscale: &exoscaleAddressConfig{
+					ManagedEIPMode: exoscaleManagedEIPHealthCheck,
+					HealthCheck:    &exoscaleHealthCheckConfig{Mode: "tcp", Port: 22},
+				},
+			},
+		})
+	})
+	ctx := context.Background()
+
+	for _, address := range []string{"192.0.2.1", "192.0.2.2"} {
+		r, err := provider.NewElasticIPRefresher(ctx, logrus.WithField("address", address), mustParseNetAddress(address))
+		require.NoError(t, err)
+		mustRefresh(t, ctx, r)
+	}
+
+	// Only the address using the health check mode stays attached to other
+	// instances
+	assert.Equal(t, []egoscale.UUID{fakeExoscaleUUID(1)}, api.holders(fakeExoscaleUUID(1001)))
+	assert.Nil(t, api.findElasticIP(fakeExoscaleUUID(1001)).Healthcheck)
+	assert.Equal(t, []egoscale.UUID{fakeExoscaleUUID(1), fakeExoscaleUUID(2)}, api.holders(fakeExoscaleUUID(1002)))
+	assert.Equal(t, &egoscale.ElasticIPHealthcheck{
+		Mode: egoscale.ElasticIPHealthcheckModeTCP,
+		Port: 22,
+	}, api.findElasticIP(fakeExoscaleUUID(1002)).Healthcheck)
+}
+
+func TestExoscaleManagedEIPModePerAddressInvalid(t *testing.T) {
+	api := newFakeExoscaleAPI(1)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	endpoint := mustParseTextURL(server.URL)
+
+	cfg := exoscaleNotifyConfig{
+		Endpoint:   &endpoint,
+		Zone:       "ch-gva-2",
+		Key:        "EXOtest",
+		Secret:     "secret",
+		InstanceID: fakeExoscaleUUID(1).String(),
+	}
+	cfg = cfg.withAddresses([]managedAddress{{
+		Address:  mustParseNetAddress("192.0.2.1"),
+		Exoscale: &exoscaleAddressConfig{ManagedEIPMode: exoscaleManagedEIPHealthCheck},
+	}})
+
+	_, err := cfg.NewProvider(context.Background(), identityConfig{}, rateLimitConfig{}, httpConfig{})
+	assert.EqualError(t, err, `Address 192.0.2.1/32: Managed EIP mode "health-check" requires a health check configuration`)
+}
+
+func TestExoscaleCachedIdentity(t *testing.T) {
+	api := newFakeExoscaleAPI(3)
+
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	endpoint := mustParseTextURL(server.URL)
+
+	cfg := exoscaleNotifyConfig{
+		Endpoint:   &endpoint,
+		Zone:       "ch-gva-2",
+		Key:        "EXOtest",
+		Secret:     "secret",
+		InstanceID: fakeExoscaleUUID(1).String(),
+	}
+	identity := identityConfig{
+		Sources:           []string{identitySourceCache},
+		CacheFileTemplate: filepath.Join(t.TempDir(), "identity.%s.json"),
+		CacheTTL:          1 * time.Hour,
+	}
+
+	// The instance is confirmed before the first use
+	_, err := cfg.NewProvider(context.Background(), identity, rateLimitConfig{}, httpConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, api.callCounts()["GET /instance/{id}"])
+
+	// Afterwards the cached identity is confirmed in the background
+	api.resetCalls()
+	cfg.Zone = ""
+	cfg.InstanceID = ""
+
+	provider, err := cfg.NewProvider(context.Background(), identity, rateLimitConfig{}, httpConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, fakeExoscaleUUID(1).String(), provider.Identity())
+	assert.Equal(t, "ch-gva-2", provider.(*exoscaleElasticIPProvider).zone)
+
+	assert.Eventually(t, func() bool {
+		return api.callCounts()["GET /instance/{id}"] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A cached identity contradicting the configuration is ignored
+	api.resetCalls()
+	cfg.InstanceID = fakeExoscaleUUID(2).String()
+	cfg.Zone = "ch-gva-2"
+
+	provider, err = cfg.NewProvider(context.Background(), identity, rateLimitConfig{}, httpConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, fakeExoscaleUUID(2).String(), provider.Identity())
+	assert.Equal(t, 1, api.callCounts()["GET /instance/{id}"])
+}
@@ -2,25 +2,377 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/cenkalti/backoff/v4"
+	"github.com/nightlyone/lockfile"
 	"github.com/sirupsen/logrus"
 )
 
+const fakeIdentity = "fake"
+
+// Interval of attempts to lock the state file
+const fakeStateLockInterval = 10 * time.Millisecond
+
+// Serializes access to state files within this process; the lock file only
+// excludes other processes
+var fakeStateFileMu sync.Mutex
+
+// fakeNotifyConfig controls the fake provider used to test floaty without
+// a cloud. Processes sharing a state file see the same owners and faults.
+type fakeNotifyConfig struct {
+	// ID of this machine; must differ between processes sharing a state
+	// file
+	Identity string `yaml:"identity"`
+
+	// JSON file with owners and faults shared between processes; the state
+	// is kept in memory if empty
+	StateFile string `yaml:"state-file"`
+
+	// Address of the HTTP endpoint to inspect and change the state, e.g.
+	// "127.0.0.1:9180"; disabled if empty
+	ControlListen string `yaml:"control-listen"`
+
+	// Owners of addresses until they are refreshed, keyed by address
+	Owners map[string]string `yaml:"owners"`
+
+	Faults fakeFaults `yaml:"faults"`
+}
+
+func newFakeNotifyConfig() fakeNotifyConfig {
+	return fakeNotifyConfig{
+		Identity: fakeIdentity,
+	}
+}
+
+// fakeDuration is a duration de-/serialized as text such as "1.5s"
+type fakeDuration time.Duration
+
+func (d fakeDuration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *fakeDuration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = fakeDuration(parsed)
+
+	return nil
+}
+
+// fakeFaults are injected into the API calls of the fake provider
+type fakeFaults struct {
+	// Delay of every API call
+	Latency fakeDuration `yaml:"latency" json:"latency,omitempty"`
+
+	// Probability of API calls failing with a temporary error, from 0 to 1
+	ErrorRate float64 `yaml:"error-rate" json:"error-rate,omitempty"`
+
+	// All API calls fail with a temporary error
+	Outage bool `yaml:"outage" json:"outage,omitempty"`
+
+	// Addresses whose refreshes fail with a permanent error
+	PermanentErrors []netAddress `yaml:"permanent-errors" json:"permanent-errors,omitempty"`
+}
+
+func (f fakeFaults) validate() error {
+	if f.Latency < 0 {
+		return fmt.Errorf("Latency must not be negative")
+	}
+
+	if f.ErrorRate < 0 || f.ErrorRate > 1 {
+		return fmt.Errorf("Error rate must be between 0 and 1, got %v", f.ErrorRate)
+	}
+
+	return nil
+}
+
+func (f fakeFaults) isPermanent(address netAddress) bool {
+	for _, i := range f.PermanentErrors {
+		if i.String() == address.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fakeCloudState is what the fake provider knows about the "cloud"
+type fakeCloudState struct {
+	// Machine each address is routed to, keyed by address
+	Owners map[string]string `json:"owners"`
+
+	// Replace the configured faults once set via the control endpoint
+	Faults *fakeFaults `json:"faults,omitempty"`
+}
+
+func newFakeCloudState(owners map[string]string) fakeCloudState {
+	result := fakeCloudState{Owners: map[string]string{}}
+
+	for address, owner := range owners {
+		result.Owners[address] = owner
+	}
+
+	return result
+}
+
+// normalizeFakeOwners returns the owners keyed by parsed addresses
+func normalizeFakeOwners(owners map[string]string) (map[string]string, error) {
+	result := map[string]string{}
+
+	for address, owner := range owners {
+		parsed, err := parseNetAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		result[parsed.String()] = owner
+	}
+
+	return result, nil
+}
+
+func (s fakeCloudState) clone() fakeCloudState {
+	result := newFakeCloudState(s.Owners)
+
+	if s.Faults != nil {
+		faults := *s.Faults
+		result.Faults = &faults
+	}
+
+	return result
+}
+
+func (c fakeNotifyConfig) NewProvider(ctx context.Context) (elasticIPProvider, error) {
+	if err := c.Faults.validate(); err != nil {
+		return nil, fmt.Errorf("Fake faults: %w", err)
+	}
+
+	owners, err := normalizeFakeOwners(c.Owners)
+	if err != nil {
+		return nil, fmt.Errorf("Fake owners: %w", err)
+	}
+	c.Owners = owners
+
+	if c.StateFile != "" {
+		path, err := filepath.Abs(c.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		c.StateFile = path
+	}
+
+	p := &fakeElasticIPProvider{
+		cfg:   c,
+		state: newFakeCloudState(c.Owners),
+	}
+
+	if c.ControlListen != "" {
+		listener, err := net.Listen("tcp", c.ControlListen)
+		if err != nil {
+			// Another process may still be shutting down
+			logrus.Warningf("Fake control endpoint unavailable: %s", err)
+		} else {
+			go p.serveControl(ctx, listener)
+		}
+	}
+
+	return p, nil
+}
+
 func NewFakeProvider() (elasticIPProvider, error) {
-	return &fakeElasticIPProvider{}, nil
+	return newFakeNotifyConfig().NewProvider(context.Background())
 }
 
+// fakeElasticIPProvider pretends to route addresses and prints each update.
+// The zero value is usable and injects no faults.
 type fakeElasticIPProvider struct {
+	cfg fakeNotifyConfig
+
 	mu             sync.Mutex
 	refreshCounter map[string]int
+
+	// Used without state file
+	state fakeCloudState
+}
+
+func (p *fakeElasticIPProvider) Identity() string {
+	if p.cfg.Identity == "" {
+		return fakeIdentity
+	}
+
+	return p.cfg.Identity
+}
+
+// load returns the current state
+func (p *fakeElasticIPProvider) load() (fakeCloudState, error) {
+	if p.cfg.StateFile == "" {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		return p.state.clone(), nil
+	}
+
+	data, err := os.ReadFile(p.cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return newFakeCloudState(p.cfg.Owners), nil
+	} else if err != nil {
+		return fakeCloudState{}, fmt.Errorf("Reading fake state: %w", err)
+	}
+
+	result := fakeCloudState{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fakeCloudState{}, fmt.Errorf("Parsing fake state: %w", err)
+	}
+
+	return result.clone(), nil
+}
+
+// update calls the function with the current state and stores the changes
+// unless it fails. State files are locked for the duration.
+func (p *fakeElasticIPProvider) update(ctx context.Context, fn func(*fakeCloudState) error) error {
+	if p.cfg.StateFile == "" {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		state := p.state.clone()
+		if err := fn(&state); err != nil {
+			return err
+		}
+		p.state = state
+
+		return nil
+	}
+
+	fakeStateFileMu.Lock()
+	defer fakeStateFileMu.Unlock()
+
+	unlock, err := lockFakeStateFile(ctx, p.cfg.StateFile+".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := p.load()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&state); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p.cfg.StateFile, append(data, '\n'), 0644)
 }
 
-func (p *fakeElasticIPProvider) Test(ctx context.Context) error {
+func lockFakeStateFile(ctx context.Context, path string) (func() error, error) {
+	lock, err := lockfile.New(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(fakeStateLockInterval)
+	defer ticker.Stop()
+
+	for {
+		err := lock.TryLock()
+		if err == nil {
+			return lock.Unlock, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Locking fake state: %w", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// faults returns the faults currently in effect
+func (p *fakeElasticIPProvider) faults() (fakeFaults, error) {
+	state, err := p.load()
+	if err != nil {
+		return fakeFaults{}, err
+	}
+
+	if state.Faults != nil {
+		return *state.Faults, nil
+	}
+
+	return p.cfg.Faults, nil
+}
+
+// call simulates an API call concerning the address and returns the
+// injected error, if any
+func (p *fakeElasticIPProvider) call(ctx context.Context, address netAddress, refresh bool) error {
+	faults, err := p.faults()
+	if err != nil {
+		return err
+	}
+
+	if faults.Latency > 0 {
+		timer := time.NewTimer(time.Duration(faults.Latency))
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	switch {
+	case faults.Outage:
+		return errors.New("Fake API outage")
+
+	case refresh && faults.isPermanent(address):
+		return backoff.Permanent(fmt.Errorf("Fake permanent error for %s", address))
+
+	case faults.ErrorRate > 0 && rand.Float64() < faults.ErrorRate:
+		return errors.New("Fake temporary error")
+	}
+
 	return nil
 }
 
+func (p *fakeElasticIPProvider) Test(ctx context.Context, addresses []netAddress, _ selfTestConfig, report *selfTestReport) {
+	faults, err := p.faults()
+
+	report.Time(func() error { return err })
+
+	switch {
+	case err != nil:
+		report.Add("credentials", checkCritical, "Fake state unavailable: %s", err)
+		return
+
+	case faults.Outage:
+		report.Add("credentials", checkCritical, "Fake API outage")
+		return
+	}
+
+	report.Add("credentials", checkOK, "Fake provider needs no credentials")
+
+	for _, address := range addresses {
+		report.Add(fmt.Sprintf("address %s", address), checkOK, "Fake address exists")
+	}
+}
+
 func (p *fakeElasticIPProvider) NewElasticIPRefresher(ctx context.Context,
 	logger *logrus.Entry, network netAddress) (elasticIPRefresher, error) {
 
@@ -30,11 +382,11 @@ func (p *fakeElasticIPProvider) NewElasticIPRefresher(ctx context.Context,
 	if p.refreshCounter == nil {
 		p.refreshCounter = map[string]int{}
 	}
+
 	ref := &fakeElasticIPRefresher{
-		network:        network,
-		logger:         logger,
-		mu:             &p.mu,
-		refreshCounter: p.refreshCounter,
+		network:  network,
+		logger:   logger,
+		provider: p,
 	}
 
 	return ref, nil
@@ -44,21 +396,199 @@ type fakeElasticIPRefresher struct {
 	network netAddress
 	logger  *logrus.Entry
 
-	mu             *sync.Mutex
-	refreshCounter map[string]int
+	provider *fakeElasticIPProvider
 }
 
 func (r *fakeElasticIPRefresher) Logger() *logrus.Entry {
 	return r.logger
 }
 
-func (r *fakeElasticIPRefresher) Refresh(ctx context.Context) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+func (r *fakeElasticIPRefresher) Refresh(ctx context.Context) (bool, error) {
+	p := r.provider
+	key := r.network.String()
 
-	c := r.refreshCounter[r.network.String()]
-	r.refreshCounter[r.network.String()] = c + 1
+	p.mu.Lock()
+	p.refreshCounter[key]++
+	p.mu.Unlock()
+
+	if err := p.call(ctx, r.network, true); err != nil {
+		return false, err
+	}
+
+	moved := false
+
+	if err := p.update(ctx, func(state *fakeCloudState) error {
+		moved = state.Owners[key] != p.Identity()
+		state.Owners[key] = p.Identity()
+		return nil
+	}); err != nil {
+		return false, err
+	}
 
 	fmt.Printf("REFRESH %s\n", r.network)
+	return moved, nil
+}
+
+func (r *fakeElasticIPRefresher) Owners(ctx context.Context) ([]string, error) {
+	if err := r.provider.call(ctx, r.network, false); err != nil {
+		return nil, err
+	}
+
+	state, err := r.provider.load()
+	if err != nil {
+		return nil, err
+	}
+
+	if owner, ok := state.Owners[r.network.String()]; ok {
+		return []string{owner}, nil
+	}
+
+	return nil, nil
+}
+
+func (r *fakeElasticIPRefresher) Release(ctx context.Context) error {
+	p := r.provider
+	key := r.network.String()
+
+	if err := p.call(ctx, r.network, false); err != nil {
+		return err
+	}
+
+	// Addresses routed to other machines stay there
+	if err := p.update(ctx, func(state *fakeCloudState) error {
+		if state.Owners[key] == p.Identity() {
+			delete(state.Owners, key)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("RELEASE %s\n", r.network)
 	return nil
 }
+
+// fakeControlState is returned by the control endpoint
+type fakeControlState struct {
+	Identity  string            `json:"identity"`
+	Owners    map[string]string `json:"owners"`
+	Faults    fakeFaults        `json:"faults"`
+	Refreshes map[string]int    `json:"refreshes"`
+}
+
+// controlHandler serves the control endpoint:
+//
+//	GET /state   owners, faults in effect and refreshes by this process
+//	PUT /faults  replace the faults, for all processes sharing the state
+//	PUT /owners  replace the owners of all addresses
+func (p *fakeElasticIPProvider) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /state", func(w http.ResponseWriter, r *http.Request) {
+		state, err := p.load()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		faults, err := p.faults()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		result := fakeControlState{
+			Identity:  p.Identity(),
+			Owners:    state.Owners,
+			Faults:    faults,
+			Refreshes: map[string]int{},
+		}
+
+		p.mu.Lock()
+		for address, count := range p.refreshCounter {
+			result.Refreshes[address] = count
+		}
+		p.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	mux.HandleFunc("PUT /faults", func(w http.ResponseWriter, r *http.Request) {
+		faults := fakeFaults{}
+		if err := decodeFakeControlRequest(r, &faults); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := faults.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := p.update(r.Context(), func(state *fakeCloudState) error {
+			state.Faults = &faults
+			return nil
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("PUT /owners", func(w http.ResponseWriter, r *http.Request) {
+		owners := map[string]string{}
+		if err := decodeFakeControlRequest(r, &owners); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		owners, err := normalizeFakeOwners(owners)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := p.update(r.Context(), func(state *fakeCloudState) error {
+			state.Owners = owners
+			return nil
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
+
+func decodeFakeControlRequest(r *http.Request, out interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(out); err != nil {
+		return fmt.Errorf("Parsing request: %w", err)
+	}
+
+	return nil
+}
+
+func (p *fakeElasticIPProvider) serveControl(ctx context.Context, listener net.Listener) {
+	server := &http.Server{
+		Handler:           p.controlHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	logrus.Infof("Fake control endpoint listening on %s", listener.Addr())
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logrus.Errorf("Fake control endpoint failed: %s", err)
+	}
+}
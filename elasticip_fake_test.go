@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// fakeOtherOwners routes the addresses to another machine
+func fakeOtherOwners(addresses []netAddress) map[string]string {
+	result := map[string]string{}
+	for _, address := range addresses {
+		result[address.String()] = "other"
+	}
+	return result
+}
+
+func newFakeTestProvider(t *testing.T, cfg fakeNotifyConfig) *fakeElasticIPProvider {
+	provider, err := cfg.NewProvider(context.Background())
+	require.NoError(t, err)
+	return provider.(*fakeElasticIPProvider)
+}
+
+func newFakeTestRefresher(t *testing.T, provider elasticIPProvider, address netAddress) elasticIPRefresher {
+	r, err := provider.NewElasticIPRefresher(context.Background(), logrus.WithField("test", t.Name()), address)
+	require.NoError(t, err)
+	return r
+}
+
+func TestFakeNotifyConfigYAML(t *testing.T) {
+	cfg := newNotifyConfig()
+	require.NoError(t, yaml.Unmarshal([]byte(`
+provider: fake
+fake:
+  identity: lb1
+  state-file: /tmp/floaty-fake.json
+  control-listen: 127.0.0.1:9180
+  owners:
+    192.0.2.1: lb2
+  faults:
+    latency: 1.5s
+    error-rate: 0.25
+    permanent-errors:
+    - 192.0.2.2
+`), &cfg))
+
+	assert.Equal(t, fakeNotifyConfig{
+		Identity:      "lb1",
+		StateFile:     "/tmp/floaty-fake.json",
+		ControlListen: "127.0.0.1:9180",
+		Owners:        map[string]string{"192.0.2.1": "lb2"},
+		Faults: fakeFaults{
+			Latency:         fakeDuration(1500 * time.Millisecond),
+			ErrorRate:       0.25,
+			PermanentErrors: []netAddress{mustParseNetAddress("192.0.2.2")},
+		},
+	}, cfg.Fake)
+}
+
+func TestFakeNotifyConfigInvalid(t *testing.T) {
+	for _, cfg := range []fakeNotifyConfig{
+		{Faults: fakeFaults{ErrorRate: 1.5}},
+		{Faults: fakeFaults{Latency: fakeDuration(-time.Second)}},
+		{Owners: map[string]string{"nonsense": "lb1"}},
+	} {
+		_, err := cfg.NewProvider(context.Background())
+		assert.Error(t, err)
+	}
+}
+
+func TestFakeProviderFaults(t *testing.T) {
+	address := mustParseNetAddress("192.0.2.1")
+
+	t.Run("latency", func(t *testing.T) {
+		cfg := newFakeNotifyConfig()
+		cfg.Faults.Latency = fakeDuration(time.Hour)
+		r := newFakeTestRefresher(t, newFakeTestProvider(t, cfg), address)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := r.Refresh(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("outage", func(t *testing.T) {
+		cfg := newFakeNotifyConfig()
+		cfg.Faults.Outage = true
+		provider := newFakeTestProvider(t, cfg)
+		r := newFakeTestRefresher(t, provider, address)
+
+		_, err := r.Refresh(context.Background())
+		require.Error(t, err)
+		assert.NotErrorAs(t, err, new(*backoff.PermanentError))
+
+		_, err = r.Owners(context.Background())
+		assert.Error(t, err)
+
+		report := &selfTestReport{}
+		provider.Test(context.Background(), []netAddress{address}, newSelfTestConfig(), report)
+		assert.Equal(t, checkCritical, report.Status())
+	})
+
+	t.Run("error-rate", func(t *testing.T) {
+		cfg := newFakeNotifyConfig()
+		cfg.Faults.ErrorRate = 1
+		r := newFakeTestRefresher(t, newFakeTestProvider(t, cfg), address)
+
+		_, err := r.Refresh(context.Background())
+		require.Error(t, err)
+		assert.NotErrorAs(t, err, new(*backoff.PermanentError))
+	})
+
+	t.Run("permanent-errors", func(t *testing.T) {
+		cfg := newFakeNotifyConfig()
+		cfg.Faults.PermanentErrors = []netAddress{address}
+		provider := newFakeTestProvider(t, cfg)
+
+		_, err := newFakeTestRefresher(t, provider, address).Refresh(context.Background())
+		assert.ErrorAs(t, err, new(*backoff.PermanentError))
+
+		_, err = newFakeTestRefresher(t, provider, mustParseNetAddress("192.0.2.2")).Refresh(context.Background())
+		assert.NoError(t, err)
+	})
+}
+
+func TestFakeProviderSharedState(t *testing.T) {
+	ctx := context.Background()
+	address := mustParseNetAddress("192.0.2.1")
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	newProvider := func(identity string) *fakeElasticIPProvider {
+		cfg := newFakeNotifyConfig()
+		cfg.Identity = identity
+		cfg.StateFile = path
+		cfg.Owners = map[string]string{"192.0.2.1/32": "initial"}
+		return newFakeTestProvider(t, cfg)
+	}
+
+	lb1 := newFakeTestRefresher(t, newProvider("lb1"), address)
+	lb2 := newFakeTestRefresher(t, newProvider("lb2"), address)
+
+	owners, err := lb2.Owners(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"initial"}, owners)
+
+	moved, err := lb1.Refresh(ctx)
+	require.NoError(t, err)
+	assert.True(t, moved)
+
+	owners, err = lb2.Owners(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lb1"}, owners)
+
+	moved, err = lb2.Refresh(ctx)
+	require.NoError(t, err)
+	assert.True(t, moved)
+
+	// Releasing doesn't take the address away from the other machine
+	require.NoError(t, lb1.Release(ctx))
+	owners, err = lb1.Owners(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lb2"}, owners)
+
+	require.NoError(t, lb2.Release(ctx))
+	owners, err = lb1.Owners(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, owners)
+}
+
+func TestFakeControlEndpoint(t *testing.T) {
+	ctx := context.Background()
+	address := mustParseNetAddress("192.0.2.1")
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	cfg := newFakeNotifyConfig()
+	cfg.Identity = "lb1"
+	cfg.StateFile = path
+	provider := newFakeTestProvider(t, cfg)
+	r := newFakeTestRefresher(t, provider, address)
+
+	cfg.Identity = "lb2"
+	other := newFakeTestRefresher(t, newFakeTestProvider(t, cfg), address)
+
+	server := httptest.NewServer(provider.controlHandler())
+	defer server.Close()
+
+	put := func(path, body string) int {
+		req, err := http.NewRequest(http.MethodPut, server.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	mustRefresh(t, ctx, r)
+
+	// Faults apply to all processes sharing the state
+	assert.Equal(t, http.StatusNoContent, put("/faults", `{"outage": true}`))
+	_, err := other.Refresh(ctx)
+	assert.ErrorContains(t, err, "Fake API outage")
+
+	assert.Equal(t, http.StatusNoContent, put("/faults", `{}`))
+	mustRefresh(t, ctx, other)
+
+	// Another machine takes over, e.g. in a split brain
+	assert.Equal(t, http.StatusNoContent, put("/owners", `{"192.0.2.1": "lb3"}`))
+	owners, err := r.Owners(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lb3"}, owners)
+
+	assert.Equal(t, http.StatusBadRequest, put("/faults", `{"error-rate": 2}`))
+	assert.Equal(t, http.StatusBadRequest, put("/faults", `{"unknown": true}`))
+	assert.Equal(t, http.StatusBadRequest, put("/owners", `{"nonsense": "lb3"}`))
+
+	resp, err := http.Get(server.URL + "/state")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	state := fakeControlState{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&state))
+	assert.Equal(t, fakeControlState{
+		Identity:  "lb1",
+		Owners:    map[string]string{"192.0.2.1/32": "lb3"},
+		Refreshes: map[string]int{"192.0.2.1/32": 1},
+	}, state)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	egoscale "github.com/exoscale/egoscale/v3"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Timeout of refreshes expected to time out
+const goldenRefreshTimeout = 100 * time.Millisecond
+
+func newGoldenCloudscaleRefresher(t *testing.T, name string, faults ...httpFault) elasticIPRefresher {
+	api := newFakeCloudscaleAPI()
+	api.addFloatingIP("192.0.2.1/32", "", fakeCloudscaleOtherUUID)
+
+	transport, endpoint := newGoldenTransport(t, "cloudscale-"+name, injectFaults(api, faults...))
+	endpointURL := mustParseTextURL(endpoint + "/")
+
+	cfg := cloudscaleNotifyConfig{
+		Endpoint:   &endpointURL,
+		Token:      "token",
+		ServerUUID: uuid.Must(uuid.FromString(fakeCloudscaleServerUUID)),
+	}
+
+	provider, err := cfg.NewProvider(context.Background(), identityConfig{}, rateLimitConfig{}, httpConfig{transport: transport})
+	require.NoError(t, err)
+
+	r, err := provider.NewElasticIPRefresher(context.Background(), logrus.WithField("test", t.Name()), mustParseNetAddress("192.0.2.1"))
+	require.NoError(t, err)
+
+	return r
+}
+
+func TestCloudscaleGolden(t *testing.T) {
+	const patchPath = "/v1/floating-ips/192.0.2.1"
+
+	t.Run("refresh", func(t *testing.T) {
+		r := newGoldenCloudscaleRefresher(t, "refresh")
+
+		moved, err := r.Refresh(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, moved)
+	})
+
+	t.Run("client-error", func(t *testing.T) {
+		r := newGoldenCloudscaleRefresher(t, "client-error", httpFault{
+			Method: http.MethodPatch,
+			Path:   patchPath,
+			Status: http.StatusForbidden,
+			Body:   `{"detail": "You do not have permission to perform this action."}`,
+		})
+
+		_, err := r.Refresh(context.Background())
+		require.Error(t, err)
+		assert.IsType(t, &backoff.PermanentError{}, err)
+		assert.ErrorContains(t, err, "You do not have permission")
+	})
+
+	t.Run("server-error", func(t *testing.T) {
+		r := newGoldenCloudscaleRefresher(t, "server-error", httpFault{
+			Method: http.MethodPatch,
+			Path:   patchPath,
+			Times:  1,
+			Status: http.StatusBadGateway,
+			Body:   `{"detail": "Bad gateway."}`,
+		})
+
+		// Retried by the refresh loop
+		_, err := r.Refresh(context.Background())
+		require.Error(t, err)
+		_, permanent := err.(*backoff.PermanentError)
+		assert.False(t, permanent)
+
+		moved, err := r.Refresh(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, moved)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		r := newGoldenCloudscaleRefresher(t, "timeout", httpFault{
+			Method: http.MethodPatch,
+			Path:   patchPath,
+			Stall:  true,
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), goldenRefreshTimeout)
+		defer cancel()
+
+		_, err := r.Refresh(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		_, permanent := err.(*backoff.PermanentError)
+		assert.False(t, permanent)
+	})
+}
+
+func newGoldenExoscaleRefresher(t *testing.T, name string, faults ...httpFault) elasticIPRefresher {
+	api := newFakeExoscaleAPI(2)
+	api.addElasticIP(fakeExoscaleUUID(1001), "192.0.2.1")
+	api.attach(fakeExoscaleUUID(2), fakeExoscaleUUID(1001))
+
+	transport, endpoint := newGoldenTransport(t, "exoscale-"+name, injectFaults(api, faults...))
+	endpointURL := mustParseTextURL(endpoint)
+
+	cfg := exoscaleNotifyConfig{
+		Endpoint:   &endpointURL,
+		Zone:       "ch-gva-2",
+		Key:        "EXOtest",
+		Secret:     "secret",
+		InstanceID: fakeExoscaleUUID(1).String(),
+	}
+
+	provider, err := cfg.NewProvider(context.Background(), identityConfig{}, rateLimitConfig{}, httpConfig{transport: transport})
+	require.NoError(t, err)
+
+	r, err := provider.NewElasticIPRefresher(context.Background(), logrus.WithField("test", t.Name()), mustParseNetAddress("192.0.2.1"))
+	require.NoError(t, err)
+
+	return r
+}
+
+func TestExoscaleGolden(t *testing.T) {
+	attachPath := "/elastic-ip/" + fakeExoscaleUUID(1001).String() + ":attach"
+
+	t.Run("attach-detach", func(t *testing.T) {
+		// Attaches to this instance, waits for the operation, then detaches
+		// from the other holder
+		r := newGoldenExoscaleRefresher(t, "attach-detach")
+
+		moved, err := r.Refresh(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, moved)
+
+		owners, err := r.Owners(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{fakeExoscaleUUID(1).String()}, owners)
+	})
+
+	t.Run("client-error", func(t *testing.T) {
+		r := newGoldenExoscaleRefresher(t, "client-error", httpFault{
+			Method: http.MethodPut,
+			Path:   attachPath,
+			Status: http.StatusForbidden,
+			Body:   `{"message": "Forbidden"}`,
+		})
+
+		_, err := r.Refresh(context.Background())
+		assert.ErrorIs(t, err, egoscale.ErrForbidden)
+	})
+
+	t.Run("server-error", func(t *testing.T) {
+		r := newGoldenExoscaleRefresher(t, "server-error", httpFault{
+			Method: http.MethodPut,
+			Path:   attachPath,
+			Times:  1,
+			Status: http.StatusInternalServerError,
+			Body:   `{"message": "Internal error"}`,
+		})
+
+		_, err := r.Refresh(context.Background())
+		assert.ErrorIs(t, err, egoscale.ErrInternalServerError)
+
+		moved, err := r.Refresh(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, moved)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		r := newGoldenExoscaleRefresher(t, "timeout", httpFault{
+			Method: http.MethodPut,
+			Path:   attachPath,
+			Stall:  true,
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), goldenRefreshTimeout)
+		defer cancel()
+
+		_, err := r.Refresh(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
@@ -2,57 +2,362 @@ package main
 
 import (
 	"context"
+	"errors"
 	"sync"
-	"time"
 
+	"github.com/cenkalti/backoff/v4"
 	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
 )
 
 type elasticIPProvider interface {
-	Test(context.Context) error
+	// Identity returns the provider-specific ID of the machine running floaty
+	Identity() string
+	// Test verifies configuration and API access and adds the results to
+	// the report
+	Test(context.Context, []netAddress, selfTestConfig, *selfTestReport)
 	NewElasticIPRefresher(context.Context, *logrus.Entry, netAddress) (elasticIPRefresher, error)
 }
 
 type elasticIPRefresher interface {
 	Logger() *logrus.Entry
-	Refresh(context.Context) error
+	// Refresh routes the address to this machine and reports whether it
+	// was moved, i.e. wasn't routed only to this machine before. Refreshers
+	// unable to tell report every successful update as a move.
+	Refresh(context.Context) (bool, error)
+	// Owners returns the IDs of all machines the address is currently
+	// routed to
+	Owners(context.Context) ([]string, error)
+	// Release routes the address away from this machine
+	Release(context.Context) error
 }
 
-func pinElasticIPs(ctx context.Context, provider elasticIPProvider, addresses []netAddress, cfg notifyConfig) error {
-	refreshers := []elasticIPRefresher{}
+// elasticIPBatchProvider is implemented by providers able to refresh all
+// addresses of a VRRP instance at once, sharing lookups between them
+type elasticIPBatchProvider interface {
+	elasticIPProvider
+	NewElasticIPBatchRefresher(context.Context, *logrus.Entry, []netAddress) (elasticIPBatchRefresher, error)
+}
+
+type elasticIPBatchRefresher interface {
+	Logger() *logrus.Entry
+	Addresses() []netAddress
+	// RefreshAll refreshes the given addresses, a subset of Addresses, and
+	// returns one result per address in the same order
+	RefreshAll(context.Context, []netAddress) []refreshResult
+}
+
+// refreshResult is the outcome of refreshing a single address
+type refreshResult struct {
+	// Moved as reported by elasticIPRefresher.Refresh
+	Moved bool
+	Err   error
+}
+
+// refreshConcurrently calls the function for all indices up to n in parallel
+// and returns the results in order
+func refreshConcurrently(n int, fn func(int) (bool, error)) []refreshResult {
+	results := make([]refreshResult, n)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i].Moved, results[i].Err = fn(i)
+		}(i)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// pinElasticIPs keeps routing the addresses of the given VRRP instance to
+// this machine until the context is cancelled or a failure policy gives up
+func pinElasticIPs(ctx context.Context, provider elasticIPProvider, instance string, addresses []netAddress, cfg notifyConfig) error {
+	health := newRefreshHealth(cfg.TrackFile, instance)
+
+	err := runPinning(ctx, provider, instance, addresses, cfg, health)
+	if err != nil {
+		health.SetUnhealthy(err)
+	}
+
+	return err
+}
+
+func runPinning(ctx context.Context, provider elasticIPProvider, instance string, addresses []netAddress, cfg notifyConfig, health *refreshHealth) error {
+	// Multiple Keepalived addresses may refer to the same network
+	addresses = uniqueAddresses(addresses)
+
+	// Failure policies may stop all refreshes
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+
+	policies, err := newFailurePolicies(cfg, instance, addresses, health, stop)
+	if err != nil {
+		return err
+	}
+
+	pause := newPauseWatcher(ctx, cfg.PauseFile)
+
+	announcer, err := newNeighborAnnouncer(cfg, addresses)
+	if err != nil {
+		return err
+	}
+
+	// Results of all refreshes, including those pinning addresses again,
+	// are subject to the track file and failure policies
+	record := func(addresses []netAddress, results []refreshResult) {
+		health.Record(addresses, results)
+		policies.Record(addresses, results)
+	}
+
+	// Refreshers used for pinning individual addresses again, created on
+	// demand when refreshing in batches
+	var mu sync.Mutex
+	refreshers := map[string]elasticIPRefresher{}
+
+	repin := func(ctx context.Context, address netAddress) error {
+		if pause.Paused() {
+			return errors.New("Paused")
+		}
+
+		if !policies.Allow(address) {
+			return errors.New("Refreshes suspended by failure policy")
+		}
+
+		ctxRefresh, cancel := context.WithTimeout(ctx, cfg.refreshSchedule(address).Timeout)
+		defer cancel()
+
+		refresher, err := func() (elasticIPRefresher, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if refresher, ok := refreshers[address.String()]; ok {
+				return refresher, nil
+			}
+
+			refresher, err := provider.NewElasticIPRefresher(ctxRefresh, logrus.WithField("address", address), address)
+			if err != nil {
+				return nil, err
+			}
+			refreshers[address.String()] = refresher
+
+			return refresher, nil
+		}()
+
+		moved := false
+		if err == nil {
+			moved, err = refresher.Refresh(ctxRefresh)
+		}
+
+		record([]netAddress{address}, []refreshResult{{Moved: moved, Err: err}})
+
+		if moved && err == nil {
+			go announcer.Announce(ctx, []netAddress{address})
+		}
+
+		return err
+	}
+
+	verifier, err := newAddressVerifier(cfg, addresses, newStatusRecorder(cfg.Status, instance), repin)
+	if err != nil {
+		return err
+	}
+
+	loop := refreshLoop{
+		pause: pause,
+		allow: policies.Allow,
+		onRefreshed: func(addresses []netAddress, results []refreshResult) {
+			record(addresses, results)
+
+			moved := []netAddress{}
+			for i, address := range addresses {
+				if results[i].Moved && results[i].Err == nil {
+					moved = append(moved, address)
+				}
+			}
+			if len(moved) == 0 {
+				return
+			}
+
+			// Announcements and verifications must not delay further
+			// refreshes
+			go announcer.Announce(ctx, moved)
+
+			for _, address := range moved {
+				go verifier.Verify(ctx, address)
+			}
+		},
+	}
+
+	if batchProvider, ok := provider.(elasticIPBatchProvider); ok {
+		// Addresses with the same schedule are refreshed together
+		schedules := []refreshSchedule{}
+		groups := map[refreshSchedule][]netAddress{}
+		for _, address := range addresses {
+			schedule := cfg.refreshSchedule(address)
+			if _, ok := groups[schedule]; !ok {
+				schedules = append(schedules, schedule)
+			}
+			groups[schedule] = append(groups[schedule], address)
+		}
+
+		batchRefreshers := []elasticIPBatchRefresher{}
+		for _, schedule := range schedules {
+			logger := logrus.WithField("addresses", groups[schedule])
+			refresher, err := batchProvider.NewElasticIPBatchRefresher(ctx, logger, groups[schedule])
+			if err != nil {
+				return err
+			}
+			batchRefreshers = append(batchRefreshers, refresher)
+		}
+
+		wg := sync.WaitGroup{}
+		for i, schedule := range schedules {
+			wg.Add(1)
+			go func(schedule refreshSchedule, refresher elasticIPBatchRefresher) {
+				defer wg.Done()
+				loop.runBatchRefresher(ctx, schedule, refresher)
+			}(schedule, batchRefreshers[i])
+		}
+		wg.Wait()
+		return failurePolicyCause(ctx)
+	}
+
+	// All addresses are validated before starting to refresh any of them
+	var errs error
+	mu.Lock()
 	for _, address := range addresses {
 		logger := logrus.WithField("address", address)
 		refresher, err := provider.NewElasticIPRefresher(ctx, logger, address)
 		if err != nil {
-			return err
+			errs = multierr.Append(errs, err)
+			continue
 		}
-		refreshers = append(refreshers, refresher)
+		refreshers[address.String()] = refresher
+	}
+	mu.Unlock()
+	if errs != nil {
+		return errs
 	}
 
 	wg := sync.WaitGroup{}
-	for _, i := range refreshers {
+	for _, address := range addresses {
 		wg.Add(1)
-		go func(refresher elasticIPRefresher) {
+		go func(address netAddress, refresher elasticIPRefresher) {
 			defer wg.Done()
-			runRefresher(ctx, cfg.RefreshInterval, cfg.RefreshTimeout, cfg.BackOff, refresher)
-		}(i)
+			loop.runRefresher(ctx, cfg.refreshSchedule(address), address, refresher)
+		}(address, refreshers[address.String()])
 	}
 	wg.Wait()
+	return failurePolicyCause(ctx)
+}
+
+// failurePolicyCause returns the error if refreshing was stopped by a
+// failure policy
+func failurePolicyCause(ctx context.Context) error {
+	var exitErr *failurePolicyExitError
+	if err := context.Cause(ctx); errors.As(err, &exitErr) {
+		return exitErr
+	}
+
 	return nil
 }
 
-func runRefresher(ctx context.Context, interval time.Duration, timeout time.Duration, backOff backOffConfig, r elasticIPRefresher) {
+// refreshLoop contains the settings shared by all refreshers of a VRRP
+// instance
+type refreshLoop struct {
+	pause *pauseWatcher
+
+	// Reports whether the address may be refreshed now
+	allow func(netAddress) bool
+
+	// Called with the results of each refresh
+	onRefreshed func([]netAddress, []refreshResult)
+}
+
+// runRefresher refreshes the address until the context is cancelled
+func (l refreshLoop) runRefresher(ctx context.Context, schedule refreshSchedule, address netAddress, r elasticIPRefresher) {
+	logger := r.Logger()
+	logger.Infof("Refreshing %q every %s on average", r, schedule.Interval)
+
+	err := loopWithRetries(ctx, logger, schedule.Interval, schedule.BackOff.New(), l.pause.Resumed,
+		func(ctx context.Context) error {
+			if l.pause.Paused() {
+				logger.Info("Paused, skipping refresh")
+				return nil
+			}
+
+			if !l.allow(address) {
+				return nil
+			}
+
+			ctxRefresh, cancel := context.WithTimeout(ctx, schedule.Timeout)
+
+			defer cancel()
+
+			moved, err := r.Refresh(ctxRefresh)
+			l.onRefreshed([]netAddress{address}, []refreshResult{{Moved: moved, Err: err}})
+
+			return err
+		})
+
+	logger.Debugf("Shutdown (%s)", err)
+}
 
+// runBatchRefresher refreshes the addresses until the context is cancelled
+func (l refreshLoop) runBatchRefresher(ctx context.Context, schedule refreshSchedule, r elasticIPBatchRefresher) {
 	logger := r.Logger()
-	logger.Infof("Refreshing %q every %s on average", r, interval)
+	logger.Infof("Refreshing %d addresses every %s on average", len(r.Addresses()), schedule.Interval)
 
-	err := loopWithRetries(ctx, logger, interval, backOff.New(),
+	err := loopWithRetries(ctx, logger, schedule.Interval, schedule.BackOff.New(), l.pause.Resumed,
 		func(ctx context.Context) error {
-			ctxRefresh, cancel := context.WithTimeout(ctx, timeout)
+			if l.pause.Paused() {
+				logger.Info("Paused, skipping refresh")
+				return nil
+			}
+
+			addresses := []netAddress{}
+			for _, address := range r.Addresses() {
+				if l.allow(address) {
+					addresses = append(addresses, address)
+				}
+			}
+			if len(addresses) == 0 {
+				return nil
+			}
+
+			ctxRefresh, cancel := context.WithTimeout(ctx, schedule.Timeout)
 
 			defer cancel()
 
-			return r.Refresh(ctxRefresh)
+			results := r.RefreshAll(ctxRefresh, addresses)
+
+			l.onRefreshed(addresses, results)
+
+			var errs error
+			permanent := true
+			for i, address := range addresses {
+				err := results[i].Err
+				if err == nil {
+					continue
+				}
+
+				logger.WithField("address", address).Errorf("Refresh failed: %s", err)
+
+				if _, ok := err.(*backoff.PermanentError); !ok {
+					permanent = false
+				}
+				errs = multierr.Append(errs, err)
+			}
+
+			if errs != nil && permanent {
+				// Retrying is pointless if no address can succeed
+				return backoff.Permanent(errs)
+			}
+
+			return errs
 		})
 
 	logger.Debugf("Shutdown (%s)", err)
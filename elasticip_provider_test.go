@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mustRefresh refreshes the address and returns whether it was moved
+func mustRefresh(t *testing.T, ctx context.Context, r elasticIPRefresher) bool {
+	t.Helper()
+
+	moved, err := r.Refresh(ctx)
+	require.NoError(t, err)
+
+	return moved
+}
+
+func TestRefreshConcurrently(t *testing.T) {
+	results := refreshConcurrently(3, func(i int) (bool, error) {
+		if i == 1 {
+			return false, context.Canceled
+		}
+		return i == 2, nil
+	})
+
+	require.Equal(t, []refreshResult{
+		{},
+		{Err: context.Canceled},
+		{Moved: true},
+	}, results)
+}
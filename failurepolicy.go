@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+const (
+	// Keep retrying with back-off
+	failureActionRetry = "retry"
+	// Stop refreshing for a while, then try once before resuming
+	failureActionCircuitBreaker = "circuit-breaker"
+	// Stop refreshing the VRRP instance and exit with an error
+	failureActionExit = "exit"
+	// Report the VRRP instance as unhealthy in the track file
+	failureActionUnhealthy = "unhealthy"
+	// Run a command
+	failureActionNotify = "notify"
+
+	defaultFailurePolicyThreshold    = 5
+	defaultFailurePolicyOpenDuration = 5 * time.Minute
+	defaultFailurePolicyTimeout      = 30 * time.Second
+)
+
+// failurePolicyConfig determines what happens when refreshing an address
+// keeps failing
+type failurePolicyConfig struct {
+	Action string `yaml:"action"`
+
+	// Number of consecutive failed refreshes before the action is taken.
+	// Permanent errors count immediately.
+	Threshold int `yaml:"threshold"`
+
+	// How long an open circuit breaker skips refreshes
+	OpenDuration time.Duration `yaml:"open-duration"`
+
+	// Command for the notify action and how long it may run
+	Command []string      `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func newFailurePolicyConfig() failurePolicyConfig {
+	return failurePolicyConfig{
+		Action:       failureActionRetry,
+		Threshold:    defaultFailurePolicyThreshold,
+		OpenDuration: defaultFailurePolicyOpenDuration,
+		Timeout:      defaultFailurePolicyTimeout,
+	}
+}
+
+// validate checks the action and its settings
+func (c failurePolicyConfig) validate() error {
+	switch c.Action {
+	case "", failureActionRetry, failureActionCircuitBreaker, failureActionExit, failureActionUnhealthy:
+	case failureActionNotify:
+		if len(c.Command) == 0 {
+			return fmt.Errorf("Failure action %q requires a command", c.Action)
+		}
+	default:
+		return fmt.Errorf("Failure action %q not supported", c.Action)
+	}
+
+	return nil
+}
+
+// failurePolicy returns the policy for the given address. Unset values of
+// the override in the managed-addresses entry are taken from the global
+// policy.
+func (c notifyConfig) failurePolicy(address netAddress) (failurePolicyConfig, error) {
+	result := c.FailurePolicy
+
+	if entry, ok := c.findManagedAddress(address); ok && entry.FailurePolicy != nil {
+		override := entry.FailurePolicy
+
+		if override.Action != "" {
+			result.Action = override.Action
+		}
+		if override.Threshold != 0 {
+			result.Threshold = override.Threshold
+		}
+		if override.OpenDuration != 0 {
+			result.OpenDuration = override.OpenDuration
+		}
+		if len(override.Command) > 0 {
+			result.Command = override.Command
+		}
+		if override.Timeout != 0 {
+			result.Timeout = override.Timeout
+		}
+	}
+
+	if result.Action == "" {
+		result.Action = failureActionRetry
+	}
+
+	if err := result.validate(); err != nil {
+		return result, fmt.Errorf("Failure policy of %s: %w", address, err)
+	}
+
+	return result, nil
+}
+
+// validateFailurePolicies checks the global policy and the policies of all
+// managed addresses
+func (c notifyConfig) validateFailurePolicies() error {
+	if err := c.FailurePolicy.validate(); err != nil {
+		return fmt.Errorf("Failure policy: %w", err)
+	}
+
+	var errs error
+
+	for _, entry := range c.ManagedAddresses {
+		if _, err := c.failurePolicy(entry.Address); err != nil {
+			errs = multierr.Append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// failurePolicyExitError stops refreshing when the exit action is taken
+type failurePolicyExitError struct {
+	Address netAddress
+	Err     error
+}
+
+func (e *failurePolicyExitError) Error() string {
+	return fmt.Sprintf("Giving up on %s: %s", e.Address, e.Err)
+}
+
+func (e *failurePolicyExitError) Unwrap() error {
+	return e.Err
+}
+
+// addressFailures is the state of the failure policy of an address
+type addressFailures struct {
+	policy failurePolicyConfig
+	logger *logrus.Entry
+
+	failures  int
+	escalated bool
+
+	// Circuit breaker is open until the given time, then allows a single
+	// refresh
+	open      bool
+	openUntil time.Time
+}
+
+// failurePolicies applies the failure policies of the addresses of a VRRP
+// instance
+type failurePolicies struct {
+	instance string
+	health   *refreshHealth
+	exit     func(error)
+
+	now func() time.Time
+
+	mu        sync.Mutex
+	addresses map[string]*addressFailures
+}
+
+func newFailurePolicies(cfg notifyConfig, instance string, addresses []netAddress, health *refreshHealth, exit func(error)) (*failurePolicies, error) {
+	p := &failurePolicies{
+		instance:  instance,
+		health:    health,
+		exit:      exit,
+		now:       time.Now,
+		addresses: map[string]*addressFailures{},
+	}
+
+	for _, address := range addresses {
+		policy, err := cfg.failurePolicy(address)
+		if err != nil {
+			return nil, err
+		}
+
+		p.addresses[address.String()] = &addressFailures{
+			policy: policy,
+			logger: logrus.WithFields(logrus.Fields{
+				"address": address,
+				"policy":  policy.Action,
+			}),
+		}
+	}
+
+	return p, nil
+}
+
+// Allow reports whether the address may be refreshed now
+func (p *failurePolicies) Allow(address netAddress) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state, ok := p.addresses[address.String()]
+	if !ok || !state.open {
+		return true
+	}
+
+	if p.now().Before(state.openUntil) {
+		state.logger.Debug("Circuit breaker open, skipping refresh")
+		return false
+	}
+
+	state.logger.Info("Circuit breaker half-open, trying to refresh")
+
+	return true
+}
+
+// Record applies the policies to the results of refreshing the addresses
+func (p *failurePolicies) Record(addresses []netAddress, results []refreshResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, address := range addresses {
+		state, ok := p.addresses[address.String()]
+		if !ok {
+			continue
+		}
+
+		err := results[i].Err
+
+		if err == nil {
+			if state.escalated {
+				state.logger.Info("Refresh succeeded again")
+			}
+
+			state.failures = 0
+			state.escalated = false
+			state.open = false
+			continue
+		}
+
+		state.failures++
+
+		if _, ok := err.(*backoff.PermanentError); ok && state.failures < state.policy.Threshold {
+			state.failures = state.policy.Threshold
+		}
+
+		if state.open {
+			// The half-open refresh failed
+			state.openUntil = p.now().Add(state.policy.OpenDuration)
+			state.logger.Warningf("Refresh failed, circuit breaker open for %s: %s", state.policy.OpenDuration, err)
+			continue
+		}
+
+		if state.escalated || state.failures < state.policy.Threshold {
+			continue
+		}
+
+		state.escalated = true
+
+		p.escalate(address, state, err)
+	}
+}
+
+// escalate must be called with the lock held
+func (p *failurePolicies) escalate(address netAddress, state *addressFailures, err error) {
+	logger := state.logger.WithField("failures", state.failures)
+
+	switch state.policy.Action {
+	case failureActionRetry:
+		logger.Errorf("Refresh keeps failing, retrying: %s", err)
+
+	case failureActionCircuitBreaker:
+		state.open = true
+		state.openUntil = p.now().Add(state.policy.OpenDuration)
+		logger.Errorf("Refresh keeps failing, circuit breaker open for %s: %s", state.policy.OpenDuration, err)
+
+	case failureActionExit:
+		logger.Errorf("Refresh keeps failing, exiting: %s", err)
+		p.exit(&failurePolicyExitError{Address: address, Err: err})
+
+	case failureActionUnhealthy:
+		logger.Errorf("Refresh keeps failing, reporting as unhealthy: %s", err)
+		p.health.Escalate(address, err)
+
+	case failureActionNotify:
+		logger.Errorf("Refresh keeps failing, running %q: %s", state.policy.Command[0], err)
+		go runFailureCommand(logger, state.policy, p.instance, address, state.failures, err)
+	}
+}
+
+// runFailureCommand runs the command of the notify action with details in
+// environment variables
+func runFailureCommand(logger *logrus.Entry, policy failurePolicyConfig, instance string, address netAddress, failures int, failure error) {
+	ctx, cancel := context.WithTimeout(context.Background(), policy.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, policy.Command[0], policy.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"FLOATY_INSTANCE="+instance,
+		"FLOATY_ADDRESS="+address.String(),
+		fmt.Sprintf("FLOATY_FAILURES=%d", failures),
+		"FLOATY_ERROR="+failure.Error(),
+	)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		logger.Errorf("Running %q failed: %s: %s", policy.Command[0], err, output)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailurePolicyForAddress(t *testing.T) {
+	cfg := newNotifyConfig()
+	cfg.ManagedAddresses = []managedAddress{
+		{
+			Address:       mustParseNetAddress("192.0.2.10"),
+			FailurePolicy: &failurePolicyConfig{Action: failureActionCircuitBreaker, Threshold: 2},
+		},
+		{
+			Address:       mustParseNetAddress("192.0.2.0/24"),
+			FailurePolicy: &failurePolicyConfig{Action: failureActionNotify},
+		},
+		{Address: mustParseNetAddress("192.0.2.11")},
+	}
+
+	policy, err := cfg.failurePolicy(mustParseNetAddress("192.0.2.10"))
+	require.NoError(t, err)
+	assert.Equal(t, failurePolicyConfig{
+		Action:       failureActionCircuitBreaker,
+		Threshold:    2,
+		OpenDuration: defaultFailurePolicyOpenDuration,
+		Timeout:      defaultFailurePolicyTimeout,
+	}, policy)
+
+	for _, address := range []string{"192.0.2.11", "198.51.100.1"} {
+		policy, err = cfg.failurePolicy(mustParseNetAddress(address))
+		require.NoError(t, err)
+		assert.Equal(t, cfg.FailurePolicy, policy)
+	}
+
+	_, err = cfg.failurePolicy(mustParseNetAddress("192.0.2.0/24"))
+	assert.EqualError(t, err, `Failure policy of 192.0.2.0/24: Failure action "notify" requires a command`)
+
+	assert.EqualError(t, cfg.validateFailurePolicies(),
+		`Failure policy of 192.0.2.0/24: Failure action "notify" requires a command`)
+
+	cfg.FailurePolicy.Action = "panic"
+	_, err = cfg.failurePolicy(mustParseNetAddress("198.51.100.1"))
+	assert.EqualError(t, err, `Failure policy of 198.51.100.1/32: Failure action "panic" not supported`)
+
+	assert.EqualError(t, cfg.validateFailurePolicies(), `Failure policy: Failure action "panic" not supported`)
+}
+
+func TestFailurePolicyCircuitBreaker(t *testing.T) {
+	cfg := newNotifyConfig()
+	cfg.FailurePolicy.Action = failureActionCircuitBreaker
+	cfg.FailurePolicy.Threshold = 2
+	cfg.FailurePolicy.OpenDuration = time.Minute
+
+	address := mustParseNetAddress("192.0.2.10")
+	addresses := []netAddress{address}
+	failed := []refreshResult{{Err: errors.New("timeout")}}
+
+	p, err := newFailurePolicies(cfg, "test", addresses, nil, nil)
+	require.NoError(t, err)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	p.Record(addresses, failed)
+	assert.True(t, p.Allow(address))
+
+	p.Record(addresses, failed)
+	assert.False(t, p.Allow(address), "open")
+
+	now = now.Add(time.Minute)
+	assert.True(t, p.Allow(address), "half-open")
+
+	p.Record(addresses, failed)
+	assert.False(t, p.Allow(address), "open again")
+
+	now = now.Add(time.Minute)
+	assert.True(t, p.Allow(address), "half-open")
+
+	p.Record(addresses, []refreshResult{{Moved: true}})
+	assert.True(t, p.Allow(address), "closed")
+
+	// Permanent errors open the circuit immediately
+	p.Record(addresses, []refreshResult{{Err: backoff.Permanent(errors.New("HTTP 404"))}})
+	assert.False(t, p.Allow(address))
+
+	// Addresses without policy are always allowed
+	assert.True(t, p.Allow(mustParseNetAddress("192.0.2.11")))
+}
+
+func TestFailurePolicyUnhealthy(t *testing.T) {
+	trackCfg := newTrackFileConfig()
+	trackCfg.FileTemplate = filepath.Join(t.TempDir(), "track.%s")
+	trackCfg.Failures = 10
+
+	cfg := newNotifyConfig()
+	cfg.FailurePolicy.Action = failureActionUnhealthy
+	cfg.FailurePolicy.Threshold = 1
+
+	address := mustParseNetAddress("192.0.2.10")
+	addresses := []netAddress{address}
+	health := newRefreshHealth(trackCfg, "test")
+
+	p, err := newFailurePolicies(cfg, "test", addresses, health, nil)
+	require.NoError(t, err)
+
+	record := func(results []refreshResult) string {
+		health.Record(addresses, results)
+		p.Record(addresses, results)
+
+		data, err := os.ReadFile(trackCfg.makeTrackFilePath("test"))
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	assert.Equal(t, "1\n", record([]refreshResult{{Err: errors.New("timeout")}}))
+	assert.Equal(t, "0\n", record([]refreshResult{{}}))
+}
+
+func TestFailurePolicyNotify(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+
+	cfg := newNotifyConfig()
+	cfg.FailurePolicy.Action = failureActionNotify
+	cfg.FailurePolicy.Threshold = 1
+	cfg.FailurePolicy.Command = []string{"/bin/sh", "-c", `echo "$FLOATY_INSTANCE $FLOATY_ADDRESS $FLOATY_FAILURES $FLOATY_ERROR" > "$0"`, out}
+
+	address := mustParseNetAddress("192.0.2.10")
+	addresses := []netAddress{address}
+
+	p, err := newFailurePolicies(cfg, "vi_1", addresses, nil, nil)
+	require.NoError(t, err)
+
+	p.Record(addresses, []refreshResult{{Err: errors.New("timeout")}})
+
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(out)
+		return err == nil && string(data) == "vi_1 192.0.2.10/32 1 timeout\n"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// failingElasticIPProvider refreshes nothing successfully
+type failingElasticIPProvider struct {
+	fakeElasticIPProvider
+}
+
+type failingElasticIPRefresher struct {
+	elasticIPRefresher
+}
+
+func (p *failingElasticIPProvider) NewElasticIPRefresher(ctx context.Context,
+	logger *logrus.Entry, network netAddress) (elasticIPRefresher, error) {
+	r, err := p.fakeElasticIPProvider.NewElasticIPRefresher(ctx, logger, network)
+	return failingElasticIPRefresher{r}, err
+}
+
+func (r failingElasticIPRefresher) Refresh(ctx context.Context) (bool, error) {
+	return false, errors.New("API unavailable")
+}
+
+func TestFailurePolicyExit(t *testing.T) {
+	cfg := newNotifyConfig()
+	cfg.BackOff.InitialInterval = time.Millisecond
+	cfg.BackOff.MaxInterval = time.Millisecond
+	cfg.ManagedAddresses = []managedAddress{{
+		Address:       mustParseNetAddress("192.0.2.10"),
+		FailurePolicy: &failurePolicyConfig{Action: failureActionExit, Threshold: 3},
+	}}
+
+	addresses := []netAddress{
+		mustParseNetAddress("192.0.2.10"),
+		mustParseNetAddress("192.0.2.11"),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := pinElasticIPs(ctx, &failingElasticIPProvider{}, "test", addresses, cfg)
+
+	var exitErr *failurePolicyExitError
+	require.ErrorAs(t, err, &exitErr)
+	assert.Equal(t, "192.0.2.10/32", exitErr.Address.String())
+	assert.EqualError(t, err, "Giving up on 192.0.2.10/32: API unavailable")
+	assert.NoError(t, ctx.Err())
+}
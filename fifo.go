@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 
@@ -98,7 +99,12 @@ func defaultNotificatonHandler(provider elasticIPProvider, cfg notifyConfig) not
 		go func() {
 			logrus.WithField("notification", notification).Infof("Handle Notification")
 			err := handleNotification(ctx, provider, cfg, notification)
-			if err != nil {
+
+			var exitErr *failurePolicyExitError
+			if errors.As(err, &exitErr) {
+				// Escalate like a failing notify script would
+				logrus.Fatalf("Failed to handle notification: %s", err)
+			} else if err != nil {
 				logrus.Errorf("Failed to handle notification: %s", err)
 			}
 		}()
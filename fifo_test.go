@@ -20,7 +20,7 @@ func TestFIFO_integration(t *testing.T) {
 	refreshCounter := map[string]int{}
 	provider := &fakeElasticIPProvider{refreshCounter: refreshCounter}
 	cfg := notifyConfig{
-		ManagedAddresses: []netAddress{addr},
+		ManagedAddresses: []managedAddress{{Address: addr}},
 		RefreshInterval:  100 * time.Millisecond,
 		RefreshTimeout:   time.Second,
 	}
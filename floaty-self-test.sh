@@ -18,14 +18,14 @@ if [ ! -f "$config_file" ]; then
   exit 3
 fi
 
-self_test_output=$("$floaty_bin" -T "$config_file" 2>&1)
+# Floaty writes the report in the Nagios plugin format to standard output and
+# exits with the matching status code. Logs are discarded.
+"$floaty_bin" -T "$config_file" 2>/dev/null
 self_test_exit=$?
 
-if [ $self_test_exit -eq 0 ]; then
-  echo "Floaty self-test passed"
-  exit 0
-else
-  echo -e "Floaty self-test failed\n"
-  echo -e "${self_test_output}"
-  exit 2
+if [ $self_test_exit -gt 3 ]; then
+  echo "FLOATY UNKNOWN - self-test exited with status ${self_test_exit}"
+  exit 3
 fi
+
+exit $self_test_exit
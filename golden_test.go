@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The golden files in testdata/golden are generated from the fake APIs in
+// this repository, never from the real Cloudscale or Exoscale APIs. They pin
+// down the requests floaty makes and how it handles the responses, but only
+// reflect the real APIs as far as the fakes do.
+var updateGolden = flag.Bool("update", false, "Update the golden files in testdata/golden from the fake APIs")
+
+// Host of API endpoints answered from golden files; never contacted
+const goldenEndpoint = "http://api.golden.invalid"
+
+// Response headers kept in golden files
+var goldenHeaders = []string{"Content-Type", "Retry-After"}
+
+// httpInteraction is a request and the response to it. Bodies must be
+// JSON. A request timing out has no response.
+type httpInteraction struct {
+	Method      string          `json:"method"`
+	Path        string          `json:"path"`
+	RequestBody json.RawMessage `json:"request-body,omitempty"`
+
+	Timeout bool `json:"timeout,omitempty"`
+
+	Status       int               `json:"status,omitempty"`
+	Header       map[string]string `json:"header,omitempty"`
+	ResponseBody json.RawMessage   `json:"response-body,omitempty"`
+}
+
+// matches reports whether the interaction was recorded for the request
+func (i httpInteraction) matches(method, path string, body json.RawMessage) bool {
+	return i.Method == method && i.Path == path && bytes.Equal(i.RequestBody, body)
+}
+
+func goldenPath(name string) string {
+	return filepath.Join("testdata", "golden", name+".json")
+}
+
+// compactJSON normalizes a body for golden files
+func compactJSON(data []byte) (json.RawMessage, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, data); err != nil {
+		return nil, fmt.Errorf("Body is not JSON: %w: %q", err, data)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// readRequestBody returns the normalized body of the request
+func readRequestBody(req *http.Request) (json.RawMessage, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(data))
+
+	return compactJSON(data)
+}
+
+// newGoldenTransport returns a transport and an endpoint for the named
+// golden file. With -update requests are sent to the given handler, usually
+// a fake API, and the interactions are written to the golden file.
+// Otherwise the golden file is replayed and the handler isn't used. All
+// recorded interactions must be replayed by the end of the test.
+func newGoldenTransport(t *testing.T, name string, upstream http.Handler) (http.RoundTripper, string) {
+	t.Helper()
+
+	if *updateGolden {
+		server := httptest.NewServer(upstream)
+		t.Cleanup(server.Close)
+
+		r := &recordingTransport{
+			prefix: server.URL,
+			next:   http.DefaultTransport,
+		}
+
+		t.Cleanup(func() {
+			data, err := json.MarshalIndent(r.interactions, "", "  ")
+			require.NoError(t, err)
+			require.NoError(t, os.MkdirAll(filepath.Dir(goldenPath(name)), 0755))
+			require.NoError(t, os.WriteFile(goldenPath(name), append(data, '\n'), 0644))
+		})
+
+		return r, server.URL
+	}
+
+	data, err := os.ReadFile(goldenPath(name))
+	require.NoError(t, err, "Golden file missing, generate it with -update")
+
+	r := &goldenTransport{}
+	require.NoError(t, json.Unmarshal(data, &r.interactions))
+
+	// Golden files are indented
+	for i := range r.interactions {
+		r.interactions[i].RequestBody, err = compactJSON(r.interactions[i].RequestBody)
+		require.NoError(t, err)
+	}
+
+	r.used = make([]bool, len(r.interactions))
+
+	t.Cleanup(func() {
+		for i, used := range r.used {
+			interaction := r.interactions[i]
+			assert.Truef(t, used, "Recorded request %s %s not replayed", interaction.Method, interaction.Path)
+		}
+	})
+
+	return r, goldenEndpoint
+}
+
+// recordingTransport forwards requests and records them
+type recordingTransport struct {
+	prefix string
+	next   http.RoundTripper
+
+	mu           sync.Mutex
+	interactions []httpInteraction
+}
+
+func (r *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	interaction := httpInteraction{
+		Method:      req.Method,
+		Path:        strings.TrimPrefix(req.URL.String(), r.prefix),
+		RequestBody: body,
+	}
+
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		if req.Context().Err() == nil {
+			return nil, err
+		}
+
+		interaction.Timeout = true
+	} else {
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+
+		interaction.Status = resp.StatusCode
+		if interaction.ResponseBody, err = compactJSON(data); err != nil {
+			return nil, err
+		}
+
+		for _, name := range goldenHeaders {
+			if value := resp.Header.Get(name); value != "" {
+				if interaction.Header == nil {
+					interaction.Header = map[string]string{}
+				}
+				interaction.Header[name] = value
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.interactions = append(r.interactions, interaction)
+	r.mu.Unlock()
+
+	return resp, err
+}
+
+// goldenTransport answers requests with recorded responses. Each
+// interaction is replayed once; requests may arrive in a different order
+// than recorded.
+type goldenTransport struct {
+	mu           sync.Mutex
+	interactions []httpInteraction
+	used         []bool
+}
+
+func (r *goldenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	path := strings.TrimPrefix(req.URL.String(), goldenEndpoint)
+
+	r.mu.Lock()
+	var found *httpInteraction
+	for i := range r.interactions {
+		if !r.used[i] && r.interactions[i].matches(req.Method, path, body) {
+			r.used[i] = true
+			found = &r.interactions[i]
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	if found == nil {
+		return nil, fmt.Errorf("No recorded interaction for %s %s %s", req.Method, path, body)
+	}
+
+	if found.Timeout {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", found.Status, http.StatusText(found.Status)),
+		StatusCode:    found.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          io.NopCloser(bytes.NewReader(found.ResponseBody)),
+		ContentLength: int64(len(found.ResponseBody)),
+		Request:       req,
+	}
+
+	for name, value := range found.Header {
+		resp.Header.Set(name, value)
+	}
+
+	return resp, nil
+}
+
+// httpFault replaces the responses to matching requests of a fake API when
+// generating golden files
+type httpFault struct {
+	Method string
+	Path   string
+
+	// Number of requests to fail; zero fails all of them
+	Times int
+
+	// Status and JSON body of the response, or no response until the
+	// request is cancelled
+	Status int
+	Body   string
+	Stall  bool
+}
+
+// injectFaults returns a handler answering requests matching a fault
+// accordingly and passing on all others
+func injectFaults(next http.Handler, faults ...httpFault) http.Handler {
+	var mu sync.Mutex
+	counts := make([]int, len(faults))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		var found *httpFault
+		for i, fault := range faults {
+			if fault.Method == r.Method && fault.Path == r.URL.Path && (fault.Times == 0 || counts[i] < fault.Times) {
+				counts[i]++
+				found = &faults[i]
+				break
+			}
+		}
+		mu.Unlock()
+
+		switch {
+		case found == nil:
+			next.ServeHTTP(w, r)
+
+		case found.Stall:
+			// The server only notices the client going away once the
+			// body has been read
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(found.Status)
+			io.WriteString(w, found.Body)
+		}
+	})
+}
+
+func TestGoldenTransport(t *testing.T) {
+	r := &goldenTransport{
+		interactions: []httpInteraction{
+			{Method: "GET", Path: "/v1/a", Status: 200, ResponseBody: json.RawMessage(`{"a":1}`)},
+			{Method: "PATCH", Path: "/v1/a", RequestBody: json.RawMessage(`{"b":2}`), Status: 204},
+		},
+		used: make([]bool, 2),
+	}
+
+	client := &http.Client{Transport: r}
+
+	_, err := client.Post(goldenEndpoint+"/v1/a", "application/json", strings.NewReader(`{}`))
+	assert.ErrorContains(t, err, "No recorded interaction for POST /v1/a {}")
+
+	req, err := http.NewRequest("PATCH", goldenEndpoint+"/v1/a", strings.NewReader(`{ "b": 2 }`))
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 204, resp.StatusCode)
+
+	resp, err = client.Get(goldenEndpoint + "/v1/a")
+	require.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, string(data))
+
+	// Each interaction is only replayed once
+	_, err = client.Get(goldenEndpoint + "/v1/a")
+	assert.Error(t, err)
+
+	assert.Equal(t, []bool{true, true}, r.used)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	egoscale "github.com/exoscale/egoscale/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Managed elastic IPs are detached from all other instances like
+	// unmanaged ones
+	exoscaleManagedEIPExclusive = "exclusive"
+	// Managed elastic IPs stay attached to other instances
+	exoscaleManagedEIPShared = "shared"
+	// All elastic IPs are configured with the given health check and stay
+	// attached to other instances
+	exoscaleManagedEIPHealthCheck = "health-check"
+)
+
+// exoscaleAddressConfig controls how floaty coexists with the health check
+// based failover of Exoscale. It's set for the provider and may be
+// overridden for individual managed addresses.
+type exoscaleAddressConfig struct {
+	ManagedEIPMode string                     `yaml:"managed-eip-mode"`
+	HealthCheck    *exoscaleHealthCheckConfig `yaml:"health-check"`
+}
+
+// override returns the configuration with the values set in o replacing
+// the own ones
+func (c exoscaleAddressConfig) override(o exoscaleAddressConfig) exoscaleAddressConfig {
+	if o.ManagedEIPMode != "" {
+		c.ManagedEIPMode = o.ManagedEIPMode
+	}
+	if o.HealthCheck != nil {
+		c.HealthCheck = o.HealthCheck
+	}
+	return c
+}
+
+// exoscaleManagedEIP is the validated form of exoscaleAddressConfig
+type exoscaleManagedEIP struct {
+	mode        string
+	healthCheck *egoscale.ElasticIPHealthcheck
+}
+
+func (c exoscaleAddressConfig) managedEIP() (exoscaleManagedEIP, error) {
+	result := exoscaleManagedEIP{mode: c.ManagedEIPMode}
+
+	var err error
+
+	switch result.mode {
+	case "":
+		result.mode = exoscaleManagedEIPExclusive
+	case exoscaleManagedEIPExclusive, exoscaleManagedEIPShared:
+	case exoscaleManagedEIPHealthCheck:
+		if c.HealthCheck == nil {
+			return result, fmt.Errorf("Managed EIP mode %q requires a health check configuration", result.mode)
+		}
+		if result.healthCheck, err = c.HealthCheck.elasticIPHealthcheck(); err != nil {
+			return result, err
+		}
+	default:
+		return result, fmt.Errorf("Unsupported managed EIP mode %q", result.mode)
+	}
+
+	if c.HealthCheck != nil && result.healthCheck == nil {
+		logrus.Warningf("Health check configuration is only used with managed EIP mode %q", exoscaleManagedEIPHealthCheck)
+	}
+
+	return result, nil
+}
+
+type exoscaleHealthCheckConfig struct {
+	Mode          string        `yaml:"mode"`
+	Port          int64         `yaml:"port"`
+	URI           string        `yaml:"uri"`
+	Interval      time.Duration `yaml:"interval"`
+	Timeout       time.Duration `yaml:"timeout"`
+	StrikesOK     int64         `yaml:"strikes-ok"`
+	StrikesFail   int64         `yaml:"strikes-fail"`
+	TLSSNI        string        `yaml:"tls-sni"`
+	TLSSkipVerify bool          `yaml:"tls-skip-verify"`
+}
+
+// elasticIPHealthcheck converts the configuration to the API representation.
+// Unset values are left to the provider defaults.
+func (c exoscaleHealthCheckConfig) elasticIPHealthcheck() (*egoscale.ElasticIPHealthcheck, error) {
+	mode := egoscale.ElasticIPHealthcheckMode(c.Mode)
+
+	switch mode {
+	case egoscale.ElasticIPHealthcheckModeTCP, egoscale.ElasticIPHealthcheckModeHTTP, egoscale.ElasticIPHealthcheckModeHttps:
+	default:
+		return nil, fmt.Errorf("Unsupported health check mode %q", c.Mode)
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		return nil, fmt.Errorf("Invalid health check port %d", c.Port)
+	}
+
+	result := &egoscale.ElasticIPHealthcheck{
+		Mode:        mode,
+		Port:        c.Port,
+		URI:         c.URI,
+		Interval:    int64(c.Interval / time.Second),
+		Timeout:     int64(c.Timeout / time.Second),
+		StrikesOk:   c.StrikesOK,
+		StrikesFail: c.StrikesFail,
+		TlsSNI:      c.TLSSNI,
+	}
+
+	if mode == egoscale.ElasticIPHealthcheckModeHttps {
+		skipVerify := c.TLSSkipVerify
+		result.TlsSkipVerify = &skipVerify
+	}
+
+	return result, nil
+}
+
+// exoscaleHealthcheckMatches reports whether the actual health check
+// contains all configured values
+func exoscaleHealthcheckMatches(actual, desired *egoscale.ElasticIPHealthcheck) bool {
+	if actual == nil || desired == nil {
+		return actual == desired
+	}
+
+	if actual.Mode != desired.Mode || actual.Port != desired.Port || actual.URI != desired.URI {
+		return false
+	}
+
+	for _, i := range []struct{ actual, desired int64 }{
+		{actual.Interval, desired.Interval},
+		{actual.Timeout, desired.Timeout},
+		{actual.StrikesOk, desired.StrikesOk},
+		{actual.StrikesFail, desired.StrikesFail},
+	} {
+		if i.desired != 0 && i.actual != i.desired {
+			return false
+		}
+	}
+
+	if desired.TlsSNI != "" && actual.TlsSNI != desired.TlsSNI {
+		return false
+	}
+
+	if desired.TlsSkipVerify != nil &&
+		(actual.TlsSkipVerify == nil || *actual.TlsSkipVerify != *desired.TlsSkipVerify) {
+		return false
+	}
+
+	return true
+}
+
+func describeExoscaleHealthcheck(hc *egoscale.ElasticIPHealthcheck) string {
+	if hc == nil {
+		return "no health check"
+	}
+
+	target := fmt.Sprintf("port %d", hc.Port)
+	if hc.URI != "" {
+		target += " " + hc.URI
+	}
+
+	description := fmt.Sprintf("%s health check on %s", hc.Mode, target)
+
+	// Unset values use provider defaults
+	if hc.Interval > 0 {
+		description += fmt.Sprintf(" every %ds", hc.Interval)
+	}
+	if hc.Timeout > 0 {
+		description += fmt.Sprintf(", timeout %ds", hc.Timeout)
+	}
+	if hc.StrikesOk > 0 || hc.StrikesFail > 0 {
+		description += fmt.Sprintf(", strikes ok/fail %d/%d", hc.StrikesOk, hc.StrikesFail)
+	}
+
+	return description
+}
+
+// keepsOtherHolders reports whether the elastic IP must not be detached from
+// other instances
+func (m exoscaleManagedEIP) keepsOtherHolders(eip egoscale.ElasticIP) bool {
+	switch m.mode {
+	case exoscaleManagedEIPShared:
+		return eip.Healthcheck != nil
+	case exoscaleManagedEIPHealthCheck:
+		return true
+	}
+	return false
+}
+
+// ensureHealthcheck configures the health check of the elastic IP if it
+// differs from the configuration
+func (r *exoscaleElasticIPRefresher) ensureHealthcheck(ctx context.Context) error {
+	desired := r.managedEIP.healthCheck
+
+	eip, err := r.client.GetElasticIP(ctx, r.eip.ID)
+	if err != nil {
+		return fmt.Errorf("Retrieving elastic IP %s: %w", r.eip.IP, err)
+	}
+
+	if exoscaleHealthcheckMatches(eip.Healthcheck, desired) {
+		return nil
+	}
+
+	r.logger.Infof("Updating health check of EIP %s: %s", r.eip.IP, describeExoscaleHealthcheck(desired))
+
+	op, err := r.client.UpdateElasticIP(ctx, r.eip.ID, egoscale.UpdateElasticIPRequest{
+		Healthcheck: desired,
+	})
+	if err == nil {
+		_, err = r.client.Wait(ctx, op, egoscale.OperationStateSuccess)
+	}
+	if err != nil {
+		return fmt.Errorf("Updating health check of elastic IP %s: %w", r.eip.IP, err)
+	}
+
+	return nil
+}
+
+// testHealthcheck reports how the elastic IP coexists with the health check
+// based failover of Exoscale
+func (m exoscaleManagedEIP) testHealthcheck(eip *egoscale.ElasticIP, holders int) (checkStatus, string) {
+	description := fmt.Sprintf("%s, attached to %d instance(s)", describeExoscaleHealthcheck(eip.Healthcheck), holders)
+
+	switch m.mode {
+	case exoscaleManagedEIPHealthCheck:
+		if !exoscaleHealthcheckMatches(eip.Healthcheck, m.healthCheck) {
+			return checkWarning, fmt.Sprintf("%s; differs from configured %s",
+				description, describeExoscaleHealthcheck(m.healthCheck))
+		}
+	case exoscaleManagedEIPShared:
+		if eip.Healthcheck == nil && holders > 1 {
+			return checkWarning, fmt.Sprintf("%s; unmanaged elastic IP will be detached from other instances", description)
+		}
+	default:
+		if eip.Healthcheck != nil {
+			return checkWarning, fmt.Sprintf("%s; managed elastic IP will be detached from other instances", description)
+		}
+	}
+
+	return checkOK, description
+}
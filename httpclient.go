@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHTTPTimeout             = 1 * time.Minute
+	defaultHTTPDialTimeout         = 30 * time.Second
+	defaultHTTPTLSHandshakeTimeout = 10 * time.Second
+	defaultHTTPKeepAlive           = 30 * time.Second
+	defaultHTTPIdleConnTimeout     = 90 * time.Second
+	defaultHTTPMetadataTimeout     = 5 * time.Second
+)
+
+// Metadata services are only reachable directly
+var defaultHTTPNoProxy = []string{
+	"169.254.169.254",
+	"metadata.exoscale.com",
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// httpConfig controls the HTTP clients used for provider APIs and metadata
+// services
+type httpConfig struct {
+	// Defaults to the proxy given in the environment
+	Proxy *textURL `yaml:"proxy"`
+
+	// Hosts, domains (with leading dot) and networks not to use the proxy
+	// for
+	NoProxy []string `yaml:"no-proxy"`
+
+	// PEM file with certificates trusted in addition to the system ones
+	CAFile string `yaml:"ca-file"`
+
+	// Client certificate and key as PEM files
+	CertFile string `yaml:"cert-file"`
+	KeyFile  string `yaml:"key-file"`
+
+	TLSMinVersion string `yaml:"tls-min-version"`
+
+	// Timeout of API requests including reading the response; metadata
+	// requests always use a short timeout
+	Timeout               time.Duration `yaml:"timeout"`
+	DialTimeout           time.Duration `yaml:"dial-timeout"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tls-handshake-timeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"response-header-timeout"`
+
+	// Interval of TCP keep-alive probes and how long idle connections are
+	// kept open for reuse
+	KeepAlive             time.Duration `yaml:"keep-alive"`
+	IdleConnectionTimeout time.Duration `yaml:"idle-connection-timeout"`
+	DisableKeepAlives     bool          `yaml:"disable-keep-alives"`
+
+	// Replaces the configured transport, e.g. to replay recorded API
+	// interactions in tests
+	transport http.RoundTripper
+}
+
+func newHTTPConfig() httpConfig {
+	return httpConfig{
+		NoProxy:               defaultHTTPNoProxy,
+		TLSMinVersion:         "1.2",
+		Timeout:               defaultHTTPTimeout,
+		DialTimeout:           defaultHTTPDialTimeout,
+		TLSHandshakeTimeout:   defaultHTTPTLSHandshakeTimeout,
+		KeepAlive:             defaultHTTPKeepAlive,
+		IdleConnectionTimeout: defaultHTTPIdleConnTimeout,
+	}
+}
+
+// tlsConfig returns the TLS client configuration
+func (c httpConfig) tlsConfig() (*tls.Config, error) {
+	result := &tls.Config{}
+
+	if c.TLSMinVersion != "" {
+		version, ok := tlsVersions[c.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported TLS version %q", c.TLSMinVersion)
+		}
+		result.MinVersion = version
+	}
+
+	if c.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		data, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Reading CA bundle: %w", err)
+		}
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %q", c.CAFile)
+		}
+
+		result.RootCAs = pool
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("Client certificate and key must be given together")
+	}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Loading client certificate: %w", err)
+		}
+
+		result.Certificates = []tls.Certificate{cert}
+	}
+
+	return result, nil
+}
+
+// bypassesProxy reports whether the host is listed in no-proxy
+func (c httpConfig) bypassesProxy(host string) bool {
+	ip := net.ParseIP(host)
+
+	for _, entry := range c.NoProxy {
+		if strings.HasPrefix(entry, ".") {
+			if strings.HasSuffix(host, entry) || host == entry[1:] {
+				return true
+			}
+			continue
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if strings.EqualFold(host, entry) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c httpConfig) proxy(req *http.Request) (*url.URL, error) {
+	if c.bypassesProxy(req.URL.Hostname()) {
+		return nil, nil
+	}
+
+	if c.Proxy == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	// Make copy to prevent modifications
+	proxyURL := url.URL(c.Proxy.URL)
+
+	return &proxyURL, nil
+}
+
+// newTransport returns a transport with the configured proxy, TLS and
+// connection settings
+func (c httpConfig) newTransport() (*http.Transport, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: c.KeepAlive,
+	}
+
+	return &http.Transport{
+		Proxy:                 c.proxy,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+		IdleConnTimeout:       c.IdleConnectionTimeout,
+		MaxIdleConns:          100,
+		DisableKeepAlives:     c.DisableKeepAlives,
+		ExpectContinueTimeout: 1 * time.Second,
+	}, nil
+}
+
+// roundTripper returns the transport to use for requests
+func (c httpConfig) roundTripper() (http.RoundTripper, error) {
+	if c.transport != nil {
+		return c.transport, nil
+	}
+
+	return c.newTransport()
+}
+
+// newClient returns a client for provider APIs. Requests are subject to the
+// rate limit.
+func (c httpConfig) newClient(rateLimit rateLimitConfig) (*http.Client, error) {
+	transport, err := c.roundTripper()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Timeout:   c.Timeout,
+		Transport: newRateLimitedTransport(rateLimit, transport),
+	}, nil
+}
+
+// newMetadataClient returns a client for metadata services
+func (c httpConfig) newMetadataClient() (*http.Client, error) {
+	transport, err := c.roundTripper()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Timeout:   defaultHTTPMetadataTimeout,
+		Transport: transport,
+	}, nil
+}
+
+// newProbeClient returns a client for verification probes, which are limited
+// by the probe timeout
+func (c httpConfig) newProbeClient() (*http.Client, error) {
+	transport, err := c.roundTripper()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Transport: transport,
+	}, nil
+}
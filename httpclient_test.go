@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self-signed client certificate and its key
+// as PEM files
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "floaty"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	return certFile, keyFile
+}
+
+func TestHTTPConfigBypassesProxy(t *testing.T) {
+	cfg := httpConfig{
+		NoProxy: []string{"169.254.169.254", ".internal.example", "10.0.0.0/8", "Metadata.Example.com"},
+	}
+
+	for host, expected := range map[string]bool{
+		"169.254.169.254":      true,
+		"169.254.169.253":      false,
+		"api.internal.example": true,
+		"internal.example":     true,
+		"internal.example.com": false,
+		"10.1.2.3":             true,
+		"metadata.example.com": true,
+		"api.cloudscale.ch":    false,
+	} {
+		assert.Equal(t, expected, cfg.bypassesProxy(host), host)
+	}
+}
+
+func TestHTTPConfigProxy(t *testing.T) {
+	proxied := []string{}
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer proxy.Close()
+
+	proxyURL := mustParseTextURL(proxy.URL)
+
+	cfg := newHTTPConfig()
+	cfg.Proxy = &proxyURL
+
+	client, err := cfg.newClient(rateLimitConfig{})
+	require.NoError(t, err)
+
+	resp, err := client.Get("http://api.example.net/v1/floating-ips")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, []string{"http://api.example.net/v1/floating-ips"}, proxied)
+
+	// Metadata services are contacted directly
+	transport, err := cfg.newTransport()
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", cloudscaleMetadataURL, nil)
+	require.NoError(t, err)
+
+	found, err := transport.Proxy(req)
+	require.NoError(t, err)
+	assert.Nil(t, found)
+}
+
+func TestHTTPConfigTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}), 0600))
+
+	cfg := newHTTPConfig()
+
+	client, err := cfg.newClient(rateLimitConfig{})
+	require.NoError(t, err)
+
+	_, err = client.Get(server.URL)
+	assert.ErrorContains(t, err, "certificate")
+
+	cfg.CAFile = caFile
+
+	client, err = cfg.newClient(rateLimitConfig{})
+	require.NoError(t, err)
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	cfg.CertFile, cfg.KeyFile = writeTestCertificate(t, dir)
+
+	client, err = cfg.newClient(rateLimitConfig{})
+	require.NoError(t, err)
+
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestHTTPConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	empty := filepath.Join(dir, "empty.pem")
+	require.NoError(t, os.WriteFile(empty, []byte{}, 0600))
+
+	for _, tc := range []struct {
+		name string
+		cfg  httpConfig
+		err  string
+	}{
+		{name: "tls-version", cfg: httpConfig{TLSMinVersion: "1.4"}, err: `Unsupported TLS version "1.4"`},
+		{name: "ca-missing", cfg: httpConfig{CAFile: filepath.Join(dir, "missing.pem")}, err: "Reading CA bundle: open "},
+		{name: "ca-empty", cfg: httpConfig{CAFile: empty}, err: `No certificates found in CA bundle "` + empty + `"`},
+		{name: "key-missing", cfg: httpConfig{CertFile: empty}, err: "Client certificate and key must be given together"},
+		{name: "cert-invalid", cfg: httpConfig{CertFile: empty, KeyFile: empty}, err: "Loading client certificate: "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.cfg.newClient(rateLimitConfig{})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
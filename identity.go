@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+const (
+	identitySourceCloudInit   = "cloud-init"
+	identitySourceConfigDrive = "config-drive"
+	identitySourceMetadata    = "metadata"
+	identitySourceDMI         = "dmi"
+	identitySourceCache       = "cache"
+
+	defaultCloudInitInstanceDataFile = "/run/cloud-init/instance-data.json"
+	defaultDMIProductUUIDFile        = "/sys/class/dmi/id/product_uuid"
+	defaultIdentityCacheFileTemplate = "/var/lib/floaty/identity.%s.json"
+	defaultIdentityCacheTTL          = 24 * time.Hour
+
+	// Limit accepted size of identity files
+	maxIdentityFileSize = 1024 * 1024
+)
+
+// Local sources come first as they don't depend on the network. The DMI
+// product UUID comes last as it isn't guaranteed to match the ID used by the
+// provider API.
+var defaultIdentitySources = []string{
+	identitySourceCloudInit,
+	identitySourceConfigDrive,
+	identitySourceMetadata,
+	identitySourceCache,
+	identitySourceDMI,
+}
+
+// identityConfig controls how the machine running floaty is identified when
+// its ID isn't given in the provider configuration
+type identityConfig struct {
+	// Sources in the order they're tried; defaults to all of them
+	Sources []string `yaml:"sources"`
+
+	CloudInitFile string `yaml:"cloud-init-file"`
+
+	// Mount point or device of the config drive; defaults to the device
+	// labelled by the provider
+	ConfigDrive string `yaml:"config-drive"`
+
+	DMIFile string `yaml:"dmi-file"`
+
+	CacheFileTemplate string `yaml:"cache-file-template"`
+
+	// How long an identity confirmed by the provider API is used without
+	// discovery; zero disables reuse
+	CacheTTL time.Duration `yaml:"cache-ttl"`
+}
+
+func newIdentityConfig() identityConfig {
+	return identityConfig{
+		CloudInitFile:     defaultCloudInitInstanceDataFile,
+		DMIFile:           defaultDMIProductUUIDFile,
+		CacheFileTemplate: defaultIdentityCacheFileTemplate,
+		CacheTTL:          defaultIdentityCacheTTL,
+	}
+}
+
+func (c identityConfig) sources() []string {
+	if len(c.Sources) > 0 {
+		return c.Sources
+	}
+	return defaultIdentitySources
+}
+
+func (c identityConfig) makeCacheFilePath(provider string) string {
+	if c.CacheFileTemplate == "" {
+		return ""
+	}
+	return fmt.Sprintf(c.CacheFileTemplate, url.PathEscape(provider))
+}
+
+// instanceIdentity identifies the machine running floaty within the
+// provider API
+type instanceIdentity struct {
+	ID   string `json:"id"`
+	Zone string `json:"zone,omitempty"`
+}
+
+// identityOrigin tells where the ID of the machine running floaty was found
+type identityOrigin int
+
+const (
+	// Given in the provider configuration
+	identityConfigured identityOrigin = iota
+
+	// Confirmed by the provider API in a previous invocation
+	identityCached
+
+	// Found by one of the identity sources, not yet confirmed
+	identityDiscovered
+)
+
+// identitySource returns the identity of the machine running floaty as
+// recorded by one particular source
+type identitySource func(ctx context.Context) (instanceIdentity, error)
+
+// discover tries the configured sources in order and returns the first
+// identity accepted by the validation function. The result isn't cached;
+// only identities confirmed by the provider API are stored using
+// storeValidatedIdentity.
+func (c identityConfig) discover(ctx context.Context, provider string,
+	sources map[string]identitySource, validate func(instanceIdentity) error) (instanceIdentity, error) {
+	cachePath := c.makeCacheFilePath(provider)
+
+	all := map[string]identitySource{
+		identitySourceCache: func(context.Context) (instanceIdentity, error) {
+			return readCachedIdentity(cachePath)
+		},
+	}
+	for name, source := range sources {
+		all[name] = source
+	}
+
+	names := c.sources()
+
+	for _, name := range names {
+		if _, ok := all[name]; !ok {
+			return instanceIdentity{}, fmt.Errorf("Unknown identity source %q", name)
+		}
+	}
+
+	var allErrors error
+
+	for _, name := range names {
+		logger := logrus.WithField("source", name)
+
+		identity, err := all[name](ctx)
+		if err == nil {
+			err = validate(identity)
+		}
+		if err != nil {
+			logger.Debugf("Identity lookup failed: %s", err)
+			allErrors = multierr.Append(allErrors, fmt.Errorf("%s: %w", name, err))
+
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return instanceIdentity{}, ctxErr
+			}
+			continue
+		}
+
+		logger.WithField("id", identity.ID).Debug("Found identity")
+
+		return identity, nil
+	}
+
+	return instanceIdentity{}, fmt.Errorf("Identity not found: %w", allErrors)
+}
+
+// readIdentityFile reads a file of limited size
+func readIdentityFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, errors.New("No file configured")
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	return io.ReadAll(io.LimitReader(fh, maxIdentityFileSize))
+}
+
+// cachedIdentity is persisted between invocations as each transition is
+// usually handled by a separate process. Only identities confirmed by the
+// provider API are written.
+type cachedIdentity struct {
+	instanceIdentity
+	Updated time.Time `json:"updated"`
+
+	Hostname  string    `json:"hostname,omitempty"`
+	Validated time.Time `json:"validated,omitempty"`
+}
+
+func readIdentityCacheFile(path string) (cachedIdentity, error) {
+	data, err := readIdentityFile(path)
+	if err != nil {
+		return cachedIdentity{}, err
+	}
+
+	var cached cachedIdentity
+
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return cachedIdentity{}, fmt.Errorf("Parsing %s: %w", path, err)
+	}
+
+	return cached, nil
+}
+
+// readCachedIdentity returns the cached identity if it was confirmed by the
+// provider API, regardless of its age
+func readCachedIdentity(path string) (instanceIdentity, error) {
+	cached, err := readIdentityCacheFile(path)
+	if err != nil {
+		return instanceIdentity{}, err
+	}
+
+	if cached.Validated.IsZero() {
+		return instanceIdentity{}, errors.New("Identity not confirmed by provider API")
+	}
+
+	return cached.instanceIdentity, nil
+}
+
+func writeIdentityCacheFile(path string, cached cachedIdentity) error {
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data, 0644)
+}
+
+// validatedIdentity returns the cached identity if it was confirmed by the
+// provider API on the same host within the configured TTL
+func (c identityConfig) validatedIdentity(provider, hostname string, now time.Time) (instanceIdentity, bool) {
+	path := c.makeCacheFilePath(provider)
+	if path == "" || c.CacheTTL <= 0 {
+		return instanceIdentity{}, false
+	}
+
+	cached, err := readIdentityCacheFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logrus.Warningf("Reading identity cache failed: %s", err)
+		}
+		return instanceIdentity{}, false
+	}
+
+	if cached.Validated.IsZero() || cached.Hostname != hostname || now.Sub(cached.Validated) > c.CacheTTL {
+		return instanceIdentity{}, false
+	}
+
+	return cached.instanceIdentity, true
+}
+
+// storeValidatedIdentity records an identity confirmed by the provider API
+func (c identityConfig) storeValidatedIdentity(provider, hostname string, identity instanceIdentity) {
+	path := c.makeCacheFilePath(provider)
+	if path == "" {
+		return
+	}
+
+	now := time.Now().UTC()
+
+	if err := writeIdentityCacheFile(path, cachedIdentity{
+		instanceIdentity: identity,
+		Updated:          now,
+		Hostname:         hostname,
+		Validated:        now,
+	}); err != nil {
+		logrus.Warningf("Writing identity cache %q failed: %s", path, err)
+	}
+}
+
+// identityRejectedError is returned by validation functions when the
+// provider API doesn't know the identity, as opposed to failing for other
+// reasons such as server errors, timeouts or invalid credentials
+type identityRejectedError struct {
+	Err error
+}
+
+func (e *identityRejectedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *identityRejectedError) Unwrap() error {
+	return e.Err
+}
+
+// confirmIdentity confirms an identity before it's used for the first time
+// and stores it. Only a rejection by the provider API is returned. If the API
+// is unavailable the identity is used anyway and confirmed in the background.
+func (c identityConfig) confirmIdentity(ctx context.Context, provider, hostname string,
+	identity instanceIdentity, validate func(context.Context) error) error {
+	err := validate(ctx)
+	if err == nil {
+		c.storeValidatedIdentity(provider, hostname, identity)
+		return nil
+	}
+
+	var rejected *identityRejectedError
+	if errors.As(err, &rejected) {
+		return err
+	}
+
+	logrus.WithField("id", identity.ID).Warningf("Confirming identity failed, retrying in the background: %s", err)
+
+	c.revalidateIdentity(ctx, provider, hostname, identity, validate)
+
+	return nil
+}
+
+// revalidateIdentity confirms a cached identity in the background, retrying
+// until the provider API answers. The cache is only removed when the API
+// rejects the identity so the next invocation runs the full discovery.
+func (c identityConfig) revalidateIdentity(ctx context.Context, provider, hostname string,
+	identity instanceIdentity, validate func(context.Context) error) {
+	logger := logrus.WithField("id", identity.ID)
+
+	go func() {
+		b := backoff.NewExponentialBackOff()
+		b.MaxElapsedTime = 0
+
+		err := backoff.RetryNotify(func() error {
+			err := validate(ctx)
+
+			var rejected *identityRejectedError
+			if errors.As(err, &rejected) {
+				return backoff.Permanent(err)
+			}
+
+			return err
+		}, backoff.WithContext(b, ctx), func(err error, wait time.Duration) {
+			logger.Debugf("Confirming identity failed, retrying in %s: %s", wait, err)
+		})
+		if err == nil {
+			c.storeValidatedIdentity(provider, hostname, identity)
+			return
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		logger.Warningf("Provider API rejected identity: %s", err)
+
+		path := c.makeCacheFilePath(provider)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Warningf("Removing identity cache %q failed: %s", path, err)
+		}
+	}()
+}
+
+// cloudInitInstanceData contains the standardized keys of the instance data
+// written by cloud-init
+type cloudInitInstanceData struct {
+	V1 struct {
+		InstanceID       string `json:"instance_id"`
+		AvailabilityZone string `json:"availability_zone"`
+	} `json:"v1"`
+}
+
+func readCloudInitIdentity(path string) (instanceIdentity, error) {
+	data, err := readIdentityFile(path)
+	if err != nil {
+		return instanceIdentity{}, err
+	}
+
+	var instanceData cloudInitInstanceData
+
+	if err := json.Unmarshal(data, &instanceData); err != nil {
+		return instanceIdentity{}, fmt.Errorf("Parsing %s: %w", path, err)
+	}
+
+	return instanceIdentity{
+		ID:   instanceData.V1.InstanceID,
+		Zone: instanceData.V1.AvailabilityZone,
+	}, nil
+}
+
+// readDMIIdentity returns the product UUID reported by the firmware. It's
+// only readable by root.
+func readDMIIdentity(path string) (instanceIdentity, error) {
+	data, err := readIdentityFile(path)
+	if err != nil {
+		return instanceIdentity{}, err
+	}
+
+	return instanceIdentity{
+		ID: strings.ToLower(strings.TrimSpace(string(data))),
+	}, nil
+}
+
+// readConfigDriveFile reads a file from a config drive given either as the
+// directory it's mounted on or as a device. Reading the device requires
+// root privileges.
+func readConfigDriveFile(location, name string) ([]byte, error) {
+	fi, err := os.Stat(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return readIdentityFile(filepath.Join(location, filepath.FromSlash(name)))
+	}
+
+	disk, err := diskfs.Open(location, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return nil, fmt.Errorf("Opening config drive %s: %w", location, err)
+	}
+	defer disk.File.Close()
+
+	// Config drives are usually ISO images whose block size isn't reported
+	// correctly
+	disk.DefaultBlocks = true
+
+	fs, err := disk.GetFilesystem(0)
+	if err != nil {
+		return nil, fmt.Errorf("Reading filesystem on %s: %w", location, err)
+	}
+
+	fh, err := fs.OpenFile("/"+name, os.O_RDONLY)
+	if err != nil {
+		return nil, fmt.Errorf("Opening %s on %s: %w", name, location, err)
+	}
+	defer fh.Close()
+
+	return io.ReadAll(io.LimitReader(fh, maxIdentityFileSize))
+}
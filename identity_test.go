@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeIdentityTestFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func fixedIdentitySource(id string, err error) identitySource {
+	return func(context.Context) (instanceIdentity, error) {
+		return instanceIdentity{ID: id}, err
+	}
+}
+
+func TestIdentityDiscover(t *testing.T) {
+	cfg := identityConfig{
+		Sources:           []string{"first", "second", identitySourceCache},
+		CacheFileTemplate: filepath.Join(t.TempDir(), "identity.%s.json"),
+	}
+
+	validate := func(i instanceIdentity) error {
+		if i.ID == "invalid" {
+			return errors.New("invalid")
+		}
+		return nil
+	}
+
+	// Failing and invalid sources are skipped
+	found, err := cfg.discover(context.Background(), "test", map[string]identitySource{
+		"first":  fixedIdentitySource("", errors.New("unavailable")),
+		"second": fixedIdentitySource("invalid", nil),
+		"third":  fixedIdentitySource("not-configured", nil),
+	}, validate)
+	assert.Error(t, err)
+	assert.Empty(t, found.ID)
+
+	found, err = cfg.discover(context.Background(), "test", map[string]identitySource{
+		"first":  fixedIdentitySource("", errors.New("unavailable")),
+		"second": fixedIdentitySource("server", nil),
+	}, validate)
+	require.NoError(t, err)
+	assert.Equal(t, "server", found.ID)
+
+	// Identities not confirmed by the provider API aren't cached
+	assert.NoFileExists(t, cfg.makeCacheFilePath("test"))
+
+	unavailable := map[string]identitySource{
+		"first":  fixedIdentitySource("", errors.New("unavailable")),
+		"second": fixedIdentitySource("", errors.New("unavailable")),
+	}
+
+	_, err = cfg.discover(context.Background(), "test", unavailable, validate)
+	assert.Error(t, err)
+
+	// Confirmed identity is used as a last resort
+	cfg.storeValidatedIdentity("test", "lb1", instanceIdentity{ID: "server"})
+
+	found, err = cfg.discover(context.Background(), "test", unavailable, validate)
+	require.NoError(t, err)
+	assert.Equal(t, "server", found.ID)
+
+	_, err = cfg.discover(context.Background(), "test", map[string]identitySource{
+		"first": fixedIdentitySource("server", nil),
+	}, validate)
+	assert.EqualError(t, err, `Unknown identity source "second"`)
+}
+
+func TestReadCloudInitIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instance-data.json")
+
+	writeIdentityTestFile(t, path, `{
+  "v1": {
+    "availability_zone": "ch-gva-2",
+    "cloud_name": "exoscale",
+    "instance_id": "00000000-0000-4000-8000-000000000001"
+  }
+}`)
+
+	found, err := readCloudInitIdentity(path)
+	require.NoError(t, err)
+	assert.Equal(t, instanceIdentity{
+		ID:   "00000000-0000-4000-8000-000000000001",
+		Zone: "ch-gva-2",
+	}, found)
+
+	_, err = readCloudInitIdentity(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+
+	_, err = readCloudInitIdentity("")
+	assert.EqualError(t, err, "No file configured")
+}
+
+func TestReadDMIIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "product_uuid")
+
+	writeIdentityTestFile(t, path, "96DEFB88-4F1E-4A7A-8D9B-3B1F2A4C5D6E\n")
+
+	found, err := readDMIIdentity(path)
+	require.NoError(t, err)
+	assert.Equal(t, "96defb88-4f1e-4a7a-8d9b-3b1f2a4c5d6e", found.ID)
+}
+
+func TestCloudscaleIdentitySources(t *testing.T) {
+	dir := t.TempDir()
+
+	writeIdentityTestFile(t, filepath.Join(dir, "openstack", "latest", "meta_data.json"),
+		`{"name": "lb1", "meta": {"cloudscale_uuid": "96defb88-4f1e-4a7a-8d9b-3b1f2a4c5d6e"}}`)
+
+	cfg := identityConfig{
+		Sources:       []string{identitySourceCloudInit, identitySourceConfigDrive},
+		CloudInitFile: filepath.Join(dir, "missing.json"),
+		ConfigDrive:   dir,
+	}
+
+	serverUUID, origin, err := cloudscaleNotifyConfig{}.findServerUUID(context.Background(), cfg, httpConfig{}, "lb1")
+	require.NoError(t, err)
+	assert.Equal(t, identityDiscovered, origin)
+	assert.Equal(t, "96defb88-4f1e-4a7a-8d9b-3b1f2a4c5d6e", serverUUID.String())
+}
+
+func TestCloudscaleCloudInitIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instance-data.json")
+
+	// The OpenStack instance ID isn't the server UUID
+	writeIdentityTestFile(t, path, `{
+  "ds": {
+    "meta_data": {
+      "meta": {"cloudscale_uuid": "96defb88-4f1e-4a7a-8d9b-3b1f2a4c5d6e"},
+      "name": "lb1",
+      "uuid": "2a1c0a43-5c2f-4c73-9b0e-3fd1d0c7a8e1"
+    }
+  },
+  "v1": {
+    "cloud_name": "cloudscale",
+    "instance_id": "2a1c0a43-5c2f-4c73-9b0e-3fd1d0c7a8e1"
+  }
+}`)
+
+	found, err := readCloudscaleCloudInitIdentity(path)
+	require.NoError(t, err)
+	assert.Equal(t, instanceIdentity{ID: "96defb88-4f1e-4a7a-8d9b-3b1f2a4c5d6e"}, found)
+
+	writeIdentityTestFile(t, path, `{"v1": {"instance_id": "2a1c0a43-5c2f-4c73-9b0e-3fd1d0c7a8e1"}}`)
+
+	_, err = readCloudscaleCloudInitIdentity(path)
+	assert.EqualError(t, err, "Server UUID missing in metadata")
+}
+
+func TestCloudscaleMetadataURL(t *testing.T) {
+	server := httptest.NewServer(newFakeCloudscaleAPI())
+	defer server.Close()
+
+	metadataURL := mustParseTextURL(server.URL + fakeCloudscaleMetadataPath)
+
+	cfg := cloudscaleNotifyConfig{MetadataURL: &metadataURL}
+	identity := identityConfig{Sources: []string{identitySourceMetadata}}
+
+	serverUUID, origin, err := cfg.findServerUUID(context.Background(), identity, httpConfig{}, "lb1")
+	require.NoError(t, err)
+	assert.Equal(t, identityDiscovered, origin)
+	assert.Equal(t, fakeCloudscaleServerUUID, serverUUID.String())
+}
+
+func TestExoscaleIdentitySources(t *testing.T) {
+	dir := t.TempDir()
+
+	writeIdentityTestFile(t, filepath.Join(dir, "meta-data"),
+		"instance-id: 00000000-0000-4000-8000-000000000001\navailability-zone: ch-dk-2\nlocal-hostname: lb1\n")
+
+	sources := exoscaleIdentitySources(identityConfig{ConfigDrive: dir}, httpConfig{}, true)
+
+	found, err := sources[identitySourceConfigDrive](context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, instanceIdentity{
+		ID:   "00000000-0000-4000-8000-000000000001",
+		Zone: "ch-dk-2",
+	}, found)
+}
+
+func TestValidatedIdentity(t *testing.T) {
+	cfg := identityConfig{
+		CacheFileTemplate: filepath.Join(t.TempDir(), "identity.%s.json"),
+		CacheTTL:          1 * time.Hour,
+	}
+
+	identity := instanceIdentity{ID: "server", Zone: "zone"}
+	now := time.Now()
+
+	_, ok := cfg.validatedIdentity("test", "lb1", now)
+	assert.False(t, ok)
+
+	// Unconfirmed identities, e.g. written by older versions, aren't reused
+	require.NoError(t, writeIdentityCacheFile(cfg.makeCacheFilePath("test"), cachedIdentity{
+		instanceIdentity: identity,
+		Updated:          now,
+	}))
+	_, ok = cfg.validatedIdentity("test", "lb1", now)
+	assert.False(t, ok)
+	_, err := readCachedIdentity(cfg.makeCacheFilePath("test"))
+	assert.EqualError(t, err, "Identity not confirmed by provider API")
+
+	cfg.storeValidatedIdentity("test", "lb1", identity)
+
+	found, ok := cfg.validatedIdentity("test", "lb1", now)
+	assert.True(t, ok)
+	assert.Equal(t, identity, found)
+
+	_, ok = cfg.validatedIdentity("test", "lb2", now)
+	assert.False(t, ok, "different hostname")
+
+	_, ok = cfg.validatedIdentity("test", "lb1", now.Add(2*time.Hour))
+	assert.False(t, ok, "expired")
+
+	cfg.CacheTTL = 0
+	_, ok = cfg.validatedIdentity("test", "lb1", now)
+	assert.False(t, ok, "disabled")
+}
+
+func TestRevalidateIdentity(t *testing.T) {
+	cfg := identityConfig{
+		CacheFileTemplate: filepath.Join(t.TempDir(), "identity.%s.json"),
+		CacheTTL:          1 * time.Hour,
+	}
+	path := cfg.makeCacheFilePath("test")
+	identity := instanceIdentity{ID: "server"}
+
+	cfg.storeValidatedIdentity("test", "lb1", identity)
+	cached, err := readIdentityCacheFile(path)
+	require.NoError(t, err)
+
+	// Other errors, e.g. server errors, are retried and keep the cache
+	var mu sync.Mutex
+	attempts := 0
+	cfg.revalidateIdentity(context.Background(), "test", "lb1", identity, func(context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts++
+		if attempts == 1 {
+			return errors.New("HTTP 503 Service Unavailable")
+		}
+		return nil
+	})
+
+	assert.Eventually(t, func() bool {
+		confirmed, err := readIdentityCacheFile(path)
+		return err == nil && confirmed.Validated.After(cached.Validated)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	done := make(chan struct{})
+	cfg.revalidateIdentity(context.Background(), "test", "lb1", identity, func(context.Context) error {
+		defer close(done)
+		return &identityRejectedError{Err: errors.New("HTTP 404 Not Found")}
+	})
+	<-done
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return errors.Is(err, os.ErrNotExist)
+	}, 5*time.Second, 10*time.Millisecond)
+}
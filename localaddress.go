@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+// localAddressConfig configures an address on a local interface while the
+// VRRP instance managing it is in MASTER status. Needed where the provider
+// routes the address to the machine without configuring it.
+type localAddressConfig struct {
+	Interface string `yaml:"local-interface"`
+
+	// Address with the prefix length to use on the interface; defaults to
+	// the managed address
+	Address string `yaml:"local-address"`
+
+	// Add a route to the address' network via the interface, e.g. for
+	// policy routing
+	Route      bool `yaml:"local-route"`
+	RouteTable int  `yaml:"local-route-table"`
+}
+
+// localAddress is an address to be configured on a local interface
+type localAddress struct {
+	localAddressConfig
+
+	// Managed address as known to the provider
+	Managed netAddress
+
+	IP        net.IP
+	PrefixLen int
+}
+
+func (a localAddress) String() string {
+	return fmt.Sprintf("%s/%d", a.IP, a.PrefixLen)
+}
+
+func (a localAddress) network() *net.IPNet {
+	bits := 8 * len(a.IP)
+	mask := net.CIDRMask(a.PrefixLen, bits)
+
+	return &net.IPNet{IP: a.IP.Mask(mask), Mask: mask}
+}
+
+// parseLocalAddress parses the address as configured on the interface. The
+// prefix length is retained unlike with netAddress.
+func parseLocalAddress(raw string, cfg localAddressConfig) (localAddress, error) {
+	result := localAddress{localAddressConfig: cfg}
+
+	ip, ipnet, err := net.ParseCIDR(raw)
+	if err == nil {
+		result.PrefixLen, _ = ipnet.Mask.Size()
+	} else if ip = net.ParseIP(raw); ip == nil {
+		return result, fmt.Errorf("Parsing IP address %q failed", raw)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	result.IP = ip
+
+	if err != nil {
+		result.PrefixLen = 8 * len(ip)
+	}
+
+	if result.Managed, err = parseNetAddress(raw); err != nil {
+		return result, err
+	}
+
+	if cfg.Interface == "" {
+		return result, fmt.Errorf("Local address %s requires an interface", raw)
+	}
+
+	if cfg.RouteTable < 0 {
+		return result, fmt.Errorf("Invalid route table %d for local address %s", cfg.RouteTable, raw)
+	}
+
+	return result, nil
+}
+
+// localAddress returns the address to configure on a local interface for
+// the managed-addresses entry. The local address must be within the network
+// of the managed address.
+func (a managedAddress) localAddress() (localAddress, error) {
+	raw := a.Local.Address
+	if raw == "" {
+		raw = a.Address.String()
+	}
+
+	local, err := parseLocalAddress(raw, a.Local)
+	if err != nil {
+		return local, err
+	}
+
+	if local.Managed.String() != a.Address.String() {
+		return local, fmt.Errorf("Local address %s isn't within managed address %s", raw, a.Address)
+	}
+
+	return local, nil
+}
+
+// localAddresses returns the local addresses configured for any of the given
+// managed addresses
+func (c notifyConfig) localAddresses(addresses []netAddress) ([]localAddress, error) {
+	managed := map[string]bool{}
+	for _, address := range addresses {
+		managed[address.String()] = true
+	}
+
+	result := []localAddress{}
+	var errs error
+
+	for _, entry := range c.ManagedAddresses {
+		if entry.Local.Interface == "" || !managed[entry.Address.String()] {
+			continue
+		}
+
+		local, err := entry.localAddress()
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+
+		result = append(result, local)
+	}
+
+	return result, errs
+}
+
+// addLocalAddresses configures the addresses and routes on their interfaces
+func addLocalAddresses(addresses []localAddress) error {
+	var errs error
+
+	for _, address := range addresses {
+		errs = multierr.Append(errs, address.add())
+	}
+
+	return errs
+}
+
+// removeLocalAddresses removes the addresses and routes from their interfaces
+func removeLocalAddresses(addresses []localAddress) error {
+	var errs error
+
+	for _, address := range addresses {
+		errs = multierr.Append(errs, address.remove())
+	}
+
+	return errs
+}
+
+func (a localAddress) logger() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"address":   a.String(),
+		"interface": a.Interface,
+	})
+}
+
+func (a localAddress) add() error {
+	iface, err := net.InterfaceByName(a.Interface)
+	if err != nil {
+		return fmt.Errorf("Interface %q for %s: %w", a.Interface, a, err)
+	}
+
+	if err := addInterfaceAddress(iface.Index, a.IP, a.PrefixLen); err != nil {
+		return fmt.Errorf("Adding %s to interface %q: %w", a, a.Interface, err)
+	}
+
+	if a.Route {
+		if err := addInterfaceRoute(iface.Index, a.network(), a.RouteTable); err != nil {
+			return fmt.Errorf("Adding route to %s via interface %q: %w", a.network(), a.Interface, err)
+		}
+	}
+
+	a.logger().Info("Added local address")
+
+	return nil
+}
+
+func (a localAddress) remove() error {
+	iface, err := net.InterfaceByName(a.Interface)
+	if err != nil {
+		return fmt.Errorf("Interface %q for %s: %w", a.Interface, a, err)
+	}
+
+	if a.Route {
+		if err := removeInterfaceRoute(iface.Index, a.network(), a.RouteTable); err != nil {
+			return fmt.Errorf("Removing route to %s via interface %q: %w", a.network(), a.Interface, err)
+		}
+	}
+
+	if err := removeInterfaceAddress(iface.Index, a.IP, a.PrefixLen); err != nil {
+		return fmt.Errorf("Removing %s from interface %q: %w", a, a.Interface, err)
+	}
+
+	a.logger().Info("Removed local address")
+
+	return nil
+}
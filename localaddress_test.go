@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestLocalAddresses(t *testing.T) {
+	cfg := newNotifyConfig()
+	require.NoError(t, yaml.Unmarshal([]byte(`
+managed-addresses:
+  - address: 192.0.2.10
+    local-interface: lo
+    local-route: true
+    local-route-table: 100
+  - address: 192.0.2.0/24
+    local-interface: eth0
+    local-address: 192.0.2.201/24
+  - address: 2001:db8::1
+    local-interface: eth1
+  - address: 198.51.100.1
+    local-interface: eth0
+  - 2001:db8:1::/64
+`), &cfg))
+
+	local, err := cfg.localAddresses([]netAddress{
+		mustParseNetAddress("192.0.2.0/24"),
+		mustParseNetAddress("192.0.2.10"),
+		mustParseNetAddress("2001:db8::1"),
+		mustParseNetAddress("2001:db8:1::/64"),
+	})
+	require.NoError(t, err)
+
+	formatted := []string{}
+	for _, i := range local {
+		formatted = append(formatted, i.String()+" "+i.Interface)
+	}
+
+	assert.Equal(t, []string{
+		"192.0.2.10/32 lo",
+		"192.0.2.201/24 eth0",
+		"2001:db8::1/128 eth1",
+	}, formatted)
+
+	assert.True(t, local[0].Route)
+	assert.Equal(t, 100, local[0].RouteTable)
+	assert.Equal(t, "192.0.2.0/24", local[1].network().String())
+	assert.Equal(t, "192.0.2.0/24", local[1].Managed.String())
+}
+
+func TestLocalAddressesInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		err  string
+	}{
+		{
+			name: "interface",
+			data: "- address: 192.0.2.10\n  local-route: true",
+			err:  "Managed address on line 1: Local address 192.0.2.10/32 requires an interface",
+		},
+		{
+			name: "invalid",
+			data: "- address: 192.0.2.10\n  local-interface: eth0\n  local-address: invalid",
+			err:  `Managed address on line 1: Parsing IP address "invalid" failed`,
+		},
+		{
+			name: "outside",
+			data: "- address: 192.0.2.10\n  local-interface: eth0\n  local-address: 192.0.2.11",
+			err:  "Managed address on line 1: Local address 192.0.2.11 isn't within managed address 192.0.2.10/32",
+		},
+		{
+			name: "route-table",
+			data: "- address: 192.0.2.11\n  local-interface: eth0\n  local-route-table: -1",
+			err:  "Managed address on line 1: Invalid route table -1 for local address 192.0.2.11/32",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var addresses []managedAddress
+			assert.EqualError(t, yaml.Unmarshal([]byte(tc.data), &addresses), tc.err)
+		})
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"sort"
 	"syscall"
 	"time"
 
@@ -17,14 +19,18 @@ import (
 var verboseOutput bool
 var jsonLog bool
 var dryRun bool
+var jsonOutput bool
 
 var testMode bool
 var fifoMode bool
 
+// Subcommand given as first argument, if any
+var command string
+
 const (
 	envNameVerbose string = "FLOATY_LOG_VERBOSE"
 
-	flagUsage = "{ -T <config-path> | <config-path> [group|instance] <vrrp-name> <vrrp-status> <priority> | --fifo <config-path> <fifo-path> }"
+	flagUsage = "{ -T <config-path> | <config-path> [group|instance] <vrrp-name> <vrrp-status> <priority> | --fifo <config-path> <fifo-path> | { claim | release } <config-path> <address> | diff <config-path> [instance] }"
 )
 
 func init() {
@@ -35,6 +41,7 @@ func init() {
 
 	flag.BoolVar(&jsonLog, "json-log", false, "Log output in JSON format")
 	flag.BoolVar(&dryRun, "dry-run", false, "Don't make calls to a cloud provider")
+	flag.BoolVar(&jsonOutput, "json", false, "Print results of subcommands in JSON format")
 
 	for _, i := range []string{"T", "test"} {
 		flag.BoolVar(&testMode, i, false,
@@ -83,24 +90,55 @@ func main() {
 		os.Exit(2)
 	}
 
+	args := flag.Args()
+	switch args[0] {
+	case commandClaim, commandRelease:
+		command, args = args[0], args[1:]
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+	case commandDiff:
+		command, args = args[0], args[1:]
+		if len(args) < 1 || len(args) > 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
 	setupLogger()
 
-	if !testMode {
+	if !testMode && command == "" {
 		WaitForKeepalivedTermination(ctx, stop)
 		if err = configOutOfMemoryKiller(); err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	configFile := flag.Arg(0)
+	configFile := args[0]
+
+	if testMode {
+		if len(args) != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(int(runSelfTest(ctx, configFile, os.Stdout)))
+	}
+
 	cfg, err := loadConfig(configFile, dryRun)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	switch {
-	case testMode:
-		err = testProvider(ctx, cfg)
+	case command == commandClaim, command == commandRelease:
+		err = runManualChange(ctx, cfg, command, args[1], os.Stdout)
+	case command == commandDiff:
+		instance := ""
+		if len(args) > 1 {
+			instance = args[1]
+		}
+		err = runDiff(ctx, cfg, instance, jsonOutput, os.Stdout)
 	case fifoMode:
 		err = runFifo(ctx, cfg)
 	default:
@@ -184,26 +222,70 @@ func runNotify(ctx context.Context, cfg notifyConfig) error {
 		}
 	}()
 
-	provider, err := cfg.NewProvider(ctx)
+	if notification.Status != NotificationMaster {
+		// Don't keep the addresses if the provider can't be set up, the new
+		// MASTER adds them in any case. The provider is only needed to
+		// recover from being reported as unhealthy.
+		return leaveMaster(ctx, cfg, notification, cfg.NewProvider)
+	}
+
+	provider, err := setUpProvider(ctx, cfg, notification.Instance, cfg.NewProvider)
 	if err != nil {
 		return err
 	}
 	return handleNotification(ctx, provider, cfg, notification)
 }
 
-func testProvider(ctx context.Context, cfg notifyConfig) error {
+// runSelfTest writes a report on configuration and API access in the Nagios
+// plugin format or as JSON and returns the overall status
+func runSelfTest(ctx context.Context, configFile string, out io.Writer) checkStatus {
 	logrus.Info("Running self-test")
-	if flag.NArg() != 1 {
-		flag.Usage()
-		os.Exit(2)
+
+	report := &selfTestReport{}
+
+	cfg, err := loadConfig(configFile, dryRun)
+	if err != nil {
+		report.Add("configuration", checkCritical, "Loading configuration failed: %s", err)
+	} else {
+		testProvider(ctx, cfg, report)
 	}
 
-	provider, err := cfg.NewProvider(ctx)
+	if jsonOutput {
+		err = report.WriteJSON(out)
+	} else {
+		err = report.WriteNagios(out, cfg.SelfTest)
+	}
 	if err != nil {
-		return err
+		logrus.Errorf("Writing self-test report failed: %s", err)
+		return checkUnknown
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	return report.Status()
+}
+
+func testProvider(ctx context.Context, cfg notifyConfig, report *selfTestReport) {
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
 	defer cancel()
-	return provider.Test(ctx)
+
+	addresses := []netAddress{}
+	if allAddresses, err := cfg.getAllAddresses(); err == nil {
+		for _, i := range allAddresses {
+			addresses = append(addresses, i...)
+		}
+		addresses = uniqueAddresses(addresses)
+		sort.Slice(addresses, func(i, j int) bool {
+			return addresses[i].String() < addresses[j].String()
+		})
+	} else {
+		report.Add("addresses", checkUnknown, "Determining managed addresses failed: %s", err)
+	}
+
+	provider, err := cfg.NewProvider(ctx)
+	if err != nil {
+		report.Add("provider", checkCritical, "Setting up provider failed: %s", err)
+		return
+	}
+
+	provider.Test(ctx, addresses, cfg.SelfTest, report)
+	report.AddLatencyCheck(cfg.SelfTest)
 }
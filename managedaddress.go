@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// managedAddress is an entry of managed-addresses. It's given either as
+// a bare address or as an object with settings overriding the global ones.
+type managedAddress struct {
+	Address netAddress `yaml:"address"`
+
+	RefreshInterval time.Duration `yaml:"refresh-interval"`
+	RefreshTimeout  time.Duration `yaml:"refresh-timeout"`
+
+	// Unset values are taken from the global back-off configuration
+	BackOff *backOffConfig `yaml:"back-off"`
+
+	// Configure the address on a local interface while in MASTER status
+	Local localAddressConfig `yaml:",inline"`
+
+	// Unset values are taken from the global failure policy
+	FailurePolicy *failurePolicyConfig `yaml:"failure-policy"`
+
+	// Provider-specific options
+	Exoscale *exoscaleAddressConfig `yaml:"exoscale"`
+}
+
+func (a *managedAddress) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*a = managedAddress{}
+		return node.Decode(&a.Address)
+	}
+
+	// Decoding the node directly would accept unknown fields
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+
+	type plain managedAddress
+
+	result := plain{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(&result); err != nil {
+		return fmt.Errorf("Managed address on line %d: %w", node.Line, err)
+	}
+
+	if result.Address.IP == nil {
+		return fmt.Errorf("Managed address on line %d: missing address", node.Line)
+	}
+
+	*a = managedAddress(result)
+
+	if a.Local != (localAddressConfig{}) {
+		if _, err := a.localAddress(); err != nil {
+			return fmt.Errorf("Managed address on line %d: %w", node.Line, err)
+		}
+	}
+
+	return nil
+}
+
+// refreshSchedule determines how often and for how long an address is
+// refreshed. Addresses with the same schedule are refreshed together.
+type refreshSchedule struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	BackOff  backOffConfig
+}
+
+// findManagedAddress returns the managed-addresses entry for the address
+func (c notifyConfig) findManagedAddress(address netAddress) (managedAddress, bool) {
+	for _, i := range c.ManagedAddresses {
+		if i.Address.String() == address.String() {
+			return i, true
+		}
+	}
+
+	return managedAddress{}, false
+}
+
+// refreshSchedule returns the schedule of the address, taking settings of
+// the managed-addresses entry into account
+func (c notifyConfig) refreshSchedule(address netAddress) refreshSchedule {
+	result := refreshSchedule{
+		Interval: c.RefreshInterval,
+		Timeout:  c.RefreshTimeout,
+		BackOff:  c.BackOff,
+	}
+
+	entry, ok := c.findManagedAddress(address)
+	if !ok {
+		return result
+	}
+
+	if entry.RefreshInterval > 0 {
+		result.Interval = entry.RefreshInterval
+	}
+	if entry.RefreshTimeout > 0 {
+		result.Timeout = entry.RefreshTimeout
+	}
+
+	if b := entry.BackOff; b != nil {
+		if b.InitialInterval > 0 {
+			result.BackOff.InitialInterval = b.InitialInterval
+		}
+		if b.Multiplier > 0 {
+			result.BackOff.Multiplier = b.Multiplier
+		}
+		if b.MaxInterval > 0 {
+			result.BackOff.MaxInterval = b.MaxInterval
+		}
+		if b.MaxElapsedTime > 0 {
+			result.BackOff.MaxElapsedTime = b.MaxElapsedTime
+		}
+	}
+
+	return result
+}
+
+// managedNetAddresses returns the addresses of all managed-addresses entries
+func (c notifyConfig) managedNetAddresses() []netAddress {
+	result := make([]netAddress, 0, len(c.ManagedAddresses))
+
+	for _, i := range c.ManagedAddresses {
+		result = append(result, i.Address)
+	}
+
+	return result
+}
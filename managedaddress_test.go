@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestManagedAddressUnmarshal(t *testing.T) {
+	var addresses []managedAddress
+
+	err := yaml.Unmarshal([]byte(`
+- 192.0.2.1
+- address: 192.0.2.2
+  refresh-interval: 10s
+  refresh-timeout: 5s
+  back-off:
+    max-interval: 2s
+  exoscale:
+    managed-eip-mode: shared
+`), &addresses)
+	require.NoError(t, err)
+
+	assert.Equal(t, []managedAddress{
+		{Address: mustParseNetAddress("192.0.2.1")},
+		{
+			Address:         mustParseNetAddress("192.0.2.2"),
+			RefreshInterval: 10 * time.Second,
+			RefreshTimeout:  5 * time.Second,
+			BackOff:         &backOffConfig{MaxInterval: 2 * time.Second},
+			Exoscale:        &exoscaleAddressConfig{ManagedEIPMode: exoscaleManagedEIPShared},
+		},
+	}, addresses)
+}
+
+func TestManagedAddressUnmarshalErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		err  string
+	}{
+		{name: "invalid", data: "- nonsense", err: `Parsing IP address "nonsense" failed`},
+		{name: "missing", data: "- refresh-interval: 10s", err: "Managed address on line 1: missing address"},
+		{name: "unknown", data: "- address: 192.0.2.1\n  interval: 10s", err: "field interval not found"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var addresses []managedAddress
+			err := yaml.Unmarshal([]byte(tc.data), &addresses)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
+
+func TestRefreshSchedule(t *testing.T) {
+	cfg := newNotifyConfig()
+	cfg.ManagedAddresses = []managedAddress{
+		{Address: mustParseNetAddress("192.0.2.1")},
+		{
+			Address:         mustParseNetAddress("192.0.2.2"),
+			RefreshInterval: 10 * time.Second,
+			BackOff:         &backOffConfig{MaxInterval: 2 * time.Second},
+		},
+	}
+
+	global := refreshSchedule{
+		Interval: cfg.RefreshInterval,
+		Timeout:  cfg.RefreshTimeout,
+		BackOff:  cfg.BackOff,
+	}
+
+	assert.Equal(t, global, cfg.refreshSchedule(mustParseNetAddress("192.0.2.1")))
+	assert.Equal(t, global, cfg.refreshSchedule(mustParseNetAddress("198.51.100.1")))
+
+	expected := global
+	expected.Interval = 10 * time.Second
+	expected.BackOff.MaxInterval = 2 * time.Second
+	assert.Equal(t, expected, cfg.refreshSchedule(mustParseNetAddress("192.0.2.2")))
+}
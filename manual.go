@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	commandClaim   = "claim"
+	commandRelease = "release"
+)
+
+// runManualChange routes an address to this machine or away from it once.
+// The locks of all VRRP instances managing the address are held during the
+// change, terminating any running refreshes for them.
+func runManualChange(ctx context.Context, cfg notifyConfig, command string, rawAddress string, out io.Writer) error {
+	address, err := parseNetAddress(rawAddress)
+	if err != nil {
+		return err
+	}
+
+	instances, err := cfg.findInstancesForAddress(address)
+	if err != nil {
+		logrus.Warningf("Determining VRRP instances for %s failed, not locking: %s", address, err)
+	} else if len(instances) == 0 {
+		logrus.Warningf("Address %s is not managed by any VRRP instance", address)
+	}
+
+	for _, instance := range instances {
+		unlock, err := acquireLock(ctx, cfg.MakeLockFilePath(instance), cfg.LockTimeout)
+		if err != nil {
+			return fmt.Errorf("Failed to acquire lock for VRRP instance %q: %w", instance, err)
+		}
+		defer func(instance string) {
+			if err := unlock(); err != nil {
+				logrus.Errorf("Unlocking VRRP instance %q failed: %s", instance, err)
+			}
+		}(instance)
+	}
+
+	provider, err := cfg.NewProvider(ctx)
+	if err != nil {
+		return err
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"address": address,
+		"command": command,
+	})
+
+	refresher, err := provider.NewElasticIPRefresher(ctx, logger, address)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
+	defer cancel()
+
+	before, err := refresher.Owners(ctx)
+	if err != nil {
+		return fmt.Errorf("Determining current destination: %w", err)
+	}
+	fmt.Fprintf(out, "%s: before: %s\n", address, formatOwners(before, provider.Identity()))
+
+	local, err := cfg.localAddresses([]netAddress{address})
+	if err != nil {
+		return err
+	}
+
+	announcer, err := newNeighborAnnouncer(cfg, []netAddress{address})
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case commandClaim:
+		var moved bool
+		if moved, err = refresher.Refresh(ctx); err == nil {
+			err = addLocalAddresses(local)
+		}
+		if err == nil && moved {
+			announcer.Announce(ctx, []netAddress{address})
+		}
+	case commandRelease:
+		if err = removeLocalAddresses(local); err == nil {
+			err = refresher.Release(ctx)
+		}
+	default:
+		err = fmt.Errorf("Unknown command %q", command)
+	}
+	if err != nil {
+		return err
+	}
+
+	after, err := refresher.Owners(ctx)
+	if err != nil {
+		return fmt.Errorf("Determining new destination: %w", err)
+	}
+	fmt.Fprintf(out, "%s: after: %s\n", address, formatOwners(after, provider.Identity()))
+
+	return nil
+}
+
+// formatOwners returns a human-readable list of owners, marking the machine
+// with the given identity
+func formatOwners(owners []string, self string) string {
+	if len(owners) == 0 {
+		return "none"
+	}
+
+	formatted := []string{}
+	for _, owner := range owners {
+		if owner == self {
+			owner += " (this node)"
+		}
+		formatted = append(formatted, owner)
+	}
+	sort.Strings(formatted)
+
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupManualTest(t *testing.T) notifyConfig {
+	dir := t.TempDir()
+
+	kd := filepath.Join(dir, "keepalived.conf")
+	require.NoError(t, os.WriteFile(kd, []byte(`
+vrrp_instance foo {
+  virtual_ipaddress {
+    192.0.2.10
+  }
+}
+vrrp_instance bar {
+  virtual_ipaddress {
+    192.0.2.11
+  }
+}
+`), 0644))
+
+	cfg := newNotifyConfig()
+	cfg.LockFileTemplate = filepath.Join(dir, "floaty.%s.lock")
+	cfg.KeepalivedConfigFile = kd
+	cfg.Provider = "fake"
+
+	return cfg
+}
+
+func TestFindInstancesForAddress(t *testing.T) {
+	cfg := setupManualTest(t)
+
+	instances, err := cfg.findInstancesForAddress(mustParseNetAddress("192.0.2.11"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bar"}, instances)
+
+	instances, err = cfg.findInstancesForAddress(mustParseNetAddress("192.0.2.99"))
+	assert.NoError(t, err)
+	assert.Empty(t, instances)
+
+	cfg.ManagedAddresses = []managedAddress{{Address: mustParseNetAddress("192.0.2.99")}}
+	instances, err = cfg.findInstancesForAddress(mustParseNetAddress("192.0.2.99"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bar", "foo"}, instances)
+}
+
+func TestManualClaim(t *testing.T) {
+	cfg := setupManualTest(t)
+
+	out := &bytes.Buffer{}
+	err := runManualChange(context.Background(), cfg, commandClaim, "192.0.2.10", out)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.10/32: before: none\n192.0.2.10/32: after: fake (this node)\n", out.String())
+}
+
+func TestManualRelease(t *testing.T) {
+	cfg := setupManualTest(t)
+
+	out := &bytes.Buffer{}
+	err := runManualChange(context.Background(), cfg, commandRelease, "192.0.2.10", out)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.10/32: before: none\n192.0.2.10/32: after: none\n", out.String())
+}
+
+func TestManualInvalidAddress(t *testing.T) {
+	cfg := setupManualTest(t)
+
+	err := runManualChange(context.Background(), cfg, commandClaim, "invalid", &bytes.Buffer{})
+	assert.Error(t, err)
+}
+
+func TestFormatOwners(t *testing.T) {
+	assert.Equal(t, "none", formatOwners(nil, "a"))
+	assert.Equal(t, "a (this node), b", formatOwners([]string{"b", "a"}, "a"))
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"time"
 
 	"github.com/gofrs/uuid"
 )
 
 const (
 	cloudscaleMetadataURL string = "http://169.254.169.254/openstack/latest/meta_data.json"
+
+	// OpenStack config drive
+	cloudscaleConfigDrive     = "/dev/disk/by-label/config-2"
+	cloudscaleConfigDriveFile = "openstack/latest/meta_data.json"
 )
 
 type cloudscaleMetadata struct {
@@ -21,20 +27,58 @@ type cloudscaleMetadata struct {
 	} `json:"meta"`
 }
 
-func findCloudscaleServerMetadata() (*cloudscaleMetadata, error) {
+func parseCloudscaleMetadata(data []byte) (*cloudscaleMetadata, error) {
+	md := &cloudscaleMetadata{}
+
+	if err := json.Unmarshal(data, md); err != nil {
+		return nil, err
+	}
+
+	return md, nil
+}
+
+func (md *cloudscaleMetadata) identity() (instanceIdentity, error) {
+	if md.Meta.CloudscaleUUID == nil {
+		return instanceIdentity{}, errors.New("Server UUID missing in metadata")
+	}
+
+	return instanceIdentity{ID: md.Meta.CloudscaleUUID.String()}, nil
+}
+
+// cloudscaleCloudInitData contains the OpenStack metadata as recorded in the
+// instance data written by cloud-init. The standardized instance ID is the
+// OpenStack instance ID which differs from the server UUID.
+type cloudscaleCloudInitData struct {
+	DS struct {
+		MetaData cloudscaleMetadata `json:"meta_data"`
+	} `json:"ds"`
+}
+
+func readCloudscaleCloudInitIdentity(path string) (instanceIdentity, error) {
+	data, err := readIdentityFile(path)
+	if err != nil {
+		return instanceIdentity{}, err
+	}
+
+	var instanceData cloudscaleCloudInitData
+
+	if err := json.Unmarshal(data, &instanceData); err != nil {
+		return instanceIdentity{}, fmt.Errorf("Parsing %s: %w", path, err)
+	}
+
+	return instanceData.DS.MetaData.identity()
+}
+
+func findCloudscaleServerMetadata(ctx context.Context, client *http.Client, metadataURL string) (*cloudscaleMetadata, error) {
 	var md *cloudscaleMetadata
 
-	req, err := http.NewRequest("GET", cloudscaleMetadataURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", metadataURL, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Add("User-Agent", newVersionInfo().HTTPUserAgent())
 
-	client := http.Client{
-		Timeout: 5 * time.Second,
-	}
-
 	fn := func() error {
 		resp, err := client.Do(req)
 		if err != nil {
@@ -51,11 +95,7 @@ func findCloudscaleServerMetadata() (*cloudscaleMetadata, error) {
 			return err
 		}
 
-		md = &cloudscaleMetadata{}
-
-		if err = json.Unmarshal(body, md); err != nil {
-			return err
-		}
+		md, err = parseCloudscaleMetadata(body)
 
 		return err
 	}
@@ -66,3 +106,46 @@ func findCloudscaleServerMetadata() (*cloudscaleMetadata, error) {
 
 	return md, nil
 }
+
+// cloudscaleIdentitySources returns the sources for the server UUID
+func cloudscaleIdentitySources(cfg identityConfig, httpCfg httpConfig, metadataURL string) map[string]identitySource {
+	configDrive := cfg.ConfigDrive
+	if configDrive == "" {
+		configDrive = cloudscaleConfigDrive
+	}
+
+	return map[string]identitySource{
+		identitySourceCloudInit: func(context.Context) (instanceIdentity, error) {
+			return readCloudscaleCloudInitIdentity(cfg.CloudInitFile)
+		},
+		identitySourceConfigDrive: func(context.Context) (instanceIdentity, error) {
+			data, err := readConfigDriveFile(configDrive, cloudscaleConfigDriveFile)
+			if err != nil {
+				return instanceIdentity{}, err
+			}
+
+			md, err := parseCloudscaleMetadata(data)
+			if err != nil {
+				return instanceIdentity{}, err
+			}
+
+			return md.identity()
+		},
+		identitySourceMetadata: func(ctx context.Context) (instanceIdentity, error) {
+			client, err := httpCfg.newMetadataClient()
+			if err != nil {
+				return instanceIdentity{}, err
+			}
+
+			md, err := findCloudscaleServerMetadata(ctx, client, metadataURL)
+			if err != nil {
+				return instanceIdentity{}, err
+			}
+
+			return md.identity()
+		},
+		identitySourceDMI: func(context.Context) (instanceIdentity, error) {
+			return readDMIIdentity(cfg.DMIFile)
+		},
+	}
+}
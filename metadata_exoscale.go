@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/exoscale/egoscale/v3/metadata"
+)
+
+// Name of the file containing the metadata on the config drive
+const exoscaleConfigDriveFile = "meta-data"
+
+func findExoscaleMetadata(ctx context.Context, client *http.Client, endpoint metadata.Endpoint) (string, error) {
+	var value string
+
+	fn := func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", metadata.URL+string(endpoint), nil)
+		if err != nil {
+			return err
+		}
+
+		req.Header.Add("User-Agent", newVersionInfo().HTTPUserAgent())
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Metadata %q: HTTP %d", endpoint, resp.StatusCode)
+		}
+
+		// Limit accepted response size
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+		if err != nil {
+			return err
+		}
+
+		value = string(body)
+
+		return nil
+	}
+
+	if err := metadataRetry(fn); err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
+
+// parseExoscaleConfigDriveMetadata parses the "key: value" lines of the
+// metadata on the config drive
+func parseExoscaleConfigDriveMetadata(data []byte) map[string]string {
+	result := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) == 2 {
+			result[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	return result
+}
+
+// exoscaleIdentitySources returns the sources for the instance ID and,
+// if needed, the zone
+func exoscaleIdentitySources(cfg identityConfig, httpCfg httpConfig, needZone bool) map[string]identitySource {
+	configDrive := cfg.ConfigDrive
+	if configDrive == "" {
+		configDrive = metadata.CdRomPath
+	}
+
+	return map[string]identitySource{
+		identitySourceCloudInit: func(context.Context) (instanceIdentity, error) {
+			return readCloudInitIdentity(cfg.CloudInitFile)
+		},
+		identitySourceConfigDrive: func(context.Context) (instanceIdentity, error) {
+			data, err := readConfigDriveFile(configDrive, exoscaleConfigDriveFile)
+			if err != nil {
+				return instanceIdentity{}, err
+			}
+
+			md := parseExoscaleConfigDriveMetadata(data)
+
+			return instanceIdentity{
+				ID:   md[string(metadata.InstanceID)],
+				Zone: md[string(metadata.AvailabilityZone)],
+			}, nil
+		},
+		identitySourceMetadata: func(ctx context.Context) (instanceIdentity, error) {
+			var result instanceIdentity
+
+			client, err := httpCfg.newMetadataClient()
+			if err != nil {
+				return instanceIdentity{}, err
+			}
+
+			if result.ID, err = findExoscaleMetadata(ctx, client, metadata.InstanceID); err != nil {
+				return instanceIdentity{}, err
+			}
+
+			if needZone {
+				if result.Zone, err = findExoscaleMetadata(ctx, client, metadata.AvailabilityZone); err != nil {
+					return instanceIdentity{}, err
+				}
+			}
+
+			return result, nil
+		},
+		identitySourceDMI: func(context.Context) (instanceIdentity, error) {
+			return readDMIIdentity(cfg.DMIFile)
+		},
+	}
+}
@@ -50,6 +50,22 @@ func (netaddr *netAddress) UnmarshalText(text []byte) error {
 	return nil
 }
 
+// uniqueAddresses returns the given addresses without duplicates, retaining
+// their order
+func uniqueAddresses(addresses []netAddress) []netAddress {
+	seen := map[string]bool{}
+	result := []netAddress{}
+
+	for _, i := range addresses {
+		if key := i.String(); !seen[key] {
+			seen[key] = true
+			result = append(result, i)
+		}
+	}
+
+	return result
+}
+
 func parseNetAddress(text string) (netAddress, error) {
 	result := netAddress{}
 
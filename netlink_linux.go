@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var netlinkSequence uint32
+
+// netlinkAttribute is a route attribute as used by rtnetlink
+type netlinkAttribute struct {
+	Type uint16
+	Data []byte
+}
+
+func netlinkAlign(length int) int {
+	return (length + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+}
+
+func encodeNetlinkMessage(msgType, flags uint16, seq uint32, header []byte, attrs []netlinkAttribute) []byte {
+	length := unix.NLMSG_HDRLEN + netlinkAlign(len(header))
+	for _, attr := range attrs {
+		length += netlinkAlign(unix.SizeofRtAttr + len(attr.Data))
+	}
+
+	buf := make([]byte, length)
+
+	binary.NativeEndian.PutUint32(buf[0:4], uint32(length))
+	binary.NativeEndian.PutUint16(buf[4:6], msgType)
+	binary.NativeEndian.PutUint16(buf[6:8], flags)
+	binary.NativeEndian.PutUint32(buf[8:12], seq)
+
+	offset := unix.NLMSG_HDRLEN
+	copy(buf[offset:], header)
+	offset += netlinkAlign(len(header))
+
+	for _, attr := range attrs {
+		binary.NativeEndian.PutUint16(buf[offset:offset+2], uint16(unix.SizeofRtAttr+len(attr.Data)))
+		binary.NativeEndian.PutUint16(buf[offset+2:offset+4], attr.Type)
+		copy(buf[offset+unix.SizeofRtAttr:], attr.Data)
+		offset += netlinkAlign(unix.SizeofRtAttr + len(attr.Data))
+	}
+
+	return buf
+}
+
+// netlinkRequest sends a single rtnetlink request and waits for the
+// acknowledgement
+func netlinkRequest(msgType, flags uint16, header []byte, attrs []netlinkAttribute) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("Opening netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("Binding netlink socket: %w", err)
+	}
+
+	seq := atomic.AddUint32(&netlinkSequence, 1)
+	msg := encodeNetlinkMessage(msgType, flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK, seq, header, attrs)
+
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("Sending netlink request: %w", err)
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("Receiving netlink response: %w", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("Parsing netlink response: %w", err)
+		}
+
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+
+			if len(m.Data) < 4 {
+				return errors.New("Truncated netlink response")
+			}
+
+			if code := int32(binary.NativeEndian.Uint32(m.Data[0:4])); code != 0 {
+				return unix.Errno(-code)
+			}
+
+			return nil
+		}
+	}
+}
+
+func netlinkFamily(ip net.IP) (uint8, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return unix.AF_INET, ip4
+	}
+	return unix.AF_INET6, ip.To16()
+}
+
+func netlinkAddressRequest(msgType, flags uint16, ifIndex int, ip net.IP, prefixLen int) error {
+	family, ip := netlinkFamily(ip)
+
+	header := make([]byte, unix.SizeofIfAddrmsg)
+	header[0] = family
+	header[1] = uint8(prefixLen)
+	header[3] = unix.RT_SCOPE_UNIVERSE
+	binary.NativeEndian.PutUint32(header[4:8], uint32(ifIndex))
+
+	return netlinkRequest(msgType, flags, header, []netlinkAttribute{
+		{Type: unix.IFA_LOCAL, Data: ip},
+		{Type: unix.IFA_ADDRESS, Data: ip},
+	})
+}
+
+func netlinkRouteRequest(msgType, flags uint16, ifIndex int, dst *net.IPNet, table int) error {
+	family, ip := netlinkFamily(dst.IP)
+	prefixLen, _ := dst.Mask.Size()
+
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+
+	header := make([]byte, unix.SizeofRtMsg)
+	header[0] = family
+	header[1] = uint8(prefixLen)
+	header[5] = unix.RTPROT_BOOT
+	header[6] = unix.RT_SCOPE_LINK
+	header[7] = unix.RTN_UNICAST
+
+	if table < 256 {
+		header[4] = uint8(table)
+	} else {
+		header[4] = unix.RT_TABLE_UNSPEC
+	}
+
+	oif := make([]byte, 4)
+	binary.NativeEndian.PutUint32(oif, uint32(ifIndex))
+
+	tableID := make([]byte, 4)
+	binary.NativeEndian.PutUint32(tableID, uint32(table))
+
+	return netlinkRequest(msgType, flags, header, []netlinkAttribute{
+		{Type: unix.RTA_DST, Data: ip.Mask(dst.Mask)},
+		{Type: unix.RTA_OIF, Data: oif},
+		{Type: unix.RTA_TABLE, Data: tableID},
+	})
+}
+
+// addInterfaceAddress adds the address to the interface. An existing
+// address is not an error.
+func addInterfaceAddress(ifIndex int, ip net.IP, prefixLen int) error {
+	err := netlinkAddressRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifIndex, ip, prefixLen)
+	if errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+	return err
+}
+
+// removeInterfaceAddress removes the address from the interface. A missing
+// address is not an error.
+func removeInterfaceAddress(ifIndex int, ip net.IP, prefixLen int) error {
+	err := netlinkAddressRequest(unix.RTM_DELADDR, 0, ifIndex, ip, prefixLen)
+	if errors.Is(err, unix.EADDRNOTAVAIL) {
+		return nil
+	}
+	return err
+}
+
+// addInterfaceRoute adds or replaces a link-scope route via the interface
+func addInterfaceRoute(ifIndex int, dst *net.IPNet, table int) error {
+	return netlinkRouteRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, ifIndex, dst, table)
+}
+
+// removeInterfaceRoute removes the route. A missing route is not an error.
+func removeInterfaceRoute(ifIndex int, dst *net.IPNet, table int) error {
+	err := netlinkRouteRequest(unix.RTM_DELROUTE, 0, ifIndex, dst, table)
+	if errors.Is(err, unix.ESRCH) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// enterNetworkNamespace moves the test into a new network namespace with the
+// loopback interface up. The test is skipped without the required
+// privileges.
+func enterNetworkNamespace(t *testing.T) {
+	t.Helper()
+
+	// The thread is discarded when the test ends as it's never unlocked
+	runtime.LockOSThread()
+
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("Creating network namespace failed: %s", err)
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq("lo")
+	require.NoError(t, err)
+
+	ifr.SetUint16(unix.IFF_UP)
+	require.NoError(t, unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr))
+}
+
+func interfaceAddresses(t *testing.T, name string) []string {
+	iface, err := net.InterfaceByName(name)
+	require.NoError(t, err)
+
+	addrs, err := iface.Addrs()
+	require.NoError(t, err)
+
+	result := []string{}
+	for _, addr := range addrs {
+		result = append(result, addr.String())
+	}
+	return result
+}
+
+// hasMainRoute reports whether the main routing table contains a route to
+// the IPv4 address via the loopback interface
+func hasMainRoute(t *testing.T, address string) bool {
+	destination := fmt.Sprintf("%08X", binary.NativeEndian.Uint32(net.ParseIP(address).To4()))
+
+	data, err := os.ReadFile("/proc/thread-self/net/route")
+	require.NoError(t, err)
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == "lo" && fields[1] == destination {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLocalAddressNetworkNamespace(t *testing.T) {
+	enterNetworkNamespace(t)
+
+	local := []localAddress{}
+	for raw, cfg := range map[string]localAddressConfig{
+		"192.0.2.10":     {Interface: "lo", Route: true},
+		"2001:db8::1/64": {Interface: "lo"},
+	} {
+		address, err := parseLocalAddress(raw, cfg)
+		require.NoError(t, err)
+		local = append(local, address)
+	}
+
+	require.NoError(t, addLocalAddresses(local))
+
+	// Adding is idempotent
+	require.NoError(t, addLocalAddresses(local))
+
+	addrs := interfaceAddresses(t, "lo")
+	assert.Contains(t, addrs, "192.0.2.10/32")
+	assert.Contains(t, addrs, "2001:db8::1/64")
+
+	assert.True(t, hasMainRoute(t, "192.0.2.10"))
+
+	require.NoError(t, removeLocalAddresses(local))
+
+	// Removing is idempotent
+	require.NoError(t, removeLocalAddresses(local))
+
+	addrs = interfaceAddresses(t, "lo")
+	assert.NotContains(t, addrs, "192.0.2.10/32")
+	assert.NotContains(t, addrs, "2001:db8::1/64")
+	assert.False(t, hasMainRoute(t, "192.0.2.10"))
+
+	assert.ErrorContains(t, addLocalAddresses([]localAddress{{
+		localAddressConfig: localAddressConfig{Interface: "missing0"},
+		IP:                 net.ParseIP("192.0.2.20").To4(),
+		PrefixLen:          32,
+	}}), `Interface "missing0"`)
+}
+
+func TestReleaseLocalAddresses(t *testing.T) {
+	enterNetworkNamespace(t)
+
+	cfg := newNotifyConfig()
+	cfg.ManagedAddresses = []managedAddress{{
+		Address: mustParseNetAddress("192.0.2.10"),
+		Local:   localAddressConfig{Interface: "lo"},
+	}}
+
+	local, err := cfg.localAddresses(cfg.managedNetAddresses())
+	require.NoError(t, err)
+	require.NoError(t, addLocalAddresses(local))
+	assert.Contains(t, interfaceAddresses(t, "lo"), "192.0.2.10/32")
+
+	// Leaving MASTER state doesn't need a provider
+	require.NoError(t, releaseLocalAddresses(cfg, Notification{
+		Type:     "INSTANCE",
+		Instance: "test",
+		Status:   NotificationBackup,
+	}))
+	assert.NotContains(t, interfaceAddresses(t, "lo"), "192.0.2.10/32")
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errNetlinkUnsupported = errors.New("Local interface addresses are only supported on Linux")
+
+func addInterfaceAddress(ifIndex int, ip net.IP, prefixLen int) error {
+	return errNetlinkUnsupported
+}
+
+func removeInterfaceAddress(ifIndex int, ip net.IP, prefixLen int) error {
+	return errNetlinkUnsupported
+}
+
+func addInterfaceRoute(ifIndex int, dst *net.IPNet, table int) error {
+	return errNetlinkUnsupported
+}
+
+func removeInterfaceRoute(ifIndex int, dst *net.IPNet, table int) error {
+	return errNetlinkUnsupported
+}
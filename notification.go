@@ -6,8 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/cenkalti/backoff/v4"
 	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
 )
 
 type Notification struct {
@@ -71,15 +74,105 @@ func validVRRPStatus(status string) bool {
 }
 
 func handleNotification(ctx context.Context, provider elasticIPProvider, cfg notifyConfig, notification Notification) error {
+	if notification.Status != NotificationMaster {
+		return leaveMaster(ctx, cfg, notification, func(context.Context) (elasticIPProvider, error) {
+			return provider, nil
+		})
+	}
+
 	addresses, err := cfg.getAddresses(notification.Instance)
 	if err != nil {
 		return err
 	}
 	logrus.WithField("addresses", addresses).Infof("IP addresses")
 
-	if notification.Status == NotificationMaster {
-		logrus.WithField("updating elastic IP", addresses).Infof("IP addresses")
-		return pinElasticIPs(ctx, provider, addresses, cfg)
+	local, err := cfg.localAddresses(addresses)
+	if err != nil {
+		return err
+	}
+
+	if !waitForDamping(ctx, cfg.Damping, notification.Instance) {
+		return nil
+	}
+
+	if err := addLocalAddresses(local); err != nil {
+		// The addresses must still be routed to this machine
+		logrus.Errorf("Configuring local addresses failed: %s", err)
+	}
+
+	logrus.WithField("updating elastic IP", addresses).Infof("IP addresses")
+	return pinElasticIPs(ctx, provider, notification.Instance, addresses, cfg)
+}
+
+// setUpProvider creates the provider for a VRRP instance entering MASTER
+// status. Failures are retried and count as failed refreshes of all
+// addresses, so only errors which persist or can't be fixed by retrying
+// report the instance as unhealthy.
+func setUpProvider(ctx context.Context, cfg notifyConfig, instance string,
+	newProvider func(context.Context) (elasticIPProvider, error)) (elasticIPProvider, error) {
+
+	health := newRefreshHealth(cfg.TrackFile, instance)
+
+	addresses, err := cfg.getAddresses(instance)
+	if err != nil {
+		health.SetUnhealthy(err)
+		return nil, err
+	}
+
+	var provider elasticIPProvider
+
+	err = backoff.RetryNotify(func() (err error) {
+		provider, err = newProvider(ctx)
+
+		var rejected *identityRejectedError
+		if errors.As(err, &rejected) {
+			// Another machine may do better
+			err = backoff.Permanent(err)
+		}
+
+		if err != nil {
+			results := make([]refreshResult, len(addresses))
+			for i := range results {
+				results[i].Err = err
+			}
+			health.Record(addresses, results)
+		}
+
+		return err
+	}, backoff.WithContext(cfg.BackOff.New(), ctx), func(err error, delay time.Duration) {
+		logrus.Warningf("Setting up provider failed, retrying in %s: %s", delay, err)
+	})
+	if err != nil && ctx.Err() == nil {
+		health.SetUnhealthy(err)
 	}
-	return nil
+
+	return provider, err
+}
+
+// leaveMaster removes the local addresses of a VRRP instance which is no
+// longer MASTER. If the instance is reported as unhealthy, API access is
+// checked until it's healthy again. The provider is only set up for that.
+func leaveMaster(ctx context.Context, cfg notifyConfig, notification Notification,
+	newProvider func(context.Context) (elasticIPProvider, error)) error {
+
+	err := releaseLocalAddresses(cfg, notification)
+
+	return multierr.Append(err, recoverHealth(ctx, cfg, notification.Instance, newProvider))
+}
+
+// releaseLocalAddresses removes the local addresses of a VRRP instance which
+// is no longer MASTER. It doesn't need the provider API, the addresses must
+// be removed even if the API can't be reached as the new MASTER adds them.
+func releaseLocalAddresses(cfg notifyConfig, notification Notification) error {
+	addresses, err := cfg.getAddresses(notification.Instance)
+	if err != nil {
+		return err
+	}
+
+	local, err := cfg.localAddresses(addresses)
+	if err != nil {
+		return err
+	}
+
+	return removeLocalAddresses(local)
 }
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseNotification(t *testing.T) {
@@ -37,3 +43,43 @@ func TestParseNotification(t *testing.T) {
 	t.Run("unsported group", parseTest([]string{"GROUP", "foos", "MASTER", "100"},
 		"", "", true))
 }
+
+func TestSetUpProvider(t *testing.T) {
+	cfg := newNotifyConfig()
+	cfg.TrackFile.FileTemplate = filepath.Join(t.TempDir(), "track.%s")
+	cfg.ManagedAddresses = []managedAddress{{Address: mustParseNetAddress("192.0.2.1")}}
+	cfg.BackOff.InitialInterval = time.Millisecond
+	cfg.BackOff.MaxInterval = time.Millisecond
+
+	read := func() string {
+		data, err := os.ReadFile(cfg.TrackFile.makeTrackFilePath("test"))
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	t.Run("transient", func(t *testing.T) {
+		calls := 0
+		provider, err := setUpProvider(context.Background(), cfg, "test", func(context.Context) (elasticIPProvider, error) {
+			calls++
+			if calls < cfg.TrackFile.Failures {
+				return nil, errors.New("Metadata service unavailable")
+			}
+			return newFakeNotifyConfig().NewProvider(context.Background())
+		})
+		require.NoError(t, err)
+		assert.NotNil(t, provider)
+		assert.Equal(t, cfg.TrackFile.Failures, calls)
+		assert.Equal(t, "0\n", read())
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		calls := 0
+		_, err := setUpProvider(context.Background(), cfg, "test", func(context.Context) (elasticIPProvider, error) {
+			calls++
+			return nil, &identityRejectedError{Err: errors.New("Unknown server")}
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, "1\n", read())
+	})
+}
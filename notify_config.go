@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"sort"
 	"time"
 
 	yaml "gopkg.in/yaml.v3"
@@ -27,16 +28,39 @@ type notifyConfig struct {
 
 	KeepalivedConfigFile string `yaml:"keepalived-config"`
 
-	ManagedAddresses []netAddress `yaml:"managed-addresses"`
+	ManagedAddresses []managedAddress `yaml:"managed-addresses"`
+
+	NeighborAnnouncement neighborAnnouncementConfig `yaml:"neighbor-announcement"`
+
+	Verification verificationConfig `yaml:"verification"`
+
+	Status statusConfig `yaml:"status"`
+
+	TrackFile trackFileConfig `yaml:"track-file"`
+
+	FailurePolicy failurePolicyConfig `yaml:"failure-policy"`
 
 	RefreshInterval time.Duration `yaml:"refresh-interval"`
 	RefreshTimeout  time.Duration `yaml:"refresh-timeout"`
 
 	BackOff backOffConfig `yaml:"back-off"`
 
+	Damping dampingConfig `yaml:"damping"`
+
+	PauseFile string `yaml:"pause-file"`
+
+	SelfTest selfTestConfig `yaml:"self-test"`
+
+	RateLimit rateLimitConfig `yaml:"rate-limit"`
+
+	HTTP httpConfig `yaml:"http"`
+
+	Identity identityConfig `yaml:"identity"`
+
 	Provider   string                 `yaml:"provider"`
 	Cloudscale cloudscaleNotifyConfig `yaml:"cloudscale"`
 	Exoscale   exoscaleNotifyConfig   `yaml:"exoscale"`
+	Fake       fakeNotifyConfig       `yaml:"fake"`
 }
 
 func newNotifyConfig() notifyConfig {
@@ -47,6 +71,16 @@ func newNotifyConfig() notifyConfig {
 		RefreshInterval:      defaultRefreshInterval,
 		RefreshTimeout:       defaultRefreshTimeout,
 		BackOff:              newBackOffConfig(),
+		Damping:              newDampingConfig(),
+		SelfTest:             newSelfTestConfig(),
+		RateLimit:            newRateLimitConfig(),
+		HTTP:                 newHTTPConfig(),
+		Identity:             newIdentityConfig(),
+		NeighborAnnouncement: newNeighborAnnouncementConfig(),
+		Verification:         newVerificationConfig(),
+		TrackFile:            newTrackFileConfig(),
+		FailurePolicy:        newFailurePolicyConfig(),
+		Fake:                 newFakeNotifyConfig(),
 	}
 }
 
@@ -71,13 +105,13 @@ func (c notifyConfig) NewProvider(ctx context.Context) (elasticIPProvider, error
 		return nil, errors.New("Missing provider")
 
 	case "cloudscale":
-		return c.Cloudscale.NewProvider()
+		return c.Cloudscale.NewProvider(ctx, c.Identity, c.RateLimit, c.HTTP)
 
 	case "exoscale":
-		return c.Exoscale.NewProvider(ctx)
+		return c.Exoscale.withAddresses(c.ManagedAddresses).NewProvider(ctx, c.Identity, c.RateLimit, c.HTTP)
 
 	case "fake":
-		return NewFakeProvider()
+		return c.Fake.NewProvider(ctx)
 	}
 
 	return nil, fmt.Errorf("Provider %q not supported", c.Provider)
@@ -89,11 +123,63 @@ func (c notifyConfig) MakeLockFilePath(name string) string {
 
 func (c notifyConfig) getAddresses(vrrpInstanceName string) ([]netAddress, error) {
 	if len(c.ManagedAddresses) > 0 {
-		return c.ManagedAddresses, nil
+		return c.managedNetAddresses(), nil
 	}
 	return readAddressesFromKeepalivedConfig(c.KeepalivedConfigFile, vrrpInstanceName)
 }
 
+// getAllAddresses returns the managed addresses of all VRRP instances keyed
+// by instance name. Addresses given in the configuration are reported
+// without instance name.
+func (c notifyConfig) getAllAddresses() (map[string][]netAddress, error) {
+	if len(c.ManagedAddresses) > 0 {
+		return map[string][]netAddress{"": c.managedNetAddresses()}, nil
+	}
+
+	parsed, err := parseKeepalivedConfigFile(c.KeepalivedConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string][]netAddress{}
+	for name, vrrpInstance := range parsed.vrrpInstances {
+		result[name] = vrrpInstance.Addresses
+	}
+	return result, nil
+}
+
+// findInstancesForAddress returns the names of all VRRP instances managing the
+// given address
+func (c notifyConfig) findInstancesForAddress(address netAddress) ([]string, error) {
+	parsed, err := parseKeepalivedConfigFile(c.KeepalivedConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	_, managed := c.findManagedAddress(address)
+
+	names := []string{}
+	for name, vrrpInstance := range parsed.vrrpInstances {
+		if len(c.ManagedAddresses) > 0 {
+			// Managed addresses apply to all instances
+			if managed {
+				names = append(names, name)
+			}
+			continue
+		}
+
+		for _, i := range vrrpInstance.Addresses {
+			if i.String() == address.String() {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
 func readAddressesFromKeepalivedConfig(path, vrrpInstanceName string) ([]netAddress, error) {
 	parsed, err := parseKeepalivedConfigFile(path)
 	if err != nil {
@@ -114,6 +200,9 @@ func loadConfig(path string, dryRun bool) (notifyConfig, error) {
 	if err := cfg.ReadFromYAML(path); err != nil {
 		return cfg, err
 	}
+	if err := cfg.validateFailurePolicies(); err != nil {
+		return cfg, err
+	}
 	if dryRun {
 		cfg.Provider = "fake"
 	}
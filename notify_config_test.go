@@ -1,9 +1,12 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -13,5 +16,27 @@ func TestLoadConfig(t *testing.T) {
 	assert.Equalf(t, "fake-token", cfg.Cloudscale.Token, "error parsing cloudscale token from config file")
 	managedAddr := netAddress{}
 	managedAddr.UnmarshalText([]byte("192.0.2.10"))
-	assert.Equalf(t, []netAddress{managedAddr}, cfg.ManagedAddresses, "error parsing managed addresses from config file")
+	assert.Equalf(t, []managedAddress{{Address: managedAddr}}, cfg.ManagedAddresses, "error parsing managed addresses from config file")
+}
+
+func TestLoadConfigInvalidFailurePolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "floaty.yaml")
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+provider: fake
+failure-policy:
+  action: notify
+  command: ["/usr/local/bin/page-oncall"]
+managed-addresses:
+  - address: 192.0.2.10
+    failure-policy:
+      action: circuit-breaker
+      threshold: 2
+  - address: 192.0.2.11
+    failure-policy:
+      action: panic
+`), 0644))
+
+	_, err := loadConfig(path, false)
+	assert.EqualError(t, err, `Failure policy of 192.0.2.11/32: Failure action "panic" not supported`)
 }
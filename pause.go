@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// pauseWatcher tracks a maintenance file. While the file exists no changes
+// must be made via the provider API. A nil watcher is never paused.
+type pauseWatcher struct {
+	path string
+
+	mu      sync.Mutex
+	resumed chan struct{}
+}
+
+// newPauseWatcher returns a watcher for the given path or nil if no path is
+// configured. The watcher stops when the context is cancelled.
+func newPauseWatcher(ctx context.Context, path string) *pauseWatcher {
+	if path == "" {
+		return nil
+	}
+
+	w := &pauseWatcher{
+		path:    filepath.Clean(path),
+		resumed: make(chan struct{}),
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		// Watch the directory as the file itself comes and goes
+		err = watcher.Add(filepath.Dir(w.path))
+		if err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		logrus.Warningf("Watching pause file %q failed, resuming only on next refresh: %s", w.path, err)
+		return w
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-watcher.Errors:
+				logrus.Warningf("Watching pause file %q: %s", w.path, err)
+			case e := <-watcher.Events:
+				if filepath.Clean(e.Name) != w.path {
+					continue
+				}
+				if e.Has(fsnotify.Remove) || e.Has(fsnotify.Rename) {
+					logrus.WithField("pause-file", w.path).Info("Pause file removed, resuming")
+					w.notifyResumed()
+				}
+			}
+		}
+	}()
+
+	return w
+}
+
+// Paused reports whether the pause file currently exists
+func (w *pauseWatcher) Paused() bool {
+	if w == nil {
+		return false
+	}
+
+	_, err := os.Stat(w.path)
+	return err == nil
+}
+
+// Resumed returns a channel which is closed the next time the pause file is
+// removed
+func (w *pauseWatcher) Resumed() <-chan struct{} {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.resumed
+}
+
+func (w *pauseWatcher) notifyResumed() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	close(w.resumed)
+	w.resumed = make(chan struct{})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPauseWatcherDisabled(t *testing.T) {
+	w := newPauseWatcher(context.Background(), "")
+	assert.Nil(t, w)
+	assert.False(t, w.Paused())
+	assert.Nil(t, w.Resumed())
+}
+
+func TestPauseWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "pause")
+
+	w := newPauseWatcher(ctx, path)
+	require.NotNil(t, w)
+	assert.False(t, w.Paused())
+
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	assert.True(t, w.Paused())
+
+	resumed := w.Resumed()
+	require.NoError(t, os.Remove(path))
+
+	select {
+	case <-resumed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Removing pause file did not resume")
+	}
+
+	assert.False(t, w.Paused())
+	assert.NotEqual(t, resumed, w.Resumed())
+}
+
+func TestPausedRefresher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "pause")
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+
+	addr := mustParseNetAddress("192.0.2.1")
+	provider := &fakeElasticIPProvider{refreshCounter: map[string]int{}}
+	cfg := notifyConfig{
+		RefreshInterval: time.Hour,
+		RefreshTimeout:  time.Second,
+		BackOff:         newBackOffConfig(),
+		PauseFile:       path,
+	}
+
+	go func() {
+		assert.NoError(t, pinElasticIPs(ctx, provider, "test", []netAddress{addr}, cfg))
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	provider.mu.Lock()
+	assert.Equal(t, 0, provider.refreshCounter[addr.String()])
+	provider.mu.Unlock()
+
+	// Refresh happens immediately after resuming despite the long interval
+	require.NoError(t, os.Remove(path))
+	require.Eventually(t, func() bool {
+		provider.mu.Lock()
+		defer provider.mu.Unlock()
+		return provider.refreshCounter[addr.String()] > 0
+	}, 5*time.Second, 50*time.Millisecond, "Refresh not resumed")
+}
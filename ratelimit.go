@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRateLimitRate        = 5
+	defaultRateLimitBurst       = 20
+	defaultRateLimitConcurrency = 4
+
+	// Retry-After values are limited to avoid stalling for too long on
+	// bogus responses
+	maxRetryAfter = 5 * time.Minute
+)
+
+type rateLimitConfig struct {
+	Rate        float64 `yaml:"rate"`
+	Burst       int     `yaml:"burst"`
+	Concurrency int     `yaml:"concurrency"`
+}
+
+func newRateLimitConfig() rateLimitConfig {
+	return rateLimitConfig{
+		Rate:        defaultRateLimitRate,
+		Burst:       defaultRateLimitBurst,
+		Concurrency: defaultRateLimitConcurrency,
+	}
+}
+
+// retryAfterError is returned for API responses asking to retry requests
+// later, e.g. due to rate limiting
+type retryAfterError struct {
+	StatusCode int
+	Delay      time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("HTTP %d %s, retry after %s", e.StatusCode,
+		http.StatusText(e.StatusCode), e.Delay)
+}
+
+// parseRetryAfter parses the value of a Retry-After header which is either
+// a number of seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	var delay time.Duration
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = date.Sub(now)
+	} else {
+		return 0, false
+	}
+
+	if delay < 0 {
+		delay = 0
+	} else if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+
+	return delay, true
+}
+
+// tokenBucket allows requests at a steady rate with bursts of up to the
+// bucket size. It's safe for concurrent use.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// reserve takes a token and returns how long to wait before it may be used
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel returns a reserved, but unused token
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens++
+}
+
+// Wait blocks until a request may be made or the context is cancelled
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	delay := b.reserve(time.Now())
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// rateLimitedTransport schedules all API requests of a provider. The number
+// of requests is limited by a token bucket, the number of concurrent requests
+// by a fixed number of slots. When the API asks to retry later all requests
+// are held back until then.
+type rateLimitedTransport struct {
+	next   http.RoundTripper
+	bucket *tokenBucket
+	slots  chan struct{}
+
+	mu           sync.Mutex
+	blockedUntil time.Time
+}
+
+// newRateLimitedTransport wraps the given transport, or the default transport
+// if nil. Zero values in the configuration disable the respective limit.
+func newRateLimitedTransport(cfg rateLimitConfig, next http.RoundTripper) *rateLimitedTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &rateLimitedTransport{
+		next: next,
+	}
+
+	if cfg.Rate > 0 {
+		t.bucket = newTokenBucket(cfg.Rate, cfg.Burst)
+	}
+
+	if cfg.Concurrency > 0 {
+		t.slots = make(chan struct{}, cfg.Concurrency)
+	}
+
+	return t
+}
+
+func (t *rateLimitedTransport) block(until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if until.After(t.blockedUntil) {
+		t.blockedUntil = until
+	}
+}
+
+// waitUntilUnblocked waits for a previously requested Retry-After delay
+func (t *rateLimitedTransport) waitUntilUnblocked(ctx context.Context) error {
+	t.mu.Lock()
+	delay := time.Until(t.blockedUntil)
+	t.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	if t.slots != nil {
+		select {
+		case t.slots <- struct{}{}:
+			defer func() { <-t.slots }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if err := t.waitUntilUnblocked(ctx); err != nil {
+		return nil, err
+	}
+
+	if t.bucket != nil {
+		if err := t.bucket.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	retryAfter, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+
+	if resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode == http.StatusServiceUnavailable && hasRetryAfter) {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		logrus.WithFields(logrus.Fields{
+			"url":         req.URL.Redacted(),
+			"status":      resp.StatusCode,
+			"retry-after": retryAfter,
+		}).Warning("API asked to retry later")
+
+		t.block(time.Now().Add(retryAfter))
+
+		return nil, &retryAfterError{
+			StatusCode: resp.StatusCode,
+			Delay:      retryAfter,
+		}
+	}
+
+	return resp, nil
+}
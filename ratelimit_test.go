@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, tc := range []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"invalid", 0, false},
+		{"0", 0, true},
+		{"30", 30 * time.Second, true},
+		{"-5", 0, true},
+		{"86400", maxRetryAfter, true},
+		{"Tue, 02 Jan 2024 03:05:05 GMT", 1 * time.Minute, true},
+		{"Tue, 02 Jan 2024 03:00:00 GMT", 0, true},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			delay, ok := parseRetryAfter(tc.value, now)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.expected, delay)
+		})
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 3)
+	now := time.Now()
+
+	// Burst
+	for i := 0; i < 3; i++ {
+		assert.Zero(t, b.reserve(now))
+	}
+
+	// Steady rate
+	assert.Equal(t, 500*time.Millisecond, b.reserve(now))
+	assert.Equal(t, 1*time.Second, b.reserve(now))
+
+	b.cancel()
+	assert.Equal(t, 1*time.Second, b.reserve(now))
+
+	// Refill
+	assert.Zero(t, b.reserve(now.Add(2*time.Second)))
+}
+
+func TestTokenBucketWaitCancelled(t *testing.T) {
+	b := newTokenBucket(0.001, 1)
+	assert.NoError(t, b.Wait(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, b.Wait(ctx), context.DeadlineExceeded)
+}
+
+func TestRateLimitedTransportRetryAfter(t *testing.T) {
+	var calls int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: newRateLimitedTransport(rateLimitConfig{}, nil),
+	}
+
+	_, err := client.Get(server.URL)
+
+	var retryAfter *retryAfterError
+	require.True(t, errors.As(err, &retryAfter))
+	assert.Equal(t, http.StatusTooManyRequests, retryAfter.StatusCode)
+	assert.Equal(t, 1*time.Second, retryAfter.Delay)
+
+	// Further requests are held back
+	start := time.Now()
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
+
+func TestRateLimitedTransportUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: newRateLimitedTransport(rateLimitConfig{}, nil),
+	}
+
+	// Without Retry-After the response is passed on
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestRateLimitedTransportConcurrency(t *testing.T) {
+	var current, highest int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&current, 1)
+		defer atomic.AddInt32(&current, -1)
+
+		for {
+			prev := atomic.LoadInt32(&highest)
+			if n <= prev || atomic.CompareAndSwapInt32(&highest, prev, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: newRateLimitedTransport(rateLimitConfig{Concurrency: 2}, nil),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := client.Get(server.URL)
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 2, highest)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -9,9 +10,13 @@ import (
 )
 
 // loopWithRetries calls a function repeately until context is cancelled; in
-// case of a failure retries are scheduled using the given back-off algorithm
+// case of a failure retries are scheduled using the given back-off algorithm.
+// The optional wakeup function returns a channel which, when closed, causes
+// the function to be called immediately. Delays requested by the API via
+// retryAfterError are honoured.
 func loopWithRetries(ctx context.Context, logger logrus.FieldLogger,
 	delay time.Duration, retryBackOff backoff.BackOff,
+	wakeup func() <-chan struct{},
 	fn func(context.Context) error) error {
 	const maxInitialInterval = 10 * time.Second
 	var pending bool
@@ -30,15 +35,27 @@ func loopWithRetries(ctx context.Context, logger logrus.FieldLogger,
 	normalBackOff.Reset()
 
 	for {
+		var wake <-chan struct{}
+		if wakeup != nil {
+			wake = wakeup()
+		}
+
+		var retryAfter time.Duration
+
 		if err := fn(ctx); err == nil {
 			pending = false
 		} else {
 			if permanent, ok := err.(*backoff.PermanentError); ok {
-				logger.Debugf("Giving up on retries due to permanent error: %s", permanent.Err)
+				logger.Errorf("Giving up on retries due to permanent error: %s", permanent.Err)
 				pending = false
 			} else {
 				logger.Debugf("Operation failed: %s", err)
 
+				var rateLimited *retryAfterError
+				if errors.As(err, &rateLimited) {
+					retryAfter = rateLimited.Delay
+				}
+
 				if !pending {
 					// Start with retries
 					pending = true
@@ -62,13 +79,17 @@ func loopWithRetries(ctx context.Context, logger logrus.FieldLogger,
 
 		if pending {
 			if next := retryBackOff.NextBackOff(); next == backoff.Stop {
-				logger.Debug("Giving up on retries")
+				logger.Warningf("Giving up on retries, continuing every %s", delay)
 				pending = false
 			} else {
 				timerDuration = next
 			}
 		}
 
+		if timerDuration < retryAfter {
+			timerDuration = retryAfter
+		}
+
 		logger.Debugf("Sleeping for %s", timerDuration)
 
 		timer := time.NewTimer(timerDuration)
@@ -79,6 +100,10 @@ func loopWithRetries(ctx context.Context, logger logrus.FieldLogger,
 			return ctx.Err()
 
 		case <-timer.C:
+
+		case <-wake:
+			timer.Stop()
+			logger.Debug("Woken up")
 		}
 	}
 }
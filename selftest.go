@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSelfTestLatencyWarning  = 2 * time.Second
+	defaultSelfTestLatencyCritical = 5 * time.Second
+)
+
+type selfTestConfig struct {
+	LatencyWarning  time.Duration `yaml:"latency-warning"`
+	LatencyCritical time.Duration `yaml:"latency-critical"`
+
+	// Verify write access with an update without changes. Disabled by
+	// default as every run modifies the account.
+	CheckWritePermission bool `yaml:"check-write-permission"`
+}
+
+func newSelfTestConfig() selfTestConfig {
+	return selfTestConfig{
+		LatencyWarning:  defaultSelfTestLatencyWarning,
+		LatencyCritical: defaultSelfTestLatencyCritical,
+	}
+}
+
+// checkStatus values are the exit codes defined for Nagios plugins
+type checkStatus int
+
+const (
+	checkOK checkStatus = iota
+	checkWarning
+	checkCritical
+	checkUnknown
+)
+
+func (s checkStatus) String() string {
+	switch s {
+	case checkOK:
+		return "OK"
+	case checkWarning:
+		return "WARNING"
+	case checkCritical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
+
+func (s checkStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// severity orders states from best to worst
+func (s checkStatus) severity() int {
+	switch s {
+	case checkOK:
+		return 0
+	case checkUnknown:
+		return 1
+	case checkWarning:
+		return 2
+	}
+	return 3
+}
+
+type selfTestCheck struct {
+	Name    string      `json:"name"`
+	Status  checkStatus `json:"status"`
+	Message string      `json:"message"`
+}
+
+// selfTestReport collects the results of individual checks. It's safe for
+// concurrent use.
+type selfTestReport struct {
+	mu         sync.Mutex
+	checks     []selfTestCheck
+	maxLatency time.Duration
+	apiCalls   int
+}
+
+func (r *selfTestReport) Add(name string, status checkStatus, format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.checks = append(r.checks, selfTestCheck{
+		Name:    name,
+		Status:  status,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Time calls the given function and records how long it took as API
+// latency
+func (r *selfTestReport) Time(fn func() error) error {
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.apiCalls++
+	if elapsed > r.maxLatency {
+		r.maxLatency = elapsed
+	}
+
+	return err
+}
+
+// AddLatencyCheck adds a check comparing the highest observed API latency to
+// the configured thresholds
+func (r *selfTestReport) AddLatencyCheck(cfg selfTestConfig) {
+	r.mu.Lock()
+	calls, latency := r.apiCalls, r.maxLatency
+	r.mu.Unlock()
+
+	if calls == 0 {
+		r.Add("api-latency", checkUnknown, "No API calls made")
+		return
+	}
+
+	status := checkOK
+	if cfg.LatencyCritical > 0 && latency >= cfg.LatencyCritical {
+		status = checkCritical
+	} else if cfg.LatencyWarning > 0 && latency >= cfg.LatencyWarning {
+		status = checkWarning
+	}
+
+	r.Add("api-latency", status, "Slowest of %d API calls took %s", calls, latency.Round(time.Millisecond))
+}
+
+func (r *selfTestReport) Checks() []selfTestCheck {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]selfTestCheck{}, r.checks...)
+}
+
+// Status returns the worst status of all checks
+func (r *selfTestReport) Status() checkStatus {
+	checks := r.Checks()
+
+	if len(checks) == 0 {
+		return checkUnknown
+	}
+
+	result := checkOK
+	for _, c := range checks {
+		if c.Status.severity() > result.severity() {
+			result = c.Status
+		}
+	}
+	return result
+}
+
+func (r *selfTestReport) perfdata(cfg selfTestConfig) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	failed := 0
+	for _, c := range r.checks {
+		if c.Status != checkOK {
+			failed++
+		}
+	}
+
+	return fmt.Sprintf("api_latency=%.3fs;%.3f;%.3f;0 api_calls=%d;;;0 checks_failed=%d;;;0",
+		r.maxLatency.Seconds(), cfg.LatencyWarning.Seconds(),
+		cfg.LatencyCritical.Seconds(), r.apiCalls, failed)
+}
+
+// WriteNagios writes the report in the Nagios plugin output format: a
+// summary with performance data followed by one line per check
+func (r *selfTestReport) WriteNagios(w io.Writer, cfg selfTestConfig) error {
+	status := r.Status()
+	checks := r.Checks()
+
+	problems := []string{}
+	for _, c := range checks {
+		if c.Status != checkOK {
+			problems = append(problems, fmt.Sprintf("%s: %s", c.Name, c.Message))
+		}
+	}
+
+	summary := fmt.Sprintf("%d checks passed", len(checks))
+	if len(problems) > 0 {
+		summary = strings.Join(problems, "; ")
+	}
+
+	// The pipe character separates performance data
+	sanitize := strings.NewReplacer("|", "/", "\n", " ")
+
+	if _, err := fmt.Fprintf(w, "FLOATY %s - %s | %s\n", status, sanitize.Replace(summary), r.perfdata(cfg)); err != nil {
+		return err
+	}
+
+	for _, c := range checks {
+		if _, err := fmt.Fprintf(w, "[%s] %s: %s\n", c.Status, c.Name, sanitize.Replace(c.Message)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *selfTestReport) WriteJSON(w io.Writer) error {
+	r.mu.Lock()
+	latency, calls := r.maxLatency, r.apiCalls
+	r.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(struct {
+		Status            checkStatus     `json:"status"`
+		Checks            []selfTestCheck `json:"checks"`
+		APICalls          int             `json:"api-calls"`
+		APILatencySeconds float64         `json:"api-latency-seconds"`
+	}{
+		Status:            r.Status(),
+		Checks:            r.Checks(),
+		APICalls:          calls,
+		APILatencySeconds: latency.Seconds(),
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTestReportStatus(t *testing.T) {
+	report := &selfTestReport{}
+	assert.Equal(t, checkUnknown, report.Status())
+
+	report.Add("a", checkOK, "fine")
+	assert.Equal(t, checkOK, report.Status())
+
+	report.Add("b", checkUnknown, "unsure")
+	assert.Equal(t, checkUnknown, report.Status())
+
+	report.Add("c", checkWarning, "hmm")
+	assert.Equal(t, checkWarning, report.Status())
+
+	report.Add("d", checkCritical, "broken")
+	report.Add("e", checkOK, "fine")
+	assert.Equal(t, checkCritical, report.Status())
+}
+
+func TestSelfTestLatencyCheck(t *testing.T) {
+	cfg := selfTestConfig{
+		LatencyWarning:  10 * time.Millisecond,
+		LatencyCritical: time.Hour,
+	}
+
+	report := &selfTestReport{}
+	report.AddLatencyCheck(cfg)
+	assert.Equal(t, checkUnknown, report.Status())
+
+	report = &selfTestReport{}
+	report.Time(func() error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+	report.AddLatencyCheck(cfg)
+	assert.Equal(t, checkWarning, report.Status())
+}
+
+func TestSelfTestNagiosOutput(t *testing.T) {
+	report := &selfTestReport{}
+	report.Add("credentials", checkOK, "Listed 3 floating IPs")
+	report.Add("address 192.0.2.1/32", checkCritical, "Floating IP | does not exist")
+
+	out := &bytes.Buffer{}
+	require.NoError(t, report.WriteNagios(out, newSelfTestConfig()))
+	assert.Equal(t, `FLOATY CRITICAL - address 192.0.2.1/32: Floating IP / does not exist | api_latency=0.000s;2.000;5.000;0 api_calls=0;;;0 checks_failed=1;;;0
+[OK] credentials: Listed 3 floating IPs
+[CRITICAL] address 192.0.2.1/32: Floating IP / does not exist
+`, out.String())
+}
+
+func TestSelfTestJSONOutput(t *testing.T) {
+	report := &selfTestReport{}
+	report.Add("credentials", checkOK, "Listed 3 floating IPs")
+
+	out := &bytes.Buffer{}
+	require.NoError(t, report.WriteJSON(out))
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, "OK", decoded["status"])
+	assert.Len(t, decoded["checks"], 1)
+}
+
+func TestSelfTestFakeProvider(t *testing.T) {
+	cfg := newNotifyConfig()
+	cfg.Provider = "fake"
+	cfg.ManagedAddresses = []managedAddress{
+		{Address: mustParseNetAddress("192.0.2.1")},
+		{Address: mustParseNetAddress("192.0.2.1")},
+	}
+
+	report := &selfTestReport{}
+	testProvider(context.Background(), cfg, report)
+	assert.Equal(t, checkOK, report.Status())
+
+	names := []string{}
+	for _, c := range report.Checks() {
+		names = append(names, c.Name)
+	}
+	assert.Equal(t, []string{"credentials", "address 192.0.2.1/32", "api-latency"}, names)
+}
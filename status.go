@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	verificationPending   = "pending"
+	verificationVerifying = "verifying"
+	verificationVerified  = "verified"
+	verificationFailed    = "failed"
+)
+
+// statusConfig controls where the state of refreshed addresses is exposed.
+// Both files are disabled by default.
+type statusConfig struct {
+	// JSON status file per VRRP instance
+	FileTemplate string `yaml:"file-template"`
+
+	// Metrics per VRRP instance in the format of the node exporter's
+	// textfile collector
+	MetricsFileTemplate string `yaml:"metrics-file-template"`
+}
+
+func makeStatusFilePath(template, name string) string {
+	if template == "" {
+		return ""
+	}
+	return fmt.Sprintf(template, url.PathEscape(name))
+}
+
+// verificationStatus is the outcome of the most recent reachability
+// verification of an address
+type verificationStatus struct {
+	State   string    `json:"state"`
+	Probe   string    `json:"probe"`
+	Checked time.Time `json:"checked"`
+	Error   string    `json:"error,omitempty"`
+
+	// Totals since floaty started refreshing the address
+	Failures int `json:"failures"`
+	Repins   int `json:"repins"`
+}
+
+type addressStatus struct {
+	Verification *verificationStatus `json:"verification,omitempty"`
+}
+
+type instanceStatus struct {
+	Instance  string                    `json:"instance,omitempty"`
+	Updated   time.Time                 `json:"updated"`
+	Addresses map[string]*addressStatus `json:"addresses"`
+}
+
+// statusRecorder keeps the status of the addresses of a VRRP instance and
+// writes it to the configured files on every change. A nil recorder does
+// nothing.
+type statusRecorder struct {
+	path        string
+	metricsPath string
+
+	mu     sync.Mutex
+	status instanceStatus
+}
+
+func newStatusRecorder(cfg statusConfig, instance string) *statusRecorder {
+	path := makeStatusFilePath(cfg.FileTemplate, instance)
+	metricsPath := makeStatusFilePath(cfg.MetricsFileTemplate, instance)
+
+	if path == "" && metricsPath == "" {
+		return nil
+	}
+
+	return &statusRecorder{
+		path:        path,
+		metricsPath: metricsPath,
+		status: instanceStatus{
+			Instance:  instance,
+			Addresses: map[string]*addressStatus{},
+		},
+	}
+}
+
+// updateVerification changes the verification status of the address and
+// writes the files
+func (s *statusRecorder) updateVerification(address netAddress, fn func(*verificationStatus)) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := address.String()
+
+	entry, ok := s.status.Addresses[key]
+	if !ok {
+		entry = &addressStatus{}
+		s.status.Addresses[key] = entry
+	}
+	if entry.Verification == nil {
+		entry.Verification = &verificationStatus{}
+	}
+
+	fn(entry.Verification)
+
+	s.status.Updated = time.Now()
+
+	s.write()
+}
+
+// write must be called with the lock held. Failures are only logged as the
+// status is informational.
+func (s *statusRecorder) write() {
+	if s.path != "" {
+		data, err := json.MarshalIndent(s.status, "", "  ")
+		if err == nil {
+			err = writeFileAtomic(s.path, append(data, '\n'), 0644)
+		}
+		if err != nil {
+			logrus.Warningf("Writing status file %q failed: %s", s.path, err)
+		}
+	}
+
+	if s.metricsPath != "" {
+		if err := writeFileAtomic(s.metricsPath, s.metrics(), 0644); err != nil {
+			logrus.Warningf("Writing metrics file %q failed: %s", s.metricsPath, err)
+		}
+	}
+}
+
+type statusMetric struct {
+	name, help, kind string
+	value            func(*verificationStatus) float64
+}
+
+var statusMetrics = []statusMetric{
+	{
+		name: "floaty_verification_success",
+		help: "Whether reachability of the address was verified after it was moved.",
+		kind: "gauge",
+		value: func(v *verificationStatus) float64 {
+			if v.State == verificationVerified {
+				return 1
+			}
+			return 0
+		},
+	},
+	{
+		name:  "floaty_verification_timestamp_seconds",
+		help:  "Time of the last reachability probe.",
+		kind:  "gauge",
+		value: func(v *verificationStatus) float64 { return float64(v.Checked.UnixMilli()) / 1000 },
+	},
+	{
+		name:  "floaty_verification_probe_failures_total",
+		help:  "Number of failed reachability probes.",
+		kind:  "counter",
+		value: func(v *verificationStatus) float64 { return float64(v.Failures) },
+	},
+	{
+		name:  "floaty_verification_repins_total",
+		help:  "Number of times the address was pinned again after failed probes.",
+		kind:  "counter",
+		value: func(v *verificationStatus) float64 { return float64(v.Repins) },
+	},
+}
+
+// metrics must be called with the lock held
+func (s *statusRecorder) metrics() []byte {
+	keys := []string{}
+	for key, entry := range s.status.Addresses {
+		if entry.Verification != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+
+	for _, metric := range statusMetrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", metric.name, metric.kind)
+
+		for _, key := range keys {
+			fmt.Fprintf(&buf, "%s{instance=%s,address=%s} %s\n", metric.name,
+				quoteLabelValue(s.status.Instance), quoteLabelValue(key),
+				strconv.FormatFloat(metric.value(s.status.Addresses[key].Verification), 'f', -1, 64))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabelValue(value string) string {
+	return `"` + labelValueReplacer.Replace(value) + `"`
+}
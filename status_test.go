@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusRecorder(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.Nil(t, newStatusRecorder(statusConfig{}, "test"))
+
+	status := newStatusRecorder(statusConfig{
+		FileTemplate:        dir + "/status.%s.json",
+		MetricsFileTemplate: dir + "/floaty.%s.prom",
+	}, `vi "1"`)
+
+	checked := time.Date(2024, 5, 6, 7, 8, 9, 500000000, time.UTC)
+
+	status.updateVerification(mustParseNetAddress("192.0.2.10"), func(s *verificationStatus) {
+		s.State = verificationVerified
+		s.Probe = verificationProbeHTTP
+		s.Checked = checked
+		s.Failures = 2
+		s.Repins = 1
+	})
+	status.updateVerification(mustParseNetAddress("2001:db8::/64"), func(s *verificationStatus) {
+		s.State = verificationFailed
+		s.Probe = verificationProbeHTTP
+		s.Checked = checked
+		s.Error = "timeout"
+		s.Failures = 3
+	})
+
+	data, err := os.ReadFile(dir + "/status.vi%20%221%22.json")
+	require.NoError(t, err)
+
+	parsed := instanceStatus{}
+	require.NoError(t, json.Unmarshal(data, &parsed))
+
+	assert.Equal(t, `vi "1"`, parsed.Instance)
+	assert.Equal(t, &verificationStatus{
+		State:    verificationFailed,
+		Probe:    verificationProbeHTTP,
+		Checked:  checked,
+		Error:    "timeout",
+		Failures: 3,
+	}, parsed.Addresses["2001:db8::/64"].Verification)
+
+	metrics, err := os.ReadFile(dir + "/floaty.vi%20%221%22.prom")
+	require.NoError(t, err)
+
+	assert.Equal(t, `# HELP floaty_verification_success Whether reachability of the address was verified after it was moved.
+# TYPE floaty_verification_success gauge
+floaty_verification_success{instance="vi \"1\"",address="192.0.2.10/32"} 1
+floaty_verification_success{instance="vi \"1\"",address="2001:db8::/64"} 0
+# HELP floaty_verification_timestamp_seconds Time of the last reachability probe.
+# TYPE floaty_verification_timestamp_seconds gauge
+floaty_verification_timestamp_seconds{instance="vi \"1\"",address="192.0.2.10/32"} 1714979289.5
+floaty_verification_timestamp_seconds{instance="vi \"1\"",address="2001:db8::/64"} 1714979289.5
+# HELP floaty_verification_probe_failures_total Number of failed reachability probes.
+# TYPE floaty_verification_probe_failures_total counter
+floaty_verification_probe_failures_total{instance="vi \"1\"",address="192.0.2.10/32"} 2
+floaty_verification_probe_failures_total{instance="vi \"1\"",address="2001:db8::/64"} 3
+# HELP floaty_verification_repins_total Number of times the address was pinned again after failed probes.
+# TYPE floaty_verification_repins_total counter
+floaty_verification_repins_total{instance="vi \"1\"",address="192.0.2.10/32"} 1
+floaty_verification_repins_total{instance="vi \"1\"",address="2001:db8::/64"} 0
+`, string(metrics))
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTrackFileUnhealthy = 1
+	defaultTrackFileFailures  = 3
+)
+
+// trackFileConfig controls the file reporting refresh health to Keepalived
+// via track_file. Keepalived can then lower the priority of this machine or
+// enter FAULT status when the addresses can't be routed here.
+type trackFileConfig struct {
+	// Disabled if empty
+	FileTemplate string `yaml:"file-template"`
+
+	// Values written to the file
+	Healthy   int `yaml:"healthy"`
+	Unhealthy int `yaml:"unhealthy"`
+
+	// Number of consecutive failed refreshes of an address after which the
+	// VRRP instance is unhealthy. Permanent errors count immediately.
+	Failures int `yaml:"failures"`
+}
+
+func newTrackFileConfig() trackFileConfig {
+	return trackFileConfig{
+		Unhealthy: defaultTrackFileUnhealthy,
+		Failures:  defaultTrackFileFailures,
+	}
+}
+
+func (cfg trackFileConfig) makeTrackFilePath(name string) string {
+	return fmt.Sprintf(cfg.FileTemplate, url.PathEscape(name))
+}
+
+// refreshHealth tracks refresh failures of a VRRP instance and writes the
+// track file whenever the health changes. A nil tracker does nothing.
+type refreshHealth struct {
+	cfg  trackFileConfig
+	path string
+
+	mu       sync.Mutex
+	failures map[string]refreshFailure
+	written  bool
+	healthy  bool
+}
+
+// refreshFailure counts consecutive failures of an address
+type refreshFailure struct {
+	Count int
+	Err   error
+}
+
+func newRefreshHealth(cfg trackFileConfig, instance string) *refreshHealth {
+	if cfg.FileTemplate == "" {
+		return nil
+	}
+
+	return &refreshHealth{
+		cfg:      cfg,
+		path:     cfg.makeTrackFilePath(instance),
+		failures: map[string]refreshFailure{},
+	}
+}
+
+// Record updates the health with the results of refreshing the addresses
+func (h *refreshHealth) Record(addresses []netAddress, results []refreshResult) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, address := range addresses {
+		key := address.String()
+		err := results[i].Err
+
+		if err == nil {
+			delete(h.failures, key)
+			continue
+		}
+
+		failure := h.failures[key]
+		failure.Count++
+		failure.Err = err
+
+		if _, ok := err.(*backoff.PermanentError); ok && failure.Count < h.cfg.Failures {
+			failure.Count = h.cfg.Failures
+		}
+
+		h.failures[key] = failure
+	}
+
+	h.update()
+}
+
+// Escalate reports the VRRP instance as unhealthy until refreshing the
+// address succeeds again, regardless of the number of failures
+func (h *refreshHealth) Escalate(address netAddress, err error) {
+	if h == nil {
+		logrus.WithField("address", address).Warning("No track file configured to report failures")
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	failure := h.failures[address.String()]
+	if failure.Count < h.cfg.Failures {
+		failure.Count = h.cfg.Failures
+	}
+	failure.Err = err
+
+	h.failures[address.String()] = failure
+
+	h.update()
+}
+
+// update must be called with the lock held
+func (h *refreshHealth) update() {
+	keys := []string{}
+	for key := range h.failures {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var reason error
+	for _, key := range keys {
+		// Addresses not refreshed this time may still be failing
+		if failure := h.failures[key]; failure.Count >= h.cfg.Failures {
+			reason = fmt.Errorf("Refreshing %s failed %d times: %w", key, failure.Count, failure.Err)
+			break
+		}
+	}
+
+	h.set(reason)
+}
+
+// SetUnhealthy reports the VRRP instance as unhealthy, e.g. because
+// refreshing couldn't even be started
+func (h *refreshHealth) SetUnhealthy(reason error) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.set(reason)
+}
+
+// set must be called with the lock held. The file is only written when the
+// health changes.
+func (h *refreshHealth) set(reason error) {
+	healthy := reason == nil
+
+	if h.written && h.healthy == healthy {
+		return
+	}
+
+	value := h.cfg.Healthy
+	if !healthy {
+		value = h.cfg.Unhealthy
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"track-file": h.path,
+		"value":      value,
+	})
+
+	if err := writeFileAtomic(h.path, []byte(fmt.Sprintf("%d\n", value)), 0644); err != nil {
+		logger.Errorf("Writing track file failed: %s", err)
+		return
+	}
+
+	h.written = true
+	h.healthy = healthy
+
+	if healthy {
+		logger.Info("Reporting refreshes as healthy to Keepalived")
+	} else {
+		logger.Warningf("Reporting refreshes as unhealthy to Keepalived: %s", reason)
+	}
+}
+
+// reportedUnhealthy reports whether the track file, possibly written by
+// another process, currently reports the VRRP instance as unhealthy
+func (h *refreshHealth) reportedUnhealthy() bool {
+	if h == nil || h.cfg.Healthy == h.cfg.Unhealthy {
+		return false
+	}
+
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return false
+	}
+
+	value, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.written = true
+	h.healthy = value != h.cfg.Unhealthy
+
+	return !h.healthy
+}
+
+// recoverHealth checks API access periodically while the VRRP instance is
+// reported as unhealthy outside of MASTER status, where no refreshes could
+// restore its health. Without it Keepalived would keep the instance in FAULT
+// status for good. The check is read-only; the instance is reported as
+// healthy once no self-test check is critical.
+func recoverHealth(ctx context.Context, cfg notifyConfig, instance string,
+	newProvider func(context.Context) (elasticIPProvider, error)) error {
+
+	health := newRefreshHealth(cfg.TrackFile, instance)
+	if !health.reportedUnhealthy() {
+		return nil
+	}
+
+	addresses, err := cfg.getAddresses(instance)
+	if err != nil {
+		return err
+	}
+
+	logger := logrus.WithField("instance", instance)
+	logger.Info("Reported as unhealthy, checking API access until it works again")
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	var provider elasticIPProvider
+
+	err = loopWithRetries(ctx, logger, cfg.RefreshInterval, cfg.BackOff.New(), nil,
+		func(ctx context.Context) error {
+			if provider == nil {
+				p, err := newProvider(ctx)
+				if err != nil {
+					return fmt.Errorf("Setting up provider: %w", err)
+				}
+				provider = p
+			}
+
+			ctxTest, cancel := context.WithTimeout(ctx, cfg.RefreshTimeout)
+			defer cancel()
+
+			report := &selfTestReport{}
+			provider.Test(ctxTest, addresses, newSelfTestConfig(), report)
+
+			for _, c := range report.Checks() {
+				if c.Status == checkCritical {
+					return fmt.Errorf("Check %s failed: %s", c.Name, c.Message)
+				}
+			}
+
+			health.SetUnhealthy(nil)
+			stop()
+
+			return nil
+		})
+	if ctx.Err() != nil {
+		// Healthy again or no longer needed
+		return nil
+	}
+
+	return err
+}
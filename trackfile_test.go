@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshHealth(t *testing.T) {
+	assert.Nil(t, newRefreshHealth(newTrackFileConfig(), "test"))
+
+	cfg := newTrackFileConfig()
+	cfg.FileTemplate = filepath.Join(t.TempDir(), "track.%s")
+	cfg.Healthy = 0
+	cfg.Unhealthy = -50
+	cfg.Failures = 2
+
+	path := cfg.makeTrackFilePath("vi 1")
+	assert.Equal(t, filepath.Join(filepath.Dir(path), "track.vi%201"), path)
+
+	h := newRefreshHealth(cfg, "vi 1")
+
+	read := func() string {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	a := mustParseNetAddress("192.0.2.1")
+	b := mustParseNetAddress("192.0.2.2")
+	failed := refreshResult{Err: errors.New("timeout")}
+
+	h.Record([]netAddress{a, b}, []refreshResult{{}, failed})
+	assert.Equal(t, "0\n", read())
+
+	// The file is only written when the health changes
+	require.NoError(t, os.Remove(path))
+	h.Record([]netAddress{a}, []refreshResult{{}})
+	assert.NoFileExists(t, path)
+
+	h.Record([]netAddress{a, b}, []refreshResult{{}, failed})
+	assert.Equal(t, "-50\n", read())
+
+	// Other addresses succeeding don't restore health
+	h.Record([]netAddress{a}, []refreshResult{{}})
+	assert.Equal(t, "-50\n", read())
+
+	h.Record([]netAddress{b}, []refreshResult{{Moved: true}})
+	assert.Equal(t, "0\n", read())
+
+	// Permanent errors count immediately
+	h.Record([]netAddress{a}, []refreshResult{{Err: backoff.Permanent(errors.New("HTTP 401"))}})
+	assert.Equal(t, "-50\n", read())
+
+	h.Record([]netAddress{a}, []refreshResult{{}})
+	assert.Equal(t, "0\n", read())
+
+	h.SetUnhealthy(errors.New("Missing token"))
+	assert.Equal(t, "-50\n", read())
+}
+
+func TestRecoverHealth(t *testing.T) {
+	cfg := newNotifyConfig()
+	cfg.TrackFile.FileTemplate = filepath.Join(t.TempDir(), "track.%s")
+	cfg.ManagedAddresses = []managedAddress{{Address: mustParseNetAddress("192.0.2.1")}}
+	cfg.RefreshInterval = time.Millisecond
+	cfg.BackOff.InitialInterval = time.Millisecond
+	cfg.BackOff.MaxInterval = time.Millisecond
+
+	path := cfg.TrackFile.makeTrackFilePath("test")
+	read := func() string {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	calls := 0
+	newProvider := func(faults fakeFaults) func(context.Context) (elasticIPProvider, error) {
+		return func(context.Context) (elasticIPProvider, error) {
+			calls++
+			if calls < 3 {
+				return nil, errors.New("Metadata service unavailable")
+			}
+
+			fake := newFakeNotifyConfig()
+			fake.Faults = faults
+			return fake.NewProvider(context.Background())
+		}
+	}
+
+	// Healthy instances don't need the provider
+	require.NoError(t, recoverHealth(context.Background(), cfg, "test", newProvider(fakeFaults{})))
+	assert.Zero(t, calls)
+
+	require.NoError(t, os.WriteFile(path, []byte("0\n"), 0644))
+	require.NoError(t, recoverHealth(context.Background(), cfg, "test", newProvider(fakeFaults{})))
+	assert.Zero(t, calls)
+
+	// Unhealthy instances are checked until no check is critical
+	require.NoError(t, os.WriteFile(path, []byte("1\n"), 0644))
+	require.NoError(t, recoverHealth(context.Background(), cfg, "test", newProvider(fakeFaults{})))
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, "0\n", read())
+
+	// Checking stops with the next notification
+	require.NoError(t, os.WriteFile(path, []byte("1\n"), 0644))
+	calls = 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.NoError(t, recoverHealth(ctx, cfg, "test", newProvider(fakeFaults{Outage: true})))
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, "1\n", read())
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	verificationProbeHTTP = "http"
+	verificationProbeTCP  = "tcp"
+	verificationProbeICMP = "icmp"
+
+	defaultVerificationDelay      = 2 * time.Second
+	defaultVerificationInterval   = 5 * time.Second
+	defaultVerificationTimeout    = 3 * time.Second
+	defaultVerificationAttempts   = 6
+	defaultVerificationRepinAfter = 3
+
+	maxVerificationResponseSize = 64 * 1024
+)
+
+// verificationConfig controls probes checking that traffic for an address
+// reaches this machine after it was moved. A successful API call doesn't
+// guarantee the provider's routing has converged.
+type verificationConfig struct {
+	// Probe type; empty disables verification
+	Probe string `yaml:"probe"`
+
+	// URL to fetch with the http probe and text the response must contain.
+	// "{address}" and "{hostname}" are replaced in both.
+	URL    string `yaml:"url"`
+	Expect string `yaml:"expect"`
+
+	// Reflector for the tcp ("host:port") and icmp ("host") probes. Probes
+	// are sent from the moved address.
+	Target string `yaml:"target"`
+
+	// Wait before the first probe and between probes
+	Delay    time.Duration `yaml:"delay"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+
+	// Maximum number of probes per move
+	Attempts int `yaml:"attempts"`
+
+	// Number of consecutive failed probes after which the address is
+	// pinned again; zero disables re-pinning
+	RepinAfter int `yaml:"repin-after"`
+}
+
+func newVerificationConfig() verificationConfig {
+	return verificationConfig{
+		Delay:      defaultVerificationDelay,
+		Interval:   defaultVerificationInterval,
+		Timeout:    defaultVerificationTimeout,
+		Attempts:   defaultVerificationAttempts,
+		RepinAfter: defaultVerificationRepinAfter,
+	}
+}
+
+// verificationProbe checks whether traffic for the given IP address
+// reaches this machine
+type verificationProbe func(ctx context.Context, ip net.IP) error
+
+func (c verificationConfig) newProbe(httpCfg httpConfig) (verificationProbe, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("Determining hostname: %w", err)
+	}
+
+	expand := func(template string, ip net.IP) string {
+		return strings.NewReplacer("{address}", ip.String(), "{hostname}", hostname).Replace(template)
+	}
+
+	switch c.Probe {
+	case verificationProbeHTTP:
+		if c.URL == "" {
+			return nil, fmt.Errorf("Verification probe %q requires a URL", c.Probe)
+		}
+
+		client, err := httpCfg.newProbeClient()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(ctx context.Context, ip net.IP) error {
+			return probeHTTP(ctx, client, expand(c.URL, ip), expand(c.Expect, ip))
+		}, nil
+
+	case verificationProbeTCP, verificationProbeICMP:
+		if c.Target == "" {
+			return nil, fmt.Errorf("Verification probe %q requires a target", c.Probe)
+		}
+
+		if c.Probe == verificationProbeTCP {
+			return func(ctx context.Context, ip net.IP) error {
+				return probeTCP(ctx, ip, expand(c.Target, ip))
+			}, nil
+		}
+
+		return func(ctx context.Context, ip net.IP) error {
+			return probeICMP(ctx, ip, expand(c.Target, ip))
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Verification probe %q not supported", c.Probe)
+}
+
+// probeHTTP fetches the URL and expects a successful response containing
+// the given text
+func probeHTTP(ctx context.Context, client *http.Client, url, expect string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxVerificationResponseSize))
+	if err != nil {
+		return fmt.Errorf("Reading response from %s: %w", url, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %d %s from %s", resp.StatusCode, http.StatusText(resp.StatusCode), url)
+	}
+
+	if !strings.Contains(string(body), expect) {
+		return fmt.Errorf("Response from %s doesn't contain %q", url, expect)
+	}
+
+	return nil
+}
+
+// probeTCP connects from the address to the target. The connection can
+// only be established if replies are routed to this machine.
+func probeTCP(ctx context.Context, ip net.IP, target string) error {
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: ip},
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// addressVerifier probes addresses after they were moved and pins them
+// again if the probes keep failing. A nil verifier does nothing.
+type addressVerifier struct {
+	cfg    verificationConfig
+	probe  verificationProbe
+	repin  func(context.Context, netAddress) error
+	status *statusRecorder
+
+	// Source IP per managed address
+	sources map[string]net.IP
+
+	mu      sync.Mutex
+	running map[string]*runningVerification
+}
+
+type runningVerification struct {
+	cancel context.CancelFunc
+}
+
+// newAddressVerifier determines the IP addresses to probe. Addresses
+// configured on a local interface are probed with their local IP, networks
+// without one aren't verified.
+func newAddressVerifier(cfg notifyConfig, addresses []netAddress, status *statusRecorder, repin func(context.Context, netAddress) error) (*addressVerifier, error) {
+	if cfg.Verification.Probe == "" {
+		return nil, nil
+	}
+
+	probe, err := cfg.Verification.newProbe(cfg.HTTP)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := cfg.localAddresses(addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &addressVerifier{
+		cfg:     cfg.Verification,
+		probe:   probe,
+		repin:   repin,
+		status:  status,
+		sources: map[string]net.IP{},
+		running: map[string]*runningVerification{},
+	}
+
+	for _, i := range local {
+		if _, ok := v.sources[i.Managed.String()]; !ok {
+			v.sources[i.Managed.String()] = i.IP
+		}
+	}
+
+	for _, address := range addresses {
+		if _, ok := v.sources[address.String()]; ok {
+			continue
+		}
+
+		if ones, bits := address.Mask.Size(); ones != bits {
+			logrus.WithField("address", address).Debug("Not verifying network address")
+			continue
+		}
+
+		v.sources[address.String()] = address.IP
+	}
+
+	// Verifications are cancelled when the address moves again
+	for _, address := range addresses {
+		if _, ok := v.sources[address.String()]; !ok {
+			continue
+		}
+
+		if interval := cfg.refreshSchedule(address).Interval; v.cfg.duration() > interval {
+			logrus.WithField("address", address).Warningf(
+				"Verification may take up to %s, longer than the refresh interval of %s",
+				v.cfg.duration(), interval)
+		}
+	}
+
+	return v, nil
+}
+
+// duration returns how long a verification takes at most if all probes fail
+func (c verificationConfig) duration() time.Duration {
+	if c.Attempts < 1 {
+		return 0
+	}
+
+	return c.Delay + time.Duration(c.Attempts-1)*c.Interval + time.Duration(c.Attempts)*c.Timeout
+}
+
+// Verify probes the address until a probe succeeds or the attempts are
+// exhausted. A verification still running for the address is cancelled.
+func (v *addressVerifier) Verify(ctx context.Context, address netAddress) {
+	if v == nil {
+		return
+	}
+
+	ip, ok := v.sources[address.String()]
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	key := address.String()
+	current := &runningVerification{cancel: cancel}
+
+	v.mu.Lock()
+	if previous, ok := v.running[key]; ok {
+		previous.cancel()
+	}
+	v.running[key] = current
+	v.mu.Unlock()
+
+	defer func() {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+
+		// A newer verification may have taken over already
+		if v.running[key] == current {
+			delete(v.running, key)
+		}
+	}()
+
+	logger := logrus.WithFields(logrus.Fields{
+		"address": address,
+		"probe":   v.cfg.Probe,
+	})
+
+	v.status.updateVerification(address, func(s *verificationStatus) {
+		s.State = verificationPending
+		s.Probe = v.cfg.Probe
+		s.Error = ""
+	})
+
+	failures := 0
+
+	for attempt := 1; attempt <= v.cfg.Attempts; attempt++ {
+		wait := v.cfg.Interval
+		if attempt == 1 {
+			wait = v.cfg.Delay
+		}
+
+		if !sleepContext(ctx, wait) {
+			return
+		}
+
+		ctxProbe, cancelProbe := context.WithTimeout(ctx, v.cfg.Timeout)
+		err := v.probe(ctxProbe, ip)
+		cancelProbe()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			logger.Infof("Verified reachability after %d probe(s)", attempt)
+
+			v.status.updateVerification(address, func(s *verificationStatus) {
+				s.State = verificationVerified
+				s.Checked = time.Now()
+				s.Error = ""
+			})
+			return
+		}
+
+		logger.Warningf("Reachability probe %d of %d failed: %s", attempt, v.cfg.Attempts, err)
+
+		failures++
+
+		repin := v.cfg.RepinAfter > 0 && failures >= v.cfg.RepinAfter
+
+		v.status.updateVerification(address, func(s *verificationStatus) {
+			s.State = verificationVerifying
+			if attempt == v.cfg.Attempts {
+				s.State = verificationFailed
+			}
+			s.Checked = time.Now()
+			s.Error = err.Error()
+			s.Failures++
+			if repin && attempt < v.cfg.Attempts {
+				s.Repins++
+			}
+		})
+
+		if repin && attempt < v.cfg.Attempts {
+			failures = 0
+
+			logger.Warningf("Pinning address again after %d failed probes", v.cfg.RepinAfter)
+
+			if err := v.repin(ctx, address); err != nil {
+				logger.Errorf("Pinning address again failed: %s", err)
+			}
+		}
+	}
+
+	logger.Errorf("Reachability not verified after %d probes", v.cfg.Attempts)
+}
+
+// sleepContext waits for the given duration and returns false if the context
+// was cancelled before
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	icmpEchoRequest   = 8
+	icmpEchoReply     = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+var icmpSequence uint32
+
+// icmpChecksum calculates the internet checksum as per RFC 1071
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(msg[i : i+2]))
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// probeICMP sends an echo request from the address to the target and waits
+// for the reply, which only arrives if the address is routed to this
+// machine
+func probeICMP(ctx context.Context, ip net.IP, target string) error {
+	family, source := netlinkFamily(ip)
+
+	network := "ip4"
+	domain, proto := unix.AF_INET, unix.IPPROTO_ICMP
+	request, reply := byte(icmpEchoRequest), byte(icmpEchoReply)
+	if family == unix.AF_INET6 {
+		network = "ip6"
+		domain, proto = unix.AF_INET6, unix.IPPROTO_ICMPV6
+		request, reply = icmpv6EchoRequest, icmpv6EchoReply
+	}
+
+	addrs, err := net.DefaultResolver.LookupIP(ctx, network, target)
+	if err != nil {
+		return fmt.Errorf("Resolving %q: %w", target, err)
+	}
+	dst := addrs[0]
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultVerificationTimeout)
+	}
+
+	fd, err := unix.Socket(domain, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return fmt.Errorf("Opening ICMP socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	var local, remote unix.Sockaddr
+	if domain == unix.AF_INET {
+		sa, da := &unix.SockaddrInet4{}, &unix.SockaddrInet4{}
+		copy(sa.Addr[:], source)
+		copy(da.Addr[:], dst.To4())
+		local, remote = sa, da
+	} else {
+		sa, da := &unix.SockaddrInet6{}, &unix.SockaddrInet6{}
+		copy(sa.Addr[:], source)
+		copy(da.Addr[:], dst.To16())
+		local, remote = sa, da
+	}
+
+	if err := unix.Bind(fd, local); err != nil {
+		return fmt.Errorf("Binding to %s: %w", ip, err)
+	}
+
+	id := uint16(os.Getpid())
+	seq := uint16(atomic.AddUint32(&icmpSequence, 1))
+
+	msg := []byte{request, 0, 0, 0, 0, 0, 0, 0, 'f', 'l', 'o', 'a', 't', 'y'}
+	binary.BigEndian.PutUint16(msg[4:6], id)
+	binary.BigEndian.PutUint16(msg[6:8], seq)
+	if domain == unix.AF_INET {
+		// The kernel calculates ICMPv6 checksums
+		binary.BigEndian.PutUint16(msg[2:4], icmpChecksum(msg))
+	}
+
+	if err := unix.Sendto(fd, msg, 0, remote); err != nil {
+		return fmt.Errorf("Sending echo request to %s: %w", dst, err)
+	}
+
+	buf := make([]byte, 1500)
+
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("No echo reply from %s", dst)
+		}
+
+		tv := unix.NsecToTimeval(remaining.Nanoseconds())
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			return fmt.Errorf("Setting receive timeout: %w", err)
+		}
+
+		n, from, err := unix.Recvfrom(fd, buf, 0)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Receiving echo reply: %w", err)
+		}
+
+		resp := buf[:n]
+		if domain == unix.AF_INET {
+			// IPv4 raw sockets include the IP header
+			if n < 1 || n < int(resp[0]&0x0f)*4 {
+				continue
+			}
+			resp = resp[int(resp[0]&0x0f)*4:]
+		}
+
+		if len(resp) < 8 || resp[0] != reply ||
+			binary.BigEndian.Uint16(resp[4:6]) != id || binary.BigEndian.Uint16(resp[6:8]) != seq {
+			continue
+		}
+
+		if sockaddrIP(from).Equal(dst) {
+			return nil
+		}
+	}
+}
+
+func sockaddrIP(sa unix.Sockaddr) net.IP {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(sa.Addr[:])
+	case *unix.SockaddrInet6:
+		return net.IP(sa.Addr[:])
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestVerificationProbeICMP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err := probeICMP(ctx, net.ParseIP("127.0.0.1"), "127.0.0.1")
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+		t.Skipf("Raw sockets not permitted: %s", err)
+	}
+	assert.NoError(t, err)
+
+	// Replies to an address not routed to this machine never arrive
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	assert.Error(t, probeICMP(ctx, net.ParseIP("127.0.0.1"), "192.0.2.1"))
+}
+
+func TestICMPChecksum(t *testing.T) {
+	assert.Equal(t, uint16(0xf7fe), icmpChecksum([]byte{8, 0, 0, 0, 0, 1, 0, 0}))
+	assert.Equal(t, uint16(0xf6fe), icmpChecksum([]byte{8, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1}))
+}
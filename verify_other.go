@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+func probeICMP(ctx context.Context, ip net.IP, target string) error {
+	return errors.New("ICMP verification probes are only supported on Linux")
+}
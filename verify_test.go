@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerificationProbeHTTP(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("target") {
+		case "192.0.2.10":
+			fmt.Fprintf(w, "served by %s\n", hostname)
+		case "192.0.2.11":
+			fmt.Fprintln(w, "served by other")
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	cfg := newVerificationConfig()
+	cfg.Probe = verificationProbeHTTP
+	cfg.URL = server.URL + "/?target={address}"
+	cfg.Expect = "served by {hostname}"
+
+	probe, err := cfg.newProbe(httpConfig{})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	assert.NoError(t, probe(ctx, net.ParseIP("192.0.2.10")))
+	assert.ErrorContains(t, probe(ctx, net.ParseIP("192.0.2.11")), "doesn't contain")
+	assert.ErrorContains(t, probe(ctx, net.ParseIP("192.0.2.12")), "HTTP 502 Bad Gateway")
+}
+
+func TestVerificationProbeHTTPProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		fmt.Fprintln(w, "ok")
+	}))
+	defer proxy.Close()
+
+	cfg := newVerificationConfig()
+	cfg.Probe = verificationProbeHTTP
+	cfg.URL = "http://probe.example.net/{address}"
+
+	proxyURL := mustParseTextURL(proxy.URL)
+
+	probe, err := cfg.newProbe(httpConfig{Proxy: &proxyURL})
+	require.NoError(t, err)
+
+	assert.NoError(t, probe(context.Background(), net.ParseIP("192.0.2.10")))
+	assert.Equal(t, []string{"http://probe.example.net/192.0.2.10"}, proxied)
+}
+
+func TestVerificationProbeTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	cfg := newVerificationConfig()
+	cfg.Probe = verificationProbeTCP
+	cfg.Target = listener.Addr().String()
+
+	probe, err := cfg.newProbe(httpConfig{})
+	require.NoError(t, err)
+
+	assert.NoError(t, probe(context.Background(), net.ParseIP("127.0.0.1")))
+
+	listener.Close()
+
+	assert.Error(t, probe(context.Background(), net.ParseIP("127.0.0.1")))
+}
+
+func TestVerificationProbeInvalid(t *testing.T) {
+	for _, cfg := range []verificationConfig{
+		{Probe: "udp"},
+		{Probe: verificationProbeHTTP},
+		{Probe: verificationProbeTCP},
+		{Probe: verificationProbeICMP},
+	} {
+		_, err := cfg.newProbe(httpConfig{})
+		assert.Error(t, err, cfg.Probe)
+	}
+}
+
+func TestAddressVerifier(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := newNotifyConfig()
+	cfg.ManagedAddresses = []managedAddress{{
+		Address: mustParseNetAddress("192.0.2.0/24"),
+		Local:   localAddressConfig{Interface: "eth0", Address: "192.0.2.201/24"},
+	}}
+	cfg.Verification = verificationConfig{
+		Probe:      verificationProbeTCP,
+		Target:     "198.51.100.1:80",
+		Delay:      time.Millisecond,
+		Interval:   time.Millisecond,
+		Timeout:    time.Second,
+		Attempts:   5,
+		RepinAfter: 2,
+	}
+	cfg.Status.FileTemplate = dir + "/status.%s.json"
+
+	addresses := []netAddress{
+		mustParseNetAddress("192.0.2.0/24"),
+		mustParseNetAddress("192.0.2.10"),
+		mustParseNetAddress("198.51.100.0/24"),
+	}
+
+	var mu sync.Mutex
+	probed := map[string]int{}
+	repinned := map[string]int{}
+
+	status := newStatusRecorder(cfg.Status, "test")
+
+	v, err := newAddressVerifier(cfg, addresses, status, func(ctx context.Context, address netAddress) error {
+		mu.Lock()
+		defer mu.Unlock()
+		repinned[address.String()]++
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]net.IP{
+		"192.0.2.0/24":  net.ParseIP("192.0.2.201").To4(),
+		"192.0.2.10/32": net.ParseIP("192.0.2.10").To4(),
+	}, v.sources)
+
+	v.probe = func(ctx context.Context, ip net.IP) error {
+		mu.Lock()
+		defer mu.Unlock()
+		probed[ip.String()]++
+
+		// The network succeeds on the third probe
+		if ip.String() == "192.0.2.201" && probed[ip.String()] >= 3 {
+			return nil
+		}
+		return errors.New("timeout")
+	}
+
+	ctx := context.Background()
+	for _, address := range addresses {
+		v.Verify(ctx, address)
+	}
+
+	assert.Equal(t, map[string]int{"192.0.2.201": 3, "192.0.2.10": 5}, probed)
+	assert.Equal(t, map[string]int{"192.0.2.0/24": 1, "192.0.2.10/32": 2}, repinned)
+
+	network := status.status.Addresses["192.0.2.0/24"].Verification
+	assert.Equal(t, verificationVerified, network.State)
+	assert.Equal(t, 2, network.Failures)
+	assert.Equal(t, 1, network.Repins)
+	assert.Empty(t, network.Error)
+
+	host := status.status.Addresses["192.0.2.10/32"].Verification
+	assert.Equal(t, verificationFailed, host.State)
+	assert.Equal(t, 5, host.Failures)
+	assert.Equal(t, 2, host.Repins)
+	assert.Equal(t, "timeout", host.Error)
+
+	assert.NotContains(t, status.status.Addresses, "198.51.100.0/24")
+
+	assert.FileExists(t, dir+"/status.test.json")
+}
+
+func TestAddressVerifierCancelled(t *testing.T) {
+	cfg := newNotifyConfig()
+	cfg.Verification.Probe = verificationProbeTCP
+	cfg.Verification.Target = "198.51.100.1:80"
+	cfg.Verification.Delay = time.Hour
+
+	address := mustParseNetAddress("192.0.2.10")
+
+	v, err := newAddressVerifier(cfg, []netAddress{address}, nil, nil)
+	require.NoError(t, err)
+
+	v.probe = func(ctx context.Context, ip net.IP) error {
+		t.Error("Unexpected probe")
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v.Verify(context.Background(), address)
+	}()
+
+	assert.Eventually(t, func() bool {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		return len(v.running) == 1
+	}, 5*time.Second, time.Millisecond)
+
+	// A new verification replaces the running one
+	ctx, cancel := context.WithCancel(context.Background())
+	go v.Verify(ctx, address)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Verification wasn't cancelled")
+	}
+
+	cancel()
+}
+
+func TestAddressVerifierDisabled(t *testing.T) {
+	v, err := newAddressVerifier(newNotifyConfig(), nil, nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, v)
+
+	v.Verify(context.Background(), mustParseNetAddress("192.0.2.10"))
+}
+
+func TestVerificationDuration(t *testing.T) {
+	cfg := newNotifyConfig()
+
+	// Verifications with the defaults end before the next refresh
+	assert.Equal(t, 45*time.Second, cfg.Verification.duration())
+	assert.LessOrEqual(t, cfg.Verification.duration(), cfg.RefreshInterval)
+
+	cfg.Verification.Attempts = 0
+	assert.Zero(t, cfg.Verification.duration())
+}